@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	backupFilePrefix = "horae-"
+	backupFileSuffix = ".db"
+)
+
+// backupTo writes a consistent snapshot of the database to path. The
+// snapshot is written to a temporary file first so a crash never leaves a
+// half written backup behind.
+func (db *hDataBase) backupTo(path string) (size int64, err error) {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	err = db.view("backup", func(tx *bbolt.Tx) error {
+		size, err = tx.WriteTo(file)
+		return err
+	})
+	if err != nil {
+		file.Close()
+		return 0, fmt.Errorf("write snapshot: %s", err)
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	err = file.Close()
+	if err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmpPath, path)
+}
+
+func backupFileName(now time.Time) string {
+	return backupFilePrefix + now.UTC().Format("20060102T150405") + backupFileSuffix
+}
+
+// createBackup writes a new snapshot into dir and removes the oldest ones
+// so that at most keep snapshots are left.
+func (db *hDataBase) createBackup(dir string, keep int) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, backupFileName(time.Now()))
+	size, err := db.backupTo(path)
+	if err != nil {
+		return "", err
+	}
+	logger.info("database backed up", "path", path, "size", size)
+
+	err = rotateBackups(dir, keep)
+	if err != nil {
+		logger.warn("failed to rotate backups", "dir", dir, "err", err)
+	}
+	return path, nil
+}
+
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	// names contain a sortable timestamp
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func rotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		err = os.Remove(backups[0])
+		if err != nil {
+			return err
+		}
+		logger.info("old backup removed", "path", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (db *hDataBase) runPeriodicBackups(ctx context.Context, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := db.createBackup(dir, keep)
+		if err != nil {
+			logger.error("periodic backup failed", "dir", dir, "err", err)
+		}
+	}
+}
+
+// backupHandler lets the backup command snapshot the database of a running
+// bot, which holds the exclusive lock on the file.
+func (env *environment) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	db, ok := env.db.(*hDataBase)
+	if !ok {
+		http.Error(w, "backups are supported by the bbolt storage only", http.StatusNotImplemented)
+		return
+	}
+	path, err := db.createBackup(env.backupDir, env.backupKeep)
+	if err != nil {
+		logger.error("backup requested over admin server failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, path)
+}
+
+// validateSnapshot checks that path is a consistent bbolt file with a
+// schema this binary can work with.
+func validateSnapshot(path string) (version int, err error) {
+	snapshot, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return 0, fmt.Errorf("open snapshot: %s", err)
+	}
+	defer snapshot.Close()
+
+	err = snapshot.View(func(tx *bbolt.Tx) error {
+		for checkErr := range tx.Check() {
+			return fmt.Errorf("consistency check: %s", checkErr)
+		}
+		version = readSchemaVersion(tx)
+		if version > latestSchemaVersion() {
+			return fmt.Errorf("snapshot schema version %v is newer than the latest known version %v", version, latestSchemaVersion())
+		}
+		if tx.Bucket([]byte("users")) == nil {
+			return fmt.Errorf("snapshot has no users bucket")
+		}
+		return nil
+	})
+	return version, err
+}
+
+// restoreSnapshot replaces the database file with the snapshot. The bot
+// has to be stopped, the current file is kept next to the restored one.
+func restoreSnapshot(snapshotPath string, databasePath string) (previousPath string, err error) {
+	version, err := validateSnapshot(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := bbolt.Open(databasePath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return "", fmt.Errorf("database is in use, stop the bot before restoring: %s", err)
+	}
+	current.Close()
+
+	tmpPath := databasePath + ".restore.tmp"
+	err = copyFile(snapshotPath, tmpPath)
+	if err != nil {
+		return "", err
+	}
+	previousPath = fmt.Sprintf("%v.pre-restore-%v", databasePath, time.Now().UTC().Format("20060102T150405"))
+	err = os.Rename(databasePath, previousPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	err = os.Rename(tmpPath, databasePath)
+	if err != nil {
+		os.Rename(previousPath, databasePath)
+		return "", err
+	}
+	logger.info("database restored", "snapshot", snapshotPath, "schema_version", version, "previous", previousPath)
+	return previousPath, nil
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+	err = dst.Sync()
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
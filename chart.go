@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"time"
+)
+
+const (
+	CHART_DAYS_WEEK  = 7
+	CHART_DAYS_MONTH = 30
+)
+
+const (
+	barChartWidth  = 720
+	barChartHeight = 360
+	chartMargin    = 16
+	// room for the labels of the axes
+	chartAxisWidth   = 72
+	chartAxisHeight  = 24
+	chartGridLines   = 5
+	heatmapCellSize  = 26
+	heatmapCellGap   = 2
+	glyphScale       = 2
+	glyphWidth       = 3
+	glyphHeight      = 5
+	glyphSpacing     = 1
+	heatmapHourLabel = 3
+)
+
+var (
+	colorChartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	colorChartAxis       = color.RGBA{0x55, 0x55, 0x55, 0xff}
+	colorChartGrid       = color.RGBA{0xe4, 0xe4, 0xe4, 0xff}
+	colorChartBar        = color.RGBA{0x4c, 0xaf, 0x50, 0xff}
+	colorChartGoal       = color.RGBA{0xe5, 0x39, 0x35, 0xff}
+	colorHeatmapEmpty    = color.RGBA{0xef, 0xef, 0xef, 0xff}
+)
+
+// A tiny bitmap font, there is no font rendering in the standard library.
+// Only the characters used in chart labels are drawn.
+var chartGlyphs = map[rune][glyphHeight]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", "###", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", ".#.", ".#.", ".#."},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	'A': {".#.", "#.#", "###", "#.#", "#.#"},
+	'E': {"###", "#..", "##.", "#..", "###"},
+	'F': {"###", "#..", "##.", "#..", "#.."},
+	'H': {"#.#", "#.#", "###", "#.#", "#.#"},
+	'M': {"#.#", "###", "###", "#.#", "#.#"},
+	'O': {"###", "#.#", "#.#", "#.#", "###"},
+	'R': {"##.", "#.#", "##.", "#.#", "#.#"},
+	'S': {".##", "#..", ".#.", "..#", "##."},
+	'T': {"###", ".#.", ".#.", ".#.", ".#."},
+	'U': {"#.#", "#.#", "#.#", "#.#", "###"},
+	'W': {"#.#", "#.#", "###", "###", "#.#"},
+}
+
+var chartWeekdays = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+
+func textWidth(text string) int {
+	return len([]rune(text)) * (glyphWidth + glyphSpacing) * glyphScale
+}
+
+// drawText draws the text with its top left corner at x, y. Lower case is
+// drawn as upper case, characters without a glyph are left blank.
+func drawText(img *image.RGBA, x int, y int, text string, c color.Color) {
+	for _, r := range strings.ToUpper(text) {
+		glyph, ok := chartGlyphs[r]
+		if ok {
+			for row, line := range glyph {
+				for col, pixel := range line {
+					if pixel != '#' {
+						continue
+					}
+					rect := image.Rect(x+col*glyphScale, y+row*glyphScale, x+(col+1)*glyphScale, y+(row+1)*glyphScale)
+					draw.Draw(img, rect, &image.Uniform{c}, image.Point{}, draw.Src)
+				}
+			}
+		}
+		x += (glyphWidth + glyphSpacing) * glyphScale
+	}
+}
+
+func fillRect(img *image.RGBA, rect image.Rectangle, c color.Color) {
+	draw.Draw(img, rect, &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+func encodePng(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chartStep picks a step for the grid lines so that the highest value fits
+// into chartGridLines lines.
+func chartStep(max time.Duration) time.Duration {
+	steps := []int{5, 10, 15, 30, 60, 120, 180, 240, 480}
+	for _, step := range steps {
+		if max <= time.Duration(step*chartGridLines)*time.Minute {
+			return time.Duration(step) * time.Minute
+		}
+	}
+	return time.Duration(steps[len(steps)-1]) * time.Minute
+}
+
+// focusPerDay returns the focus time of the last days in the location of
+// now, the oldest day first.
+func focusPerDay(sessions []Session, now time.Time, days int) ([]time.Duration, []time.Time) {
+	progress := progressByDay(sessions, now.Location())
+	values := make([]time.Duration, days)
+	dates := make([]time.Time, days)
+	for i := 0; i < days; i++ {
+		date := time.Date(now.Year(), now.Month(), now.Day()-(days-1-i), 0, 0, 0, 0, now.Location())
+		dates[i] = date
+		values[i] = progress[date.Format(dayLayout)].focus
+	}
+	return values, dates
+}
+
+// focusHeatmap sums up focus time by weekday, Monday first, and hour of the
+// day. Sessions crossing an hour are split between the hours.
+func focusHeatmap(sessions []Session, from time.Time, loc *time.Location) [7][24]time.Duration {
+	var cells [7][24]time.Duration
+	for _, s := range sessions {
+		if s.Kind != SESSION_KIND_FOCUS || s.StartedAt.Before(from) {
+			continue
+		}
+		start := s.StartedAt.In(loc)
+		end := start.Add(s.duration())
+		for start.Before(end) {
+			// Truncate works on absolute time, zones like +05:30 need the
+			// hour boundary built from the local clock
+			next := time.Date(start.Year(), start.Month(), start.Day(), start.Hour()+1, 0, 0, 0, loc)
+			if !next.After(start) {
+				next = start.Add(time.Hour)
+			}
+			if next.After(end) {
+				next = end
+			}
+			cells[(int(start.Weekday())+6)%7][start.Hour()] += next.Sub(start)
+			start = next
+		}
+	}
+	return cells
+}
+
+// renderBarChart draws one bar per day, a goal above zero is drawn as a line.
+func renderBarChart(values []time.Duration, dates []time.Time, goal time.Duration) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, barChartWidth, barChartHeight))
+	fillRect(img, img.Bounds(), colorChartBackground)
+
+	max := goal
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+	step := chartStep(max)
+	top := chartMargin
+	bottom := barChartHeight - chartAxisHeight
+	left := chartAxisWidth
+	right := barChartWidth - chartMargin
+	scale := float64(bottom-top) / float64(step*chartGridLines)
+	yOf := func(d time.Duration) int {
+		return bottom - int(float64(d)*scale)
+	}
+
+	for i := 0; i <= chartGridLines; i++ {
+		value := step * time.Duration(i)
+		y := yOf(value)
+		fillRect(img, image.Rect(left, y, right, y+1), colorChartGrid)
+		label := formatDuration(value)
+		drawText(img, left-textWidth(label)-4, y-glyphHeight*glyphScale/2, label, colorChartAxis)
+	}
+
+	slot := (right - left) / len(values)
+	barWidth := slot * 2 / 3
+	for i, value := range values {
+		x := left + i*(right-left)/len(values) + (slot-barWidth)/2
+		if value > 0 {
+			fillRect(img, image.Rect(x, yOf(value), x+barWidth, bottom), colorChartBar)
+		}
+		label := fmt.Sprint(dates[i].Day())
+		if len(values) <= CHART_DAYS_WEEK {
+			label = chartWeekdays[(int(dates[i].Weekday())+6)%7]
+		}
+		drawText(img, x+(barWidth-textWidth(label))/2+glyphScale, bottom+8, label, colorChartAxis)
+	}
+	fillRect(img, image.Rect(left, bottom, right, bottom+1), colorChartAxis)
+	if goal > 0 {
+		y := yOf(goal)
+		fillRect(img, image.Rect(left, y-1, right, y+1), colorChartGoal)
+	}
+	return encodePng(img)
+}
+
+// renderHeatmap draws the weekdays as rows and the hours as columns, the
+// more focus the darker the cell.
+func renderHeatmap(cells [7][24]time.Duration) ([]byte, error) {
+	cellStep := heatmapCellSize + heatmapCellGap
+	width := chartAxisWidth + 24*cellStep + chartMargin
+	height := chartMargin + 7*cellStep + chartAxisHeight
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fillRect(img, img.Bounds(), colorChartBackground)
+
+	var max time.Duration
+	for _, row := range cells {
+		for _, value := range row {
+			if value > max {
+				max = value
+			}
+		}
+	}
+
+	for day, row := range cells {
+		y := chartMargin + day*cellStep
+		drawText(img, chartAxisWidth-textWidth(chartWeekdays[day])-4, y+(heatmapCellSize-glyphHeight*glyphScale)/2, chartWeekdays[day], colorChartAxis)
+		for hour, value := range row {
+			x := chartAxisWidth + hour*cellStep
+			c := colorHeatmapEmpty
+			if value > 0 {
+				c = blendColor(colorHeatmapEmpty, colorChartBar, 0.25+0.75*float64(value)/float64(max))
+			}
+			fillRect(img, image.Rect(x, y, x+heatmapCellSize, y+heatmapCellSize), c)
+		}
+	}
+	for hour := 0; hour < 24; hour += heatmapHourLabel {
+		label := fmt.Sprint(hour)
+		x := chartAxisWidth + hour*cellStep + (heatmapCellSize-textWidth(label))/2
+		drawText(img, x, chartMargin+7*cellStep+6, label, colorChartAxis)
+	}
+	return encodePng(img)
+}
+
+func blendColor(from color.RGBA, to color.RGBA, ratio float64) color.RGBA {
+	mix := func(a uint8, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*ratio)
+	}
+	return color.RGBA{mix(from.R, to.R), mix(from.G, to.G), mix(from.B, to.B), 0xff}
+}
+
+// parseChartDays parses the argument of /chart, the number of days shown.
+func parseChartDays(args []string) (int, bool) {
+	if len(args) == 0 {
+		return CHART_DAYS_WEEK, true
+	}
+	switch args[0] {
+	case fmt.Sprint(CHART_DAYS_WEEK):
+		return CHART_DAYS_WEEK, true
+	case fmt.Sprint(CHART_DAYS_MONTH):
+		return CHART_DAYS_MONTH, true
+	}
+	return 0, false
+}
+
+// sendCharts sends the focus time per day and the heatmap of the last days
+// as photos. It returns false when there is nothing to draw.
+func (env *environment) sendCharts(chatId ChatId, user User, days int) (bool, error) {
+	sessions, err := env.db.getSessions(chatId, time.Time{}, time.Time{})
+	if err != nil {
+		return false, fmt.Errorf("load sessions: %s", err)
+	}
+	now := time.Now().In(user.location())
+	values, dates := focusPerDay(sessions, now, days)
+	var total time.Duration
+	for _, value := range values {
+		total += value
+	}
+	if total < time.Minute {
+		return false, nil
+	}
+
+	var goal time.Duration
+	if user.Goal.isSet() && user.Goal.Kind == GOAL_MINUTES {
+		goal = time.Duration(user.Goal.Value) * time.Minute
+	}
+	barChart, err := renderBarChart(values, dates, goal)
+	if err != nil {
+		return false, fmt.Errorf("render bar chart: %s", err)
+	}
+	heatmap, err := renderHeatmap(focusHeatmap(sessions, dates[0], now.Location()))
+	if err != nil {
+		return false, fmt.Errorf("render heatmap: %s", err)
+	}
+
+	err = env.sendPhoto(chatId, PRIORITY_INTERACTIVE, fmt.Sprintf("focus-%vd.png", days), barChart,
+		fmt.Sprintf("Focus time per day, last %v days - %v", days, formatDuration(total)))
+	if err != nil {
+		return false, err
+	}
+	err = env.sendPhoto(chatId, PRIORITY_INTERACTIVE, fmt.Sprintf("focus-hours-%vd.png", days), heatmap,
+		fmt.Sprintf("When you focus by weekday and hour, last %v days", days))
+	return true, err
+}
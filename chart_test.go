@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFocusHeatmapHalfHourZone(t *testing.T) {
+	loc := time.FixedZone("IST", 5*60*60+30*60)
+	// Monday 10:00-11:30 local time
+	start := time.Date(2026, 3, 2, 10, 0, 0, 0, loc)
+	session := testSession(1, start.UTC())
+	session.EndedAt = session.StartedAt.Add(90 * time.Minute)
+
+	cells := focusHeatmap([]Session{session}, time.Time{}, loc)
+	if cells[0][10] != time.Hour || cells[0][11] != 30*time.Minute {
+		t.Fatalf("expected 1h at 10:00 and 30m at 11:00, got %v and %v", cells[0][10], cells[0][11])
+	}
+	var total time.Duration
+	for _, day := range cells {
+		for _, cell := range day {
+			total += cell
+		}
+	}
+	if total != 90*time.Minute {
+		t.Fatalf("expected 90m in total, got %v", total)
+	}
+}
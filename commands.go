@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type command struct {
+	usage string
+	run   func(cfg Config, args []string) error
+}
+
+var commands = map[string]command{
+	"backup": {
+		usage: "backup [-out file] - write a consistent snapshot of the database",
+		run:   backupCommand,
+	},
+	"db": {
+		usage: "db stats|wipe-bucket <name> [-json] - show bucket statistics or empty a bucket after a backup, the bot must be stopped",
+		run:   dbCommand,
+	},
+	"export": {
+		usage: "export -chat id [-from YYYY-MM-DD] [-to YYYY-MM-DD] [-tag name] [-format csv|ics|json] [-out file] - export the session history of a user",
+		run:   exportCommand,
+	},
+	"migrate-sqlite": {
+		usage: "migrate-sqlite [-to file] - copy the bbolt database into sqlite, the bot must be stopped",
+		run:   migrateSqliteCommand,
+	},
+	"repl": {
+		usage: "repl [-storage memory|bbolt|sqlite] [-user id] [-name name] [-files dir] - chat with the bot on the terminal, in memory by default",
+		run:   replCommand,
+	},
+	"restore": {
+		usage: "restore -from file - validate a snapshot and swap it in, the bot must be stopped",
+		run:   restoreCommand,
+	},
+	"users": {
+		usage: "users list|show <chat id>|delete <chat id> [-json] - inspect or remove stored users, the bot must be stopped",
+		run:   usersCommand,
+	},
+	"webhook": {
+		usage: "webhook info [-json] - show the webhook registered with Telegram",
+		run:   webhookCommand,
+	},
+}
+
+func printCommandsUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %v\n", commands[name].usage)
+	}
+}
+
+// runCommand executes a maintenance subcommand, it returns false when name
+// is not a known command.
+func runCommand(cfg Config, name string, args []string) bool {
+	cmd, ok := commands[name]
+	if !ok {
+		return false
+	}
+	err := cmd.run(cfg, args)
+	if err != nil {
+		// errors of Bot API calls contain the token
+		fmt.Fprintf(os.Stderr, "%v: %v\n", name, logger.output.redact(err.Error()))
+		os.Exit(1)
+	}
+	return true
+}
+
+func backupCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "snapshot file, defaults to a new file in the backup directory")
+	flags.Parse(args)
+
+	db := &hDataBase{path: cfg.DatabasePath}
+	err := db.openExisting()
+	if err != nil {
+		// the running bot holds the lock, ask it to make the backup
+		logger.info("database is locked, requesting backup from the running bot", "admin_address", cfg.AdminAddress)
+		if *out != "" {
+			return fmt.Errorf("-out can't be used while the bot is running: %s", err)
+		}
+		return requestOnlineBackup(cfg.AdminAddress)
+	}
+	defer db.closeDB()
+
+	if *out == "" {
+		path, err := db.createBackup(cfg.BackupDir, cfg.BackupKeep)
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(*out), 0755)
+	if err != nil {
+		return err
+	}
+	_, err = db.backupTo(*out)
+	if err != nil {
+		return err
+	}
+	fmt.Println(*out)
+	return nil
+}
+
+func requestOnlineBackup(adminAddress string) error {
+	client := http.Client{Timeout: time.Minute}
+	resp, err := client.Post("http://"+adminAddress+"/backup", "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup failed, status code - [%v], description - [%s]", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	fmt.Print(string(body))
+	return nil
+}
+
+func restoreCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "snapshot file to restore")
+	flags.Parse(args)
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+	previousPath, err := restoreSnapshot(*from, cfg.DatabasePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %v, the previous database is kept at %v\n", *from, previousPath)
+	return nil
+}
+
+func migrateSqliteCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("migrate-sqlite", flag.ExitOnError)
+	to := flags.String("to", cfg.SqlitePath, "sqlite database file")
+	flags.Parse(args)
+
+	from, err := openMaintenanceDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer from.closeDB()
+
+	db, err := openSqliteStorage(*to)
+	if err != nil {
+		return fmt.Errorf("open %v: %s", *to, err)
+	}
+	defer db.closeDB()
+
+	stats, err := copyBboltToSqlite(from, db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("copied %v users, %v timers, %v sessions, %v partnerships, %v deferred messages, %v leaderboard opt-outs and %v meta keys to %v\n",
+		stats.users, stats.timers, stats.sessions, stats.partners, stats.deferred, stats.optOuts, stats.meta, *to)
+	return nil
+}
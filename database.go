@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"go.etcd.io/bbolt"
-	"log"
 	"os"
+	"path/filepath"
+	"time"
 )
 
-const dataFolderPath = "data"
+const (
+	dataFolderPath          = "data"
+	defaultDatabaseFilePath = dataFolderPath + "/horae.db"
+)
+
+var requiredBuckets = []string{"users", "timers", "sessions", "partners", "deferred", optOutsBucketName, metaBucketName}
 
+// hDataBase is the default bbolt backed Storage.
 type hDataBase struct {
-	db *bbolt.DB
+	db   *bbolt.DB
+	path string
 }
 
 // itob returns an 8-byte big endian representation of v.
@@ -22,48 +31,60 @@ func itob(v int64) []byte {
 	return b
 }
 
-func createBucketIfNotExists(bucketName []byte, db *bbolt.DB) error {
-	return db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucketName)
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
-		}
-		return nil
-	})
+// btoi is the reverse of itob.
+func btoi(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
 }
 
-func (db *hDataBase) initDB(wipeBucket *string) {
-	_, err := os.Stat(dataFolderPath)
+// update runs fn in a read-write transaction and records its duration.
+func (db *hDataBase) update(operation string, fn func(tx *bbolt.Tx) error) error {
+	defer dbTransactionDuration.observeSince(time.Now(), operation)
+	return db.db.Update(fn)
+}
+
+// view runs fn in a read-only transaction and records its duration.
+func (db *hDataBase) view(operation string, fn func(tx *bbolt.Tx) error) error {
+	defer dbTransactionDuration.observeSince(time.Now(), operation)
+	return db.db.View(fn)
+}
+
+func (db *hDataBase) openDB() {
+	folderPath := filepath.Dir(db.path)
+	_, err := os.Stat(folderPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			os.Mkdir(dataFolderPath, 0755)
+			os.MkdirAll(folderPath, 0755)
 		} else {
-			log.Fatal(err)
+			logger.fatal("failed to access data folder", "err", err)
 		}
 	}
-	db.db, err = bbolt.Open("data/horae.db", 0600, nil)
+	db.db, err = bbolt.Open(db.path, 0600, &bbolt.Options{Timeout: time.Second})
 	if err != nil {
-		log.Fatal(err)
+		logger.fatal("failed to open database", "err", err)
 	}
+}
 
-	var requiredBuckets = []string{"users"}
-	for _, bucketName := range requiredBuckets {
-		err := createBucketIfNotExists([]byte(bucketName), db.db)
-		if err != nil {
-			log.Fatal(err)
-		}
+// openExisting opens the database for maintenance commands, unlike openDB
+// it reports errors instead of exiting and never creates a new file.
+func (db *hDataBase) openExisting() error {
+	_, err := os.Stat(db.path)
+	if err != nil {
+		return err
 	}
+	db.db, err = bbolt.Open(db.path, 0600, &bbolt.Options{Timeout: time.Second})
+	return err
+}
 
-	if *wipeBucket != "" {
-		err = db.wipeBucket([]byte(*wipeBucket))
-		if err != nil {
-			log.Fatal(err)
-		}
+func (db *hDataBase) initDB() {
+	db.openDB()
+	err := db.migrate(false)
+	if err != nil {
+		logger.fatal("failed to migrate database", "err", err)
 	}
 }
 
 func (db *hDataBase) saveUserData(chatId ChatId, user User) error {
-	return db.db.Update(func(tx *bbolt.Tx) error {
+	return db.update("save_user", func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("users"))
 		jsonBuf, err := json.Marshal(user)
 		if err != nil {
@@ -77,9 +98,351 @@ func (db *hDataBase) saveUserData(chatId ChatId, user User) error {
 	})
 }
 
+// deleteUserData removes the user together with the timer and the session
+// history of the chat, and takes them off the group sessions they joined.
+func (db *hDataBase) deleteUserData(chatId ChatId) error {
+	return db.update("delete_user", func(tx *bbolt.Tx) error {
+		key := itob(int64(chatId))
+		for _, bucketName := range []string{"users", "timers"} {
+			err := tx.Bucket([]byte(bucketName)).Delete(key)
+			if err != nil {
+				return fmt.Errorf("delete from %v: %s", bucketName, err)
+			}
+		}
+		sessions := tx.Bucket([]byte("sessions"))
+		if chatSessions := sessions.Bucket(key); chatSessions != nil {
+			err := removeFromGroupSessions(sessions, chatSessions, chatId)
+			if err != nil {
+				return err
+			}
+			err = sessions.DeleteBucket(key)
+			if err != nil {
+				return fmt.Errorf("delete sessions: %s", err)
+			}
+		}
+		partnerships, err := partnershipsOf(tx, chatId)
+		if err != nil {
+			return err
+		}
+		for _, partnership := range partnerships {
+			err = tx.Bucket([]byte("partners")).Delete(partnership.key())
+			if err != nil {
+				return fmt.Errorf("delete partnership: %s", err)
+			}
+		}
+		err = deleteDeferredMessagesOf(tx, chatId)
+		if err != nil {
+			return err
+		}
+		return deleteOptOutsOf(tx, chatId)
+	})
+}
+
+// removeFromGroupSessions drops the user from the participants of the
+// group sessions their own sessions point to.
+func removeFromGroupSessions(sessions *bbolt.Bucket, chatSessions *bbolt.Bucket, chatId ChatId) error {
+	own := make([]Session, 0)
+	err := chatSessions.ForEach(func(_, v []byte) error {
+		var session Session
+		err := json.Unmarshal(v, &session)
+		if err != nil {
+			return fmt.Errorf("unmarshal session: %s", err)
+		}
+		own = append(own, session)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, groupId := range groupIdsOf(own) {
+		b := sessions.Bucket(itob(int64(groupId)))
+		if b == nil {
+			continue
+		}
+		changed := make(map[string][]byte)
+		err = b.ForEach(func(k, v []byte) error {
+			var session Session
+			err := json.Unmarshal(v, &session)
+			if err != nil {
+				return fmt.Errorf("unmarshal group session: %s", err)
+			}
+			if !session.removeParticipant(int64(chatId)) {
+				return nil
+			}
+			jsonBuf, err := json.Marshal(session)
+			if err != nil {
+				return fmt.Errorf("marshal group session: %s", err)
+			}
+			changed[string(k)] = jsonBuf
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, jsonBuf := range changed {
+			err = b.Put([]byte(k), jsonBuf)
+			if err != nil {
+				return fmt.Errorf("save group session: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Sessions are kept in a nested bucket per chat keyed by the session id,
+// which is the start time in nanoseconds, so cursors walk them in order.
+func (db *hDataBase) saveSession(session Session) error {
+	return db.update("save_session", func(tx *bbolt.Tx) error {
+		b, err := tx.Bucket([]byte("sessions")).CreateBucketIfNotExists(itob(int64(session.ChatId)))
+		if err != nil {
+			return fmt.Errorf("create chat sessions bucket: %s", err)
+		}
+		jsonBuf, err := json.Marshal(session)
+		if err != nil {
+			return fmt.Errorf("marshal session: %s", err)
+		}
+		err = b.Put(itob(session.Id), jsonBuf)
+		if err != nil {
+			return fmt.Errorf("save session: %s", err)
+		}
+		return nil
+	})
+}
+
+func (db *hDataBase) getSession(chatId ChatId, sessionId int64) (Session, error) {
+	var session Session
+	err := db.view("get_session", func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("sessions")).Bucket(itob(int64(chatId)))
+		if b == nil {
+			return fmt.Errorf("no sessions for chat id [%v]", chatId)
+		}
+		v := b.Get(itob(sessionId))
+		if v == nil {
+			return fmt.Errorf("session [%v] of chat id [%v] not found", sessionId, chatId)
+		}
+		return json.Unmarshal(v, &session)
+	})
+	return session, err
+}
+
+func (db *hDataBase) getSessions(chatId ChatId, from time.Time, to time.Time) ([]Session, error) {
+	sessions := make([]Session, 0)
+	err := db.view("get_sessions", func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("sessions")).Bucket(itob(int64(chatId)))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		k, v := c.First()
+		if !from.IsZero() {
+			k, v = c.Seek(itob(from.UnixNano()))
+		}
+		for ; k != nil; k, v = c.Next() {
+			var session Session
+			err := json.Unmarshal(v, &session)
+			if err != nil {
+				return fmt.Errorf("unmarshal session: %s", err)
+			}
+			if !to.IsZero() && !session.StartedAt.Before(to) {
+				break
+			}
+			sessions = append(sessions, session)
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+// Partnerships are keyed by both chat ids, the lower one first, so a pair
+// is stored once whoever invited whom.
+func (db *hDataBase) savePartnership(partnership Partnership) error {
+	return db.update("save_partnership", func(tx *bbolt.Tx) error {
+		jsonBuf, err := json.Marshal(partnership)
+		if err != nil {
+			return fmt.Errorf("marshal partnership: %s", err)
+		}
+		err = tx.Bucket([]byte("partners")).Put(partnership.key(), jsonBuf)
+		if err != nil {
+			return fmt.Errorf("save partnership: %s", err)
+		}
+		return nil
+	})
+}
+
+func (db *hDataBase) deletePartnership(partnership Partnership) error {
+	return db.update("delete_partnership", func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("partners")).Delete(partnership.key())
+	})
+}
+
+func (db *hDataBase) getPartnerships(chatId ChatId) (partnerships []Partnership, err error) {
+	err = db.view("get_partnerships", func(tx *bbolt.Tx) error {
+		partnerships, err = partnershipsOf(tx, chatId)
+		return err
+	})
+	return partnerships, err
+}
+
+// partnershipsOf walks the whole bucket, a chat has only a few partners
+// but they can be on either side of the key.
+func partnershipsOf(tx *bbolt.Tx, chatId ChatId) ([]Partnership, error) {
+	partnerships := make([]Partnership, 0)
+	err := tx.Bucket([]byte("partners")).ForEach(func(_, v []byte) error {
+		var partnership Partnership
+		err := json.Unmarshal(v, &partnership)
+		if err != nil {
+			return fmt.Errorf("unmarshal partnership: %s", err)
+		}
+		if partnership.includes(chatId) {
+			partnerships = append(partnerships, partnership)
+		}
+		return nil
+	})
+	return partnerships, err
+}
+
+// Deferred messages are keyed by when they are due, so getting the due
+// ones stops at the first message that isn't.
+func (db *hDataBase) saveDeferredMessage(msg DeferredMessage) error {
+	return db.update("save_deferred_message", func(tx *bbolt.Tx) error {
+		jsonBuf, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("marshal deferred message: %s", err)
+		}
+		err = tx.Bucket([]byte("deferred")).Put(msg.key(), jsonBuf)
+		if err != nil {
+			return fmt.Errorf("save deferred message: %s", err)
+		}
+		return nil
+	})
+}
+
+func (db *hDataBase) deleteDeferredMessage(msg DeferredMessage) error {
+	return db.update("delete_deferred_message", func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("deferred")).Delete(msg.key())
+	})
+}
+
+func (db *hDataBase) getDeferredMessages(until time.Time) (messages []DeferredMessage, err error) {
+	messages = make([]DeferredMessage, 0)
+	end := itob(until.UnixNano())
+	err = db.view("get_deferred_messages", func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte("deferred")).Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], end) <= 0; k, v = c.Next() {
+			var msg DeferredMessage
+			err := json.Unmarshal(v, &msg)
+			if err != nil {
+				return fmt.Errorf("unmarshal deferred message: %s", err)
+			}
+			messages = append(messages, msg)
+		}
+		return nil
+	})
+	return messages, err
+}
+
+// deleteDeferredMessagesOf walks the whole bucket, only messages held back
+// for the current quiet hours are in it.
+func deleteDeferredMessagesOf(tx *bbolt.Tx, chatId ChatId) error {
+	b := tx.Bucket([]byte("deferred"))
+	keys := make([][]byte, 0)
+	err := b.ForEach(func(k, v []byte) error {
+		var msg DeferredMessage
+		err := json.Unmarshal(v, &msg)
+		if err != nil {
+			return fmt.Errorf("unmarshal deferred message: %s", err)
+		}
+		if msg.Message.ChatId == chatId {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return fmt.Errorf("delete deferred message: %s", err)
+		}
+	}
+	return nil
+}
+
+// Leaderboard opt-outs are keyed by the group id followed by the user id,
+// the keys of a group are next to each other.
+func optOutKey(groupId ChatId, userId int64) []byte {
+	return append(itob(int64(groupId)), itob(userId)...)
+}
+
+func (db *hDataBase) setLeaderboardOptOut(groupId ChatId, userId int64, optOut bool) error {
+	return db.update("set_leaderboard_opt_out", func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(optOutsBucketName))
+		if !optOut {
+			return b.Delete(optOutKey(groupId, userId))
+		}
+		err := b.Put(optOutKey(groupId, userId), []byte{})
+		if err != nil {
+			return fmt.Errorf("save leaderboard opt-out: %s", err)
+		}
+		return nil
+	})
+}
+
+func (db *hDataBase) getLeaderboardOptOuts(groupId ChatId) (optOuts map[int64]bool, err error) {
+	optOuts = make(map[int64]bool)
+	prefix := itob(int64(groupId))
+	err = db.view("get_leaderboard_opt_outs", func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(optOutsBucketName)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			optOuts[btoi(k[8:])] = true
+		}
+		return nil
+	})
+	return optOuts, err
+}
+
+// deleteOptOutsOf removes the opt-outs of the user in every group, and
+// those of the chat itself when it is a group.
+func deleteOptOutsOf(tx *bbolt.Tx, chatId ChatId) error {
+	b := tx.Bucket([]byte(optOutsBucketName))
+	id := itob(int64(chatId))
+	keys := make([][]byte, 0)
+	err := b.ForEach(func(k, _ []byte) error {
+		if bytes.Equal(k[:8], id) || bytes.Equal(k[8:], id) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return fmt.Errorf("delete leaderboard opt-out: %s", err)
+		}
+	}
+	return nil
+}
+
+func (db *hDataBase) getMeta(key string) (value string, err error) {
+	err = db.view("get_meta", func(tx *bbolt.Tx) error {
+		value = string(tx.Bucket([]byte(metaBucketName)).Get([]byte(key)))
+		return nil
+	})
+	return
+}
+
+func (db *hDataBase) setMeta(key string, value string) error {
+	return db.update("set_meta", func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(metaBucketName)).Put([]byte(key), []byte(value))
+	})
+}
+
 func (db *hDataBase) getAllUsersData() (map[ChatId]User, error) {
 	users := make(map[ChatId]User, 0)
-	err := db.db.View(func(tx *bbolt.Tx) error {
+	err := db.view("get_all_users", func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("users"))
 		c := b.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
@@ -88,7 +451,7 @@ func (db *hDataBase) getAllUsersData() (map[ChatId]User, error) {
 			if err != nil {
 				return fmt.Errorf("unmarshal user: %s", err)
 			}
-			chatId := ChatId(binary.BigEndian.Uint64(k))
+			chatId := ChatId(btoi(k))
 			users[chatId] = user
 		}
 		return nil
@@ -99,29 +462,92 @@ func (db *hDataBase) getAllUsersData() (map[ChatId]User, error) {
 	return users, nil
 }
 
+// saveTimers replaces the stored timers with the given ones.
+func (db *hDataBase) saveTimers(timers map[ChatId]TimeKeeperState) error {
+	return db.update("save_timers", func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte("timers"))
+		if err != nil {
+			return fmt.Errorf("delete timers bucket: %s", err)
+		}
+		b, err := tx.CreateBucket([]byte("timers"))
+		if err != nil {
+			return fmt.Errorf("create timers bucket: %s", err)
+		}
+		for chatId, state := range timers {
+			jsonBuf, err := json.Marshal(state)
+			if err != nil {
+				return fmt.Errorf("marshal timer: %s", err)
+			}
+			err = b.Put(itob(int64(chatId)), jsonBuf)
+			if err != nil {
+				return fmt.Errorf("save timer: %s", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (db *hDataBase) getAllTimers() (map[ChatId]TimeKeeperState, error) {
+	timers := make(map[ChatId]TimeKeeperState)
+	err := db.view("get_all_timers", func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("timers"))
+		return b.ForEach(func(k, v []byte) error {
+			var state TimeKeeperState
+			err := json.Unmarshal(v, &state)
+			if err != nil {
+				return fmt.Errorf("unmarshal timer: %s", err)
+			}
+			timers[ChatId(btoi(k))] = state
+			return nil
+		})
+	})
+	return timers, err
+}
+
+// wipeBucket replaces the bucket with an empty one in a single transaction.
 func (db *hDataBase) wipeBucket(bucketName []byte) error {
-	err := db.db.Update(func(tx *bbolt.Tx) error {
+	return db.update("wipe_bucket", func(tx *bbolt.Tx) error {
 		err := tx.DeleteBucket(bucketName)
 		if err != nil {
 			return fmt.Errorf("delete bucket: %s", err)
 		}
-		fmt.Println("Bucket deleted")
-		return nil
-	})
-	if err != nil {
-		log.Fatalf("Error: %s", err)
-		return err
-	}
-	return db.db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucket(bucketName)
+		_, err = tx.CreateBucket(bucketName)
 		if err != nil {
 			return fmt.Errorf("create bucket: %s", err)
 		}
-		fmt.Println("Bucket created")
+		logger.info("bucket wiped", "bucket", string(bucketName))
 		return nil
 	})
 }
 
 func (db *hDataBase) closeDB() {
 	db.db.Close()
+}
+
+// checkOpen makes sure the database file is still there and bbolt has not been closed.
+func (db *hDataBase) checkOpen() error {
+	if db.db == nil {
+		return fmt.Errorf("database is not initialised")
+	}
+	_, err := os.Stat(db.db.Path())
+	if err != nil {
+		return err
+	}
+	tx, err := db.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	return tx.Rollback()
+}
+
+// checkReadable opens a read transaction and makes sure every required bucket is there.
+func (db *hDataBase) checkReadable() error {
+	return db.view("health_check", func(tx *bbolt.Tx) error {
+		for _, bucketName := range requiredBuckets {
+			if tx.Bucket([]byte(bucketName)) == nil {
+				return fmt.Errorf("bucket [%v] is missing", bucketName)
+			}
+		}
+		return nil
+	})
 }
\ No newline at end of file
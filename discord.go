@@ -0,0 +1,833 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultDiscordApiUrl  = "https://discord.com/api/v10"
+	discordGatewayVersion = "10"
+	// GUILD_MESSAGES, DIRECT_MESSAGES and MESSAGE_CONTENT
+	discordIntents        = 1<<9 | 1<<12 | 1<<15
+	discordReconnectDelay = 5 * time.Second
+	discordMaxContent     = 2000
+	discordMaxLabel       = 80
+	discordMaxRowButtons  = 5
+	discordMaxRows        = 5
+	// buttons of a reply keyboard send their text back as a message, the
+	// custom id of an inline button is its data
+	discordKeyboardPrefix = "key:"
+)
+
+// Gateway opcodes.
+const (
+	DISCORD_OP_DISPATCH        = 0
+	DISCORD_OP_HEARTBEAT       = 1
+	DISCORD_OP_IDENTIFY        = 2
+	DISCORD_OP_RECONNECT       = 7
+	DISCORD_OP_INVALID_SESSION = 9
+	DISCORD_OP_HELLO           = 10
+	DISCORD_OP_HEARTBEAT_ACK   = 11
+)
+
+const (
+	DISCORD_COMPONENT_ACTION_ROW   = 1
+	DISCORD_COMPONENT_BUTTON       = 2
+	DISCORD_BUTTON_STYLE_PRIMARY   = 1
+	DISCORD_BUTTON_STYLE_SECONDARY = 2
+
+	DISCORD_INTERACTION_COMPONENT       = 3
+	DISCORD_CALLBACK_MESSAGE            = 4
+	DISCORD_CALLBACK_DEFERRED_UPDATE    = 6
+	DISCORD_FLAG_EPHEMERAL              = 1 << 6
+	DISCORD_FLAG_SUPPRESS_NOTIFICATIONS = 1 << 12
+	DISCORD_METHOD_CREATE_MESSAGE       = "createMessage"
+	DISCORD_METHOD_EDIT_MESSAGE         = "editMessage"
+	DISCORD_METHOD_INTERACTION_CALLBACK = "createInteractionResponse"
+	DISCORD_METHOD_CREATE_DM            = "createDM"
+	DISCORD_METHOD_GET_GATEWAY          = "getGatewayBot"
+	DISCORD_EVENT_READY                 = "READY"
+	DISCORD_EVENT_MESSAGE_CREATE        = "MESSAGE_CREATE"
+	DISCORD_EVENT_INTERACTION_CREATE    = "INTERACTION_CREATE"
+)
+
+type DUser struct {
+	Id         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Bot        bool   `json:"bot"`
+}
+
+type DMember struct {
+	User DUser `json:"user"`
+}
+
+type DMessage struct {
+	Id        string `json:"id"`
+	ChannelId string `json:"channel_id"`
+	GuildId   string `json:"guild_id"`
+	Author    DUser  `json:"author"`
+	Content   string `json:"content"`
+}
+
+type DComponent struct {
+	Type       int          `json:"type"`
+	Style      int          `json:"style,omitempty"`
+	Label      string       `json:"label,omitempty"`
+	CustomId   string       `json:"custom_id,omitempty"`
+	Components []DComponent `json:"components,omitempty"`
+}
+
+type DAllowedMentions struct {
+	Parse []string `json:"parse"`
+}
+
+// DMessageSend creates or edits a message, an empty list of components
+// removes the buttons of an edited message.
+type DMessageSend struct {
+	Content         string           `json:"content"`
+	Components      []DComponent     `json:"components"`
+	Flags           int              `json:"flags,omitempty"`
+	AllowedMentions DAllowedMentions `json:"allowed_mentions"`
+}
+
+type DInteractionData struct {
+	CustomId string `json:"custom_id"`
+}
+
+// DInteraction is sent when a button is pressed, Member is set in guilds
+// and User in direct messages.
+type DInteraction struct {
+	Id        string           `json:"id"`
+	Token     string           `json:"token"`
+	Type      int              `json:"type"`
+	ChannelId string           `json:"channel_id"`
+	GuildId   string           `json:"guild_id"`
+	Member    *DMember         `json:"member"`
+	User      *DUser           `json:"user"`
+	Message   DMessage         `json:"message"`
+	Data      DInteractionData `json:"data"`
+}
+
+type DInteractionCallbackData struct {
+	Content string `json:"content"`
+	Flags   int    `json:"flags,omitempty"`
+}
+
+type DInteractionResponse struct {
+	Type int                       `json:"type"`
+	Data *DInteractionCallbackData `json:"data,omitempty"`
+}
+
+type DGatewayPayload struct {
+	Op       int             `json:"op"`
+	Data     json.RawMessage `json:"d"`
+	Sequence *int64          `json:"s,omitempty"`
+	Event    string          `json:"t,omitempty"`
+}
+
+type DHello struct {
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+}
+
+type DIdentifyProperties struct {
+	Os      string `json:"os"`
+	Browser string `json:"browser"`
+	Device  string `json:"device"`
+}
+
+type DIdentify struct {
+	Token      string              `json:"token"`
+	Intents    int                 `json:"intents"`
+	Properties DIdentifyProperties `json:"properties"`
+}
+
+type DReady struct {
+	User      DUser  `json:"user"`
+	SessionId string `json:"session_id"`
+}
+
+type DGatewayBot struct {
+	Url string `json:"url"`
+}
+
+type DChannel struct {
+	Id string `json:"id"`
+}
+
+type DCreateDM struct {
+	RecipientId string `json:"recipient_id"`
+}
+
+type DApiError struct {
+	Message    string  `json:"message"`
+	RetryAfter float64 `json:"retry_after"`
+}
+
+type gatewayStatus struct {
+	mut       sync.Mutex
+	sessionId string
+	readyAt   time.Time
+	err       error
+}
+
+func (s *gatewayStatus) ready(sessionId string) {
+	s.mut.Lock()
+	s.sessionId = sessionId
+	s.readyAt = time.Now()
+	s.err = nil
+	s.mut.Unlock()
+}
+
+func (s *gatewayStatus) fail(err error) {
+	s.mut.Lock()
+	s.readyAt = time.Time{}
+	s.err = err
+	s.mut.Unlock()
+}
+
+// discordMessenger receives messages and button presses through the
+// Discord gateway and answers through the REST API. Private chats are
+// keyed by the id of the user like on Telegram, guild channels by their
+// negated id so they count as groups.
+type discordMessenger struct {
+	client  http.Client
+	botKey  string
+	apiUrl  string
+	handler updateHandler
+	status  gatewayStatus
+
+	mut        sync.Mutex
+	botUserId  string
+	conn       *wsConn
+	dmChannels map[ChatId]string
+	// acks are the interactions being acknowledged, the gateway keeps
+	// reading while they are
+	acks sync.WaitGroup
+
+	reconnectDelay time.Duration
+	ctx            context.Context
+	cancel         context.CancelFunc
+	done           chan struct{}
+}
+
+func newDiscordMessenger(cfg Config) *discordMessenger {
+	if cfg.DiscordBotToken == "" {
+		logger.fatal("discord bot token is not set")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &discordMessenger{
+		client:         http.Client{Timeout: 30 * time.Second},
+		botKey:         cfg.DiscordBotToken,
+		apiUrl:         strings.TrimSuffix(cfg.DiscordApiUrl, "/"),
+		dmChannels:     make(map[ChatId]string),
+		reconnectDelay: discordReconnectDelay,
+		ctx:            ctx,
+		cancel:         cancel,
+		done:           make(chan struct{}),
+	}
+}
+
+func (d *discordMessenger) name() string {
+	return MESSENGER_DISCORD
+}
+
+// start asks the API where the gateway is and stays connected to it
+// until stopped.
+func (d *discordMessenger) start(handler updateHandler) error {
+	d.handler = handler
+	gateway := DGatewayBot{}
+	err := d.call(DISCORD_METHOD_GET_GATEWAY, "GET", "/gateway/bot", "", nil, &gateway)
+	if err != nil {
+		return fmt.Errorf("get gateway url: %s", err)
+	}
+	d.status.fail(fmt.Errorf("gateway is not connected yet"))
+	go d.runGateway(gateway.Url + "/?v=" + discordGatewayVersion + "&encoding=json")
+	return nil
+}
+
+func (d *discordMessenger) stop(ctx context.Context) error {
+	d.cancel()
+	d.mut.Lock()
+	if d.conn != nil {
+		d.conn.close()
+	}
+	d.mut.Unlock()
+	stopped := make(chan struct{})
+	go func() {
+		<-d.done
+		d.acks.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *discordMessenger) health() (string, healthComponent) {
+	d.status.mut.Lock()
+	defer d.status.mut.Unlock()
+	details := map[string]interface{}{"session_id": d.status.sessionId}
+	if !d.status.readyAt.IsZero() {
+		details["ready_at"] = d.status.readyAt.UTC().Format(time.RFC3339)
+	}
+	return "gateway", newHealthComponent(d.status.err, details)
+}
+
+// runGateway reconnects until stopped. Every connection identifies anew,
+// messages sent while the bot was away are not replayed.
+func (d *discordMessenger) runGateway(gatewayUrl string) {
+	defer close(d.done)
+	for {
+		err := d.connect(gatewayUrl)
+		if d.ctx.Err() != nil {
+			return
+		}
+		d.status.fail(err)
+		logger.warn("discord gateway disconnected", "err", err, "retry_in", d.reconnectDelay)
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(d.reconnectDelay):
+		}
+	}
+}
+
+// connect identifies on a new gateway connection and handles its events
+// until the connection drops.
+func (d *discordMessenger) connect(gatewayUrl string) error {
+	conn, err := dialWebsocket(gatewayUrl)
+	if err != nil {
+		return err
+	}
+	d.mut.Lock()
+	d.conn = conn
+	d.mut.Unlock()
+	defer conn.close()
+	if d.ctx.Err() != nil {
+		return d.ctx.Err()
+	}
+
+	hello := DHello{}
+	payload, err := readGatewayPayload(conn)
+	if err == nil && payload.Op != DISCORD_OP_HELLO {
+		err = fmt.Errorf("expected hello, got opcode [%v]", payload.Op)
+	}
+	if err == nil {
+		err = json.Unmarshal(payload.Data, &hello)
+	}
+	if err != nil {
+		return err
+	}
+	err = writeGatewayPayload(conn, DISCORD_OP_IDENTIFY, DIdentify{
+		Token:      d.botKey,
+		Intents:    discordIntents,
+		Properties: DIdentifyProperties{Os: "linux", Browser: "horae", Device: "horae"},
+	})
+	if err != nil {
+		return err
+	}
+
+	var sequence int64
+	var acked int32 = 1
+	var seqMut sync.Mutex
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+	go func() {
+		ticker := time.NewTicker(time.Duration(hello.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopHeartbeat:
+				return
+			case <-ticker.C:
+			}
+			seqMut.Lock()
+			if acked == 0 {
+				seqMut.Unlock()
+				logger.warn("discord gateway missed a heartbeat, reconnecting")
+				conn.close()
+				return
+			}
+			acked = 0
+			seq := sequence
+			seqMut.Unlock()
+			err := writeGatewayPayload(conn, DISCORD_OP_HEARTBEAT, seq)
+			if err != nil {
+				logger.warn("failed to send discord heartbeat", "err", err)
+			}
+		}
+	}()
+
+	for {
+		payload, err := readGatewayPayload(conn)
+		if err != nil {
+			return err
+		}
+		switch payload.Op {
+		case DISCORD_OP_DISPATCH:
+			if payload.Sequence != nil {
+				seqMut.Lock()
+				sequence = *payload.Sequence
+				seqMut.Unlock()
+			}
+			d.dispatch(payload.Event, payload.Data)
+		case DISCORD_OP_HEARTBEAT:
+			seqMut.Lock()
+			seq := sequence
+			seqMut.Unlock()
+			err = writeGatewayPayload(conn, DISCORD_OP_HEARTBEAT, seq)
+			if err != nil {
+				return err
+			}
+		case DISCORD_OP_HEARTBEAT_ACK:
+			seqMut.Lock()
+			acked = 1
+			seqMut.Unlock()
+		case DISCORD_OP_RECONNECT, DISCORD_OP_INVALID_SESSION:
+			return fmt.Errorf("gateway asked to reconnect, opcode - [%v]", payload.Op)
+		}
+	}
+}
+
+func readGatewayPayload(conn *wsConn) (DGatewayPayload, error) {
+	payload := DGatewayPayload{}
+	message, err := conn.readMessage()
+	if err != nil {
+		return payload, err
+	}
+	err = json.Unmarshal(message, &payload)
+	if err != nil {
+		return payload, fmt.Errorf("parse gateway payload: %s", err)
+	}
+	return payload, nil
+}
+
+func writeGatewayPayload(conn *wsConn, op int, data interface{}) error {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	message, err := json.Marshal(DGatewayPayload{Op: op, Data: dataBytes})
+	if err != nil {
+		return err
+	}
+	return conn.writeText(message)
+}
+
+func (d *discordMessenger) dispatch(event string, data json.RawMessage) {
+	switch event {
+	case DISCORD_EVENT_READY:
+		ready := DReady{}
+		err := json.Unmarshal(data, &ready)
+		if err != nil {
+			logger.warn("failed to parse discord ready event", "err", err)
+			return
+		}
+		d.mut.Lock()
+		d.botUserId = ready.User.Id
+		d.mut.Unlock()
+		d.status.ready(ready.SessionId)
+		logger.info("discord gateway ready", "bot", ready.User.Username)
+	case DISCORD_EVENT_MESSAGE_CREATE:
+		message := DMessage{}
+		err := json.Unmarshal(data, &message)
+		if err != nil {
+			updatesReceived.inc("invalid")
+			logger.warn("failed to parse discord message", "err", err)
+			return
+		}
+		d.processMessage(message)
+	case DISCORD_EVENT_INTERACTION_CREATE:
+		interaction := DInteraction{}
+		err := json.Unmarshal(data, &interaction)
+		if err != nil {
+			updatesReceived.inc("invalid")
+			logger.warn("failed to parse discord interaction", "err", err)
+			return
+		}
+		d.processInteraction(interaction)
+	}
+}
+
+func (d *discordMessenger) processMessage(message DMessage) {
+	d.mut.Lock()
+	own := message.Author.Id == d.botUserId
+	d.mut.Unlock()
+	if own || message.Author.Bot {
+		return
+	}
+	chatId, sender, err := d.resolveChat(message.ChannelId, message.GuildId, message.Author)
+	if err != nil {
+		updatesReceived.inc("invalid")
+		logger.warn("invalid discord message", "message_id", message.Id, "err", err)
+		return
+	}
+	updatesReceived.inc(messageType(message.Content))
+	d.handler.processMessage(IncomingMessage{
+		UpdateId: message.Id,
+		ChatId:   chatId,
+		Group:    message.GuildId != "",
+		From:     sender,
+		Text:     message.Content,
+	})
+}
+
+// processInteraction turns presses of keyboard buttons into messages,
+// those are acknowledged right away since nobody answers them otherwise.
+// The acknowledgement is sent aside, so a slow API doesn't hold up the
+// gateway.
+func (d *discordMessenger) processInteraction(interaction DInteraction) {
+	if interaction.Type != DISCORD_INTERACTION_COMPONENT {
+		updatesReceived.inc("unsupported")
+		return
+	}
+	user := interaction.User
+	if interaction.Member != nil {
+		user = &interaction.Member.User
+	}
+	if user == nil {
+		updatesReceived.inc("invalid")
+		logger.warn("discord interaction without a user", "interaction_id", interaction.Id)
+		return
+	}
+	chatId, sender, err := d.resolveChat(interaction.ChannelId, interaction.GuildId, *user)
+	if err != nil {
+		updatesReceived.inc("invalid")
+		logger.warn("invalid discord interaction", "interaction_id", interaction.Id, "err", err)
+		return
+	}
+
+	pressId := interaction.Id + "/" + interaction.Token
+	if text := strings.TrimPrefix(interaction.Data.CustomId, discordKeyboardPrefix); text != interaction.Data.CustomId {
+		d.acks.Add(1)
+		go func() {
+			defer d.acks.Done()
+			err := d.acknowledge(pressId)
+			if err != nil {
+				logger.warn("failed to acknowledge discord interaction", "interaction_id", interaction.Id, "err", err)
+			}
+		}()
+		updatesReceived.inc(messageType(text))
+		d.handler.processMessage(IncomingMessage{
+			UpdateId: interaction.Id,
+			ChatId:   chatId,
+			Group:    interaction.GuildId != "",
+			From:     sender,
+			Text:     text,
+		})
+		return
+	}
+	updatesReceived.inc("callback_query")
+	d.handler.processButtonPress(ButtonPress{
+		Id:        pressId,
+		UpdateId:  interaction.Id,
+		ChatId:    chatId,
+		MessageId: interaction.Message.Id,
+		From:      sender,
+		Data:      interaction.Data.CustomId,
+	})
+}
+
+// resolveChat maps a channel to a chat id and remembers the direct message
+// channel of the user.
+func (d *discordMessenger) resolveChat(channelId string, guildId string, user DUser) (ChatId, Sender, error) {
+	userId, err := strconv.ParseInt(user.Id, 10, 64)
+	if err != nil {
+		return 0, Sender{}, fmt.Errorf("unexpected user id [%v]", user.Id)
+	}
+	sender := Sender{Id: userId, FirstName: user.GlobalName}
+	if sender.FirstName == "" {
+		sender.FirstName = user.Username
+	}
+	if guildId != "" {
+		channel, err := strconv.ParseInt(channelId, 10, 64)
+		if err != nil {
+			return 0, Sender{}, fmt.Errorf("unexpected channel id [%v]", channelId)
+		}
+		return ChatId(-channel), sender, nil
+	}
+	d.mut.Lock()
+	d.dmChannels[ChatId(userId)] = channelId
+	d.mut.Unlock()
+	return ChatId(userId), sender, nil
+}
+
+// channelOf returns the channel of the chat, the direct message channel
+// of a user the bot hasn't heard from since the start is opened first.
+func (d *discordMessenger) channelOf(chatId ChatId) (string, error) {
+	if isGroupChatId(chatId) {
+		return strconv.FormatInt(-int64(chatId), 10), nil
+	}
+	d.mut.Lock()
+	channelId, ok := d.dmChannels[chatId]
+	d.mut.Unlock()
+	if ok {
+		return channelId, nil
+	}
+
+	body, err := json.Marshal(DCreateDM{RecipientId: strconv.FormatInt(int64(chatId), 10)})
+	if err != nil {
+		return "", err
+	}
+	channel := DChannel{}
+	err = d.call(DISCORD_METHOD_CREATE_DM, "POST", "/users/@me/channels", "application/json", body, &channel)
+	if err != nil {
+		return "", err
+	}
+	d.mut.Lock()
+	d.dmChannels[chatId] = channel.Id
+	d.mut.Unlock()
+	return channel.Id, nil
+}
+
+func (d *discordMessenger) acknowledge(pressId string) error {
+	body, err := json.Marshal(DInteractionResponse{Type: DISCORD_CALLBACK_DEFERRED_UPDATE})
+	if err != nil {
+		return err
+	}
+	return d.call(DISCORD_METHOD_INTERACTION_CALLBACK, "POST", "/interactions/"+pressId+"/callback", "application/json", body, nil)
+}
+
+// discordContent renders the text in Discord's markdown and keeps it
+// within the length limit.
+func discordContent(text string, format string) string {
+	if format == FORMAT_HTML {
+		text = strings.NewReplacer("<b>", "**", "</b>", "**", "<i>", "*", "</i>", "*", "<code>", "`", "</code>", "`").Replace(text)
+		text = html.UnescapeString(text)
+	}
+	if utf8.RuneCountInString(text) > discordMaxContent {
+		text = string([]rune(text)[:discordMaxContent-1]) + "…"
+	}
+	return text
+}
+
+func discordLabel(text string) string {
+	if utf8.RuneCountInString(text) > discordMaxLabel {
+		return string([]rune(text)[:discordMaxLabel])
+	}
+	return text
+}
+
+// discordKeyboard lays out the keyboard in action rows. Discord allows at
+// most 5 rows of 5 buttons, longer keyboards of one button per row are
+// packed into full rows.
+func discordKeyboard(keyboard Keyboard) []DComponent {
+	rows := keyboard
+	if len(rows) > discordMaxRows {
+		rows = nil
+		var row []string
+		for _, keyboardRow := range keyboard {
+			for _, text := range keyboardRow {
+				row = append(row, text)
+				if len(row) == discordMaxRowButtons {
+					rows = append(rows, row)
+					row = nil
+				}
+			}
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+
+	components := []DComponent{}
+	for _, row := range rows {
+		if len(components) == discordMaxRows {
+			break
+		}
+		actionRow := DComponent{Type: DISCORD_COMPONENT_ACTION_ROW}
+		for _, text := range row {
+			if len(actionRow.Components) == discordMaxRowButtons {
+				break
+			}
+			actionRow.Components = append(actionRow.Components, DComponent{
+				Type:     DISCORD_COMPONENT_BUTTON,
+				Style:    DISCORD_BUTTON_STYLE_SECONDARY,
+				Label:    discordLabel(text),
+				CustomId: discordKeyboardPrefix + discordLabel(text),
+			})
+		}
+		components = append(components, actionRow)
+	}
+	return components
+}
+
+func discordButtons(buttons []InlineButton) []DComponent {
+	if len(buttons) == 0 {
+		return []DComponent{}
+	}
+	row := DComponent{Type: DISCORD_COMPONENT_ACTION_ROW}
+	for _, button := range buttons {
+		row.Components = append(row.Components, DComponent{
+			Type:     DISCORD_COMPONENT_BUTTON,
+			Style:    DISCORD_BUTTON_STYLE_PRIMARY,
+			Label:    discordLabel(button.Text),
+			CustomId: button.Data,
+		})
+	}
+	return []DComponent{row}
+}
+
+func discordMessage(msg OutgoingMessage) DMessageSend {
+	send := DMessageSend{
+		Content:         discordContent(msg.Text, msg.Format),
+		Components:      discordButtons(msg.Buttons),
+		AllowedMentions: DAllowedMentions{Parse: []string{}},
+	}
+	if len(msg.Buttons) == 0 && msg.Keyboard != nil {
+		send.Components = discordKeyboard(msg.Keyboard)
+	}
+	if msg.Silent {
+		send.Flags = DISCORD_FLAG_SUPPRESS_NOTIFICATIONS
+	}
+	return send
+}
+
+// messageRequest sends the message with its keyboard as buttons, there
+// is no keyboard to remove since buttons belong to their message.
+func (d *discordMessenger) messageRequest(msg OutgoingMessage) (*outgoingRequest, error) {
+	return jsonRequest(DISCORD_METHOD_CREATE_MESSAGE, discordMessage(msg))
+}
+
+func (d *discordMessenger) editRequest(messageId string, msg OutgoingMessage) (*outgoingRequest, error) {
+	send := discordMessage(msg)
+	send.Flags = 0
+	req, err := jsonRequest(DISCORD_METHOD_EDIT_MESSAGE, send)
+	if err != nil {
+		return nil, err
+	}
+	req.target = messageId
+	return req, nil
+}
+
+// fileRequest attaches the file to a new message, Discord shows images
+// inline whatever the kind.
+func (d *discordMessenger) fileRequest(chatId ChatId, kind string, fileName string, content []byte, caption string) (*outgoingRequest, error) {
+	payload, err := json.Marshal(DMessageSend{
+		Content:         discordContent(caption, FORMAT_PLAIN),
+		Components:      []DComponent{},
+		AllowedMentions: DAllowedMentions{Parse: []string{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	err = writer.WriteField("payload_json", string(payload))
+	if err != nil {
+		return nil, err
+	}
+	part, err := writer.CreateFormFile("files[0]", fileName)
+	if err != nil {
+		return nil, err
+	}
+	_, err = part.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &outgoingRequest{
+		method:      DISCORD_METHOD_CREATE_MESSAGE,
+		contentType: writer.FormDataContentType(),
+		body:        body.Bytes(),
+	}, nil
+}
+
+// answerRequest answers the press with a message only the user sees.
+// Discord waits 3 seconds for the answer, the queue delivers interactive
+// requests well within that.
+func (d *discordMessenger) answerRequest(press ButtonPress, text string) (*outgoingRequest, error) {
+	response := DInteractionResponse{Type: DISCORD_CALLBACK_DEFERRED_UPDATE}
+	if text != "" {
+		response = DInteractionResponse{
+			Type: DISCORD_CALLBACK_MESSAGE,
+			Data: &DInteractionCallbackData{Content: discordContent(text, FORMAT_PLAIN), Flags: DISCORD_FLAG_EPHEMERAL},
+		}
+	}
+	req, err := jsonRequest(DISCORD_METHOD_INTERACTION_CALLBACK, response)
+	if err != nil {
+		return nil, err
+	}
+	req.target = press.Id
+	return req, nil
+}
+
+func (d *discordMessenger) send(req *outgoingRequest) error {
+	if req.method == DISCORD_METHOD_INTERACTION_CALLBACK {
+		return d.call(req.method, "POST", "/interactions/"+req.target+"/callback", req.contentType, req.body, nil)
+	}
+	channelId, err := d.channelOf(req.chatId)
+	if err != nil {
+		return err
+	}
+	switch req.method {
+	case DISCORD_METHOD_CREATE_MESSAGE:
+		return d.call(req.method, "POST", "/channels/"+channelId+"/messages", req.contentType, req.body, nil)
+	case DISCORD_METHOD_EDIT_MESSAGE:
+		return d.call(req.method, "PATCH", "/channels/"+channelId+"/messages/"+req.target, req.contentType, req.body, nil)
+	}
+	return fmt.Errorf("unknown discord method [%v]", req.method)
+}
+
+// call performs a single REST request and decodes the answer into result
+// unless it is nil. Failed requests are reported as *apiError so the
+// message queue can decide whether to retry them.
+func (d *discordMessenger) call(method string, httpMethod string, path string, contentType string, body []byte, result interface{}) error {
+	request, err := http.NewRequest(httpMethod, d.apiUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bot "+d.botKey)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	start := time.Now()
+	resp, err := d.client.Do(request)
+	observeDiscordCall(method, start, resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(respBody, result)
+	}
+
+	apiErr := &apiError{
+		messenger:   MESSENGER_DISCORD,
+		method:      method,
+		statusCode:  resp.StatusCode,
+		description: string(respBody),
+	}
+	dApiError := DApiError{}
+	if json.Unmarshal(respBody, &dApiError) == nil {
+		apiErr.description = dApiError.Message
+		apiErr.retryAfter = time.Duration(dApiError.RetryAfter * float64(time.Second))
+	}
+	return apiErr
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+type fakeDiscordCall struct {
+	method string
+	path   string
+	body   string
+}
+
+// fakeDiscord serves the REST API under /api and hands every gateway
+// connection to the test. Interaction callbacks wait for releaseAcks.
+type fakeDiscord struct {
+	server      *httptest.Server
+	connections chan *wsConn
+	releaseAcks chan struct{}
+
+	mut   sync.Mutex
+	calls []fakeDiscordCall
+}
+
+func newFakeDiscord(t *testing.T) *fakeDiscord {
+	f := &fakeDiscord{
+		connections: make(chan *wsConn, 4),
+		releaseAcks: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gateway/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := acceptTestWebsocket(w, r)
+		if err != nil {
+			t.Errorf("accept gateway connection: %v", err)
+			return
+		}
+		f.connections <- conn
+	})
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bot token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/api")
+		switch {
+		case path == "/gateway/bot":
+			json.NewEncoder(w).Encode(DGatewayBot{Url: "ws" + strings.TrimPrefix(f.server.URL, "http") + "/gateway"})
+			return
+		case strings.HasPrefix(path, "/interactions/"):
+			<-f.releaseAcks
+		case path == "/users/@me/channels":
+			json.NewEncoder(w).Encode(DChannel{Id: "500"})
+		case path == "/channels/429/messages":
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(DApiError{Message: "You are being rate limited.", RetryAfter: 1.5})
+		}
+		f.mut.Lock()
+		f.calls = append(f.calls, fakeDiscordCall{method: r.Method, path: path, body: string(body)})
+		f.mut.Unlock()
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeDiscord) messenger() *discordMessenger {
+	d := newDiscordMessenger(Config{DiscordBotToken: "token", DiscordApiUrl: f.server.URL + "/api/"})
+	d.reconnectDelay = 10 * time.Millisecond
+	return d
+}
+
+func (f *fakeDiscord) takeCalls() []fakeDiscordCall {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func (f *fakeDiscord) nextConnection(t *testing.T) *wsConn {
+	select {
+	case conn := <-f.connections:
+		t.Cleanup(func() {
+			conn.conn.Close()
+		})
+		return conn
+	case <-time.After(testTimeout):
+		t.Fatalf("the messenger didn't connect to the gateway")
+		return nil
+	}
+}
+
+// sendGateway writes a payload to the messenger, events are dispatches.
+func sendGateway(t *testing.T, conn *wsConn, op int, sequence int64, event string, data interface{}) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("marshal gateway data: %v", err)
+	}
+	payload := DGatewayPayload{Op: op, Data: dataBytes, Event: event}
+	if sequence > 0 {
+		payload.Sequence = &sequence
+	}
+	message, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshal gateway payload: %v", err)
+	}
+	err = writeServerFrame(conn, true, WS_OP_TEXT, message)
+	if err != nil {
+		t.Fatalf("write gateway payload: %v", err)
+	}
+}
+
+// identify says hello on a new connection and checks the messenger
+// identifies with its token.
+func identify(t *testing.T, conn *wsConn, heartbeatInterval int64) {
+	sendGateway(t, conn, DISCORD_OP_HELLO, 0, "", DHello{HeartbeatInterval: heartbeatInterval})
+	payload, err := readGatewayPayload(conn)
+	if err != nil {
+		t.Fatalf("read identify: %v", err)
+	}
+	identify := DIdentify{}
+	err = json.Unmarshal(payload.Data, &identify)
+	if err != nil || payload.Op != DISCORD_OP_IDENTIFY || identify.Token != "token" || identify.Intents != discordIntents {
+		t.Fatalf("expected identify, got opcode %v %s, err %v", payload.Op, payload.Data, err)
+	}
+}
+
+type testUpdateHandler struct {
+	messages chan IncomingMessage
+	presses  chan ButtonPress
+}
+
+func newTestUpdateHandler() *testUpdateHandler {
+	return &testUpdateHandler{
+		messages: make(chan IncomingMessage, 8),
+		presses:  make(chan ButtonPress, 8),
+	}
+}
+
+func (h *testUpdateHandler) processMessage(msg IncomingMessage) {
+	h.messages <- msg
+}
+
+func (h *testUpdateHandler) processButtonPress(press ButtonPress) {
+	h.presses <- press
+}
+
+func (h *testUpdateHandler) nextMessage(t *testing.T) IncomingMessage {
+	select {
+	case msg := <-h.messages:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatalf("no message reached the handler")
+		return IncomingMessage{}
+	}
+}
+
+func TestDiscordGateway(t *testing.T) {
+	fake := newFakeDiscord(t)
+	d := fake.messenger()
+	handler := newTestUpdateHandler()
+	err := d.start(handler)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		err := d.stop(ctx)
+		if err != nil {
+			t.Errorf("stop: %v", err)
+		}
+	}()
+
+	conn := fake.nextConnection(t)
+	// a heartbeat left unacknowledged drops the connection two intervals
+	// later, long enough for the events below
+	identify(t, conn, 100)
+	sendGateway(t, conn, DISCORD_OP_DISPATCH, 1, DISCORD_EVENT_READY, DReady{User: DUser{Id: "99", Username: "horae"}, SessionId: "session"})
+	sendGateway(t, conn, DISCORD_OP_DISPATCH, 2, DISCORD_EVENT_MESSAGE_CREATE, DMessage{
+		Id: "m1", ChannelId: "300", Author: DUser{Id: "99", Username: "horae"}, Content: "sent by the bot",
+	})
+	sendGateway(t, conn, DISCORD_OP_DISPATCH, 3, DISCORD_EVENT_MESSAGE_CREATE, DMessage{
+		Id: "m2", ChannelId: "300", Author: DUser{Id: "7", Username: "ann", GlobalName: "Ann"}, Content: "/start",
+	})
+	msg := handler.nextMessage(t)
+	if msg.ChatId != 7 || msg.Group || msg.From.FirstName != "Ann" || msg.Text != "/start" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if _, component := d.health(); component.Status != HEALTH_STATUS_OK {
+		t.Fatalf("gateway is not healthy after ready: %+v", component)
+	}
+
+	// heartbeats carry the latest sequence and are acknowledged
+	for {
+		payload, err := readGatewayPayload(conn)
+		if err != nil || payload.Op != DISCORD_OP_HEARTBEAT {
+			t.Fatalf("expected a heartbeat, got opcode %v, err %v", payload.Op, err)
+		}
+		sendGateway(t, conn, DISCORD_OP_HEARTBEAT_ACK, 0, "", nil)
+		if string(payload.Data) == "3" {
+			break
+		}
+	}
+
+	// a keyboard press becomes a message while its acknowledgement waits
+	sendGateway(t, conn, DISCORD_OP_DISPATCH, 4, DISCORD_EVENT_INTERACTION_CREATE, DInteraction{
+		Id: "i1", Token: "tok1", Type: DISCORD_INTERACTION_COMPONENT, ChannelId: "400", GuildId: "1",
+		Member: &DMember{User: DUser{Id: "7", Username: "ann"}}, Message: DMessage{Id: "m3"},
+		Data: DInteractionData{CustomId: discordKeyboardPrefix + TTEXT_START_FOCUS},
+	})
+	msg = handler.nextMessage(t)
+	if msg.ChatId != -400 || !msg.Group || msg.From.Id != 7 || msg.Text != TTEXT_START_FOCUS {
+		t.Fatalf("unexpected message from a keyboard press %+v", msg)
+	}
+	sendGateway(t, conn, DISCORD_OP_DISPATCH, 5, DISCORD_EVENT_INTERACTION_CREATE, DInteraction{
+		Id: "i2", Token: "tok2", Type: DISCORD_INTERACTION_COMPONENT, ChannelId: "300",
+		User: &DUser{Id: "7", Username: "ann"}, Message: DMessage{Id: "m4"},
+		Data: DInteractionData{CustomId: "join_focus:1"},
+	})
+	select {
+	case press := <-handler.presses:
+		if press.Id != "i2/tok2" || press.ChatId != 7 || press.MessageId != "m4" || press.Data != "join_focus:1" {
+			t.Fatalf("unexpected button press %+v", press)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("the button press was held up by the acknowledgement")
+	}
+	close(fake.releaseAcks)
+
+	// the gateway asks to reconnect and the messenger identifies again
+	sendGateway(t, conn, DISCORD_OP_RECONNECT, 0, "", nil)
+	conn = fake.nextConnection(t)
+	identify(t, conn, 20)
+	// without acknowledged heartbeats the connection is dropped
+	conn = fake.nextConnection(t)
+	identify(t, conn, 1000)
+
+	calls := fake.takeCalls()
+	var acks []string
+	for _, call := range calls {
+		if strings.HasPrefix(call.path, "/interactions/") {
+			acks = append(acks, call.method+" "+call.path+" "+call.body)
+		}
+	}
+	if len(acks) != 1 || acks[0] != `POST /interactions/i1/tok1/callback {"type":6}` {
+		t.Fatalf("expected the keyboard press to be acknowledged once, got %v", acks)
+	}
+}
+
+func TestDiscordSend(t *testing.T) {
+	fake := newFakeDiscord(t)
+	d := fake.messenger()
+
+	send := func(chatId ChatId, req *outgoingRequest, err error) error {
+		if err != nil {
+			t.Fatalf("encode request: %v", err)
+		}
+		req.chatId = chatId
+		return d.send(req)
+	}
+	msg := OutgoingMessage{ChatId: 7, Text: "<b>Ann &amp; Bob</b>", Format: FORMAT_HTML, Keyboard: GenerateMainKeyboard()}
+	for i := 0; i < 2; i++ {
+		req, err := d.messageRequest(msg)
+		err = send(7, req, err)
+		if err != nil {
+			t.Fatalf("send message: %v", err)
+		}
+	}
+	req, err := d.editRequest("m1", OutgoingMessage{ChatId: -400, Text: "edited"})
+	err = send(-400, req, err)
+	if err != nil {
+		t.Fatalf("edit message: %v", err)
+	}
+	req, err = d.answerRequest(ButtonPress{Id: "i1/tok", ChatId: -400}, "You joined")
+	close(fake.releaseAcks)
+	err = send(7, req, err)
+	if err != nil {
+		t.Fatalf("answer press: %v", err)
+	}
+
+	calls := fake.takeCalls()
+	expected := []string{
+		"POST /users/@me/channels",
+		"POST /channels/500/messages",
+		"POST /channels/500/messages",
+		"PATCH /channels/400/messages/m1",
+		"POST /interactions/i1/tok/callback",
+	}
+	if len(calls) != len(expected) {
+		t.Fatalf("expected %v calls, got %+v", len(expected), calls)
+	}
+	for i, call := range calls {
+		if call.method+" "+call.path != expected[i] {
+			t.Fatalf("call %v is %v %v, expected %v", i, call.method, call.path, expected[i])
+		}
+	}
+	sent := DMessageSend{}
+	err = json.Unmarshal([]byte(calls[1].body), &sent)
+	if err != nil || sent.Content != "**Ann & Bob**" || len(sent.Components) == 0 {
+		t.Fatalf("unexpected message %s, err %v", calls[1].body, err)
+	}
+	answer := DInteractionResponse{}
+	err = json.Unmarshal([]byte(calls[4].body), &answer)
+	if err != nil || answer.Type != DISCORD_CALLBACK_MESSAGE || answer.Data.Content != "You joined" || answer.Data.Flags != DISCORD_FLAG_EPHEMERAL {
+		t.Fatalf("unexpected answer %s, err %v", calls[4].body, err)
+	}
+
+	req, err = d.messageRequest(OutgoingMessage{ChatId: -429, Text: "too fast"})
+	err = send(-429, req, err)
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.statusCode != http.StatusTooManyRequests || !apiErr.isRetryable() ||
+		apiErr.retryAfter != 1500*time.Millisecond {
+		t.Fatalf("expected a retryable rate limit error, got %v", err)
+	}
+}
@@ -1,79 +1,32 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"log"
-	"mime/multipart"
-	"net/http"
-	"os"
-	"regexp"
+	"html"
+	"strings"
 	"sync"
 	"time"
 )
 
-var validPath = regexp.MustCompile("^/(update)/+")
-var reIpAddress = regexp.MustCompile(`^((25[0-5]|(2[0-4]|1\d|[1-9]|)\d)\.?\b){4}$`)
-
 type environment struct {
-	client      http.Client
-	botKey      string
-	ipAddress   string
-	db          *hDataBase
+	messenger   Messenger
+	db          Storage
 	users       Users
-	timeKeepers map[ChatId]*TimeKeeper
-}
-
-type TChat struct {
-	Id   int64  `json:"id"`
-	Type string `json:"type"`
-}
-
-type TKeyBoardButton struct {
-	Text string `json:"text"`
-}
-
-type TReplyKeyboard struct {
-	Keyboard        [][]TKeyBoardButton `json:"keyboard"`
-	ResizeKeyboard  bool                `json:"resize_keyboard"`
-	OneTimeKeyboard bool                `json:"one_time_keyboard"`
-}
-
-type TMessage struct {
-	MessageId int    `json:"message_id"`
-	Text      string `json:"text"`
-	Chat      TChat  `json:"chat"`
-	From      TUser  `json:"from"`
-}
-
-type TMessageSend struct {
-	ChatId ChatId `json:"chat_id"`
-	Text   string `json:"text"`
-}
-
-type TKeyboardMessageSend struct {
-	ChatId         ChatId         `json:"chat_id"`
-	Text           string         `json:"text"`
-	KeyboardMarkup TReplyKeyboard `json:"reply_markup"`
-	ParseMode      string         `json:"parse_mode"`
-}
-
-type TUser struct {
-	Id        int64  `json:"id"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Username  string `json:"username"`
-}
-
-type TUpdate struct {
-	UpdateId int      `json:"update_id"`
-	Message  TMessage `json:"message"`
-}
-
-func (u *TUpdate) GetChatId() ChatId {
-	return ChatId(u.Message.Chat.Id)
+	timeKeepers TimeKeepers
+	queue       *messageQueue
+	backupDir   string
+	backupKeep  int
+	// botUsername builds the deep links of partner invites
+	botUsername string
+	// groupMut serialises joining and leaving the shared focus sessions of
+	// group chats
+	groupMut sync.Mutex
+	// the scheduler and periodic backups run until shutdown cancels
+	// backgroundCtx and waits for them
+	backgroundCtx  context.Context
+	stopBackground context.CancelFunc
+	background     sync.WaitGroup
 }
 
 const (
@@ -82,368 +35,436 @@ const (
 	CHANGE_BREAK_DURATION_ACTION
 )
 
-func getPathValue(r *http.Request, pathCheck *regexp.Regexp) (string, error) {
-	m := pathCheck.FindStringSubmatch(r.URL.Path)
-	if m == nil {
-		return "", fmt.Errorf("url path is not valid")
-	}
-
-	log.Printf("getPathValue will return %v", m[1])
-	return m[1], nil
-}
-
-func (env *environment) updateHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("updateHandler")
-	pageTitle, err := getPathValue(r, validPath)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// processMessage runs a message sent to the bot through the menus, the
+// reply goes back to the same chat.
+func (env *environment) processMessage(msg IncomingMessage) {
+	ulog := env.updateLogger(msg.UpdateId, msg.ChatId)
+	if msg.Group {
+		env.processGroupMessage(msg, ulog)
 		return
 	}
-
-	fmt.Printf("Received page title - [%v]", pageTitle)
-}
-
-func (env *environment) rootHandler(w http.ResponseWriter, r *http.Request) {
-	buf, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Println(err)
+	if msg.ChatId <= 0 || msg.From.Id <= 0 {
+		ulog.warn("invalid chat id or user id", "user_id", msg.From.Id)
 		return
 	}
+	ulog.debug("update received", "type", messageType(msg.Text))
 
-	Update := &TUpdate{}
-	err = json.Unmarshal(buf, Update)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	if Update.Message.Chat.Id <= 0 || Update.Message.From.Id <= 0 {
-		log.Printf("invalid chat id - [%v] or user id - [%v]", Update.Message.Chat.Id, Update.Message.From.Id)
-		return
-	}
-
-	keyboardMsg := TKeyboardMessageSend{
-		KeyboardMarkup: TReplyKeyboard{
-			OneTimeKeyboard: false,
-		},
-	}
-	Msg := TMessageSend{}
 	focusDurations := []string{"15 minutes", "30 minutes", "45 minutes", "1 hour"}
 	pauseDurations := []string{"5 minutes", "10 minutes", "15 minutes", "20 minutes"}
 	var processedResult MenuProcessorResult
-	switch Update.Message.Text {
+	var err error
+	command, args := splitCommand(msg.Text)
+	switch command {
 	case TTEXT_START_COMMAND:
 		newUser := User{
-			FirstName: Update.Message.From.FirstName,
+			FirstName: msg.From.FirstName,
 		}
-		isNewUser := env.users.add(Update.GetChatId(), newUser)
-		if isNewUser {
+		isNewUser := env.users.add(msg.ChatId, newUser)
+		if !isNewUser {
+			ulog.debug("user already exists")
+		} else {
+			ulog.info("new user added")
 			processedResult.responseType = RESPONSE_TYPE_KEYBOARD
 			processedResult.replyText = fmt.Sprintf("Hello %s! I will help you to keep organised with your time!\n"+
-				"Please select how long you want your focus duration to be?", Update.Message.From.FirstName)
+				"Please select how long you want your focus duration to be?", html.EscapeString(msg.From.FirstName))
 			processedResult.replyKeyboard = GenerateCustomKeyboard(focusDurations...)
 			processedResult.userAction = UserAction{CurrentMenu: MENU_INIT_FOCUS}
 		}
+		// /start with a token comes from the deep link of a partner invite
+		if len(args) > 0 {
+			inviteText, inviteErr := env.acceptPartnerInvite(msg.ChatId, args[0])
+			if inviteErr != nil {
+				ulog.error("failed to accept partner invite", "err", inviteErr)
+				inviteText = "Sorry, I couldn't accept the invite. Please try again later"
+			}
+			if isNewUser {
+				processedResult.replyText = inviteText + "\n\n" + processedResult.replyText
+			} else {
+				// the menu stays as it is, so only the HTML reply is sent
+				env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{ChatId: msg.ChatId, Text: inviteText, Format: FORMAT_HTML})
+			}
+		}
 	case TTEXT_MAIN_MENU_COMMAND:
-		fmt.Printf("User %v selected main menu\n", Update.GetChatId())
-		_, ok := env.users.data[Update.GetChatId()]
+		user, ok := env.users.data[msg.ChatId]
 		if !ok {
-			log.Printf("user with chat id - [%v] is not found", Update.GetChatId())
+			ulog.warn("user is not found")
 			return
 		}
 		processedResult.responseType = RESPONSE_TYPE_KEYBOARD
 		processedResult.replyText = "Main menu"
+		if progress := env.goalProgressLine(msg.ChatId, user); progress != "" {
+			processedResult.replyText += "\n" + progress
+		}
 		processedResult.replyKeyboard = GenerateMainKeyboard()
 		processedResult.userAction = UserAction{CurrentMenu: MENU_MAIN_MENU}
 	case TTEXT_DURATIONS_COMMAND:
-		user, ok := env.users.data[Update.GetChatId()]
+		user, ok := env.users.data[msg.ChatId]
 		if !ok {
-			log.Printf("user with chat id - [%v] is not found", Update.GetChatId())
+			ulog.warn("user is not found")
 			return
 		}
 		processedResult.responseType = RESPONSE_TYPE_KEYBOARD
 		processedResult.replyText = fmt.Sprintf("Your focus duration is %v and your break duration is %v minutes", user.FocusDurationMins, user.BreakDurationMins)
 		processedResult.replyKeyboard = GenerateMainKeyboard()
 		processedResult.userAction = UserAction{CurrentMenu: MENU_MAIN_MENU}
+	case TTEXT_EXPORT_COMMAND:
+		user, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		format := EXPORT_FORMAT_JSON
+		if len(args) > 0 {
+			format = strings.ToLower(args[0])
+		}
+		processedResult.responseType = RESPONSE_TYPE_TEXT
+		processedResult.userAction = user.LastAction
+		switch {
+		case !isExportFormat(format):
+			processedResult.replyText = fmt.Sprintf("Usage: %v [%v]", TTEXT_EXPORT_COMMAND, strings.Join(exportFormats, " | "))
+		case format == EXPORT_FORMAT_JSON:
+			processedResult.replyText = "Here is everything I store about you"
+			err = env.exportUserData(msg.ChatId, user)
+		default:
+			processedResult.replyText = "Here is your session history"
+			err = env.exportSessions(msg.ChatId, format)
+		}
+		if err != nil {
+			ulog.error("failed to export user data", "err", err)
+			processedResult.replyText = "Sorry, I couldn't prepare your data. Please try again later"
+		}
+	case TTEXT_FOCUS_COMMAND:
+		user, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		mins, tag, parseErr := parseFocusArgs(args, user.FocusDurationMins)
+		if parseErr != nil || mins == 0 {
+			processedResult.responseType = RESPONSE_TYPE_TEXT
+			processedResult.replyText = fmt.Sprintf("Usage: %v [minutes] [#tag], e.g. %v 25 #backend", TTEXT_FOCUS_COMMAND, TTEXT_FOCUS_COMMAND)
+			processedResult.userAction = user.LastAction
+			break
+		}
+		processedResult = startFocus(msg.ChatId, mins, tag, 1, env)
+	case TTEXT_STATS_COMMAND:
+		user, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		processedResult.responseType = RESPONSE_TYPE_TEXT
+		processedResult.userAction = user.LastAction
+		processedResult.replyText, err = env.generateStatsText(msg.ChatId, time.Now().In(user.location()))
+		if err != nil {
+			ulog.error("failed to build stats", "err", err)
+			processedResult.replyText = "Sorry, I couldn't calculate your stats. Please try again later"
+		}
+	case TTEXT_JOURNAL_COMMAND:
+		user, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		tag := ""
+		if len(args) > 0 {
+			tag, _ = parseTag(args[0])
+		}
+		processedResult.responseType = RESPONSE_TYPE_TEXT
+		processedResult.userAction = user.LastAction
+		processedResult.replyText, err = env.generateJournalText(msg.ChatId, tag)
+		if err != nil {
+			ulog.error("failed to build journal", "err", err)
+			processedResult.replyText = "Sorry, I couldn't open your journal. Please try again later"
+		}
+	case TTEXT_GOAL_COMMAND:
+		user, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		processedResult.responseType = RESPONSE_TYPE_TEXT
+		processedResult.userAction = user.LastAction
+		processedResult.replyText, err = env.generateGoalText(msg.ChatId, user, args)
+		if err != nil {
+			ulog.error("failed to update the daily goal", "err", err)
+			processedResult.replyText = "Sorry, I couldn't update your goal. Please try again later"
+		}
+	case TTEXT_CHART_COMMAND:
+		user, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		processedResult.responseType = RESPONSE_TYPE_TEXT
+		processedResult.userAction = user.LastAction
+		days, ok := parseChartDays(args)
+		if !ok {
+			processedResult.replyText = fmt.Sprintf("Usage: %v [%v | %v]", TTEXT_CHART_COMMAND, CHART_DAYS_WEEK, CHART_DAYS_MONTH)
+			break
+		}
+		sent, chartErr := env.sendCharts(msg.ChatId, user, days)
+		switch {
+		case chartErr != nil:
+			ulog.error("failed to send charts", "err", chartErr)
+			processedResult.replyText = "Sorry, I couldn't draw your charts. Please try again later"
+		case !sent:
+			processedResult.replyText = fmt.Sprintf("You haven't focused in the last %v days, there is nothing to draw yet", days)
+		default:
+			processedResult.replyText = fmt.Sprintf("Here is how you focused, see %v for the numbers", TTEXT_STATS_COMMAND)
+		}
+	case TTEXT_SCHEDULE_COMMAND:
+		user, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		processedResult, err = processScheduleCommand(args, msg.ChatId, user, env)
+		if err != nil {
+			ulog.error("failed to update schedules", "err", err)
+			processedResult = MenuProcessorResult{
+				responseType: RESPONSE_TYPE_TEXT,
+				replyText:    "Sorry, I couldn't save your schedule. Please try again later",
+				userAction:   user.LastAction,
+			}
+		}
+	case TTEXT_PARTNER_COMMAND:
+		user, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		processedResult, err = env.generatePartnersResult(msg.ChatId, user, "")
+		if err != nil {
+			ulog.error("failed to show partners", "err", err)
+			processedResult = MenuProcessorResult{
+				responseType: RESPONSE_TYPE_TEXT,
+				replyText:    "Sorry, I couldn't load your partners. Please try again later",
+				userAction:   user.LastAction,
+			}
+		}
+	case TTEXT_DELETE_ME_COMMAND:
+		_, ok := env.users.data[msg.ChatId]
+		if !ok {
+			ulog.warn("user is not found")
+			return
+		}
+		processedResult = generateConfirmDeleteResult()
 	}
 
 	if processedResult.responseType == RESPONSE_TYPE_NONE {
-		user, ok := env.users.data[Update.GetChatId()]
+		user, ok := env.users.data[msg.ChatId]
 		if !ok {
 			msgText := fmt.Sprintf("Oops! I don't know you yet. Please type %v to start", TTEXT_START_COMMAND)
-			Msg = TMessageSend{
-				ChatId: Update.GetChatId(),
-				Text:   msgText,
-			}
+			env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{ChatId: msg.ChatId, Text: msgText})
 		} else {
 			switch user.LastAction.CurrentMenu {
 			case MENU_MAIN_MENU:
-				processedResult, err = processMainMenu(Update.Message.Text, user, Update.GetChatId(), env)
+				processedResult, err = processMainMenu(msg.Text, user, msg.ChatId, env)
 			case MENU_INFOCUS:
-				processedResult, err = processInFocusMenu(Update.Message.Text, Update.GetChatId(), &env.timeKeepers)
+				processedResult, err = processInFocusMenu(msg.Text, msg.ChatId, env)
 			case MENU_INBREAK:
-				processedResult, err = processInBreakMenu(Update.Message.Text, Update.GetChatId(), &env.timeKeepers)
+				processedResult, err = processInBreakMenu(msg.Text, msg.ChatId, env)
 			case MENU_INIT_FOCUS:
-				processedResult, err = processInitFocusMenu(Update.Message.Text, Update.GetChatId(), user, &env.users, focusDurations, pauseDurations)
+				processedResult, err = processInitFocusMenu(msg.Text, msg.ChatId, user, &env.users, focusDurations, pauseDurations)
 			case MENU_INIT_BREAK:
-				processedResult, err = processInitBreakMenu(Update.Message.Text, Update.GetChatId(), user, &env.users, pauseDurations)
+				processedResult, err = processInitBreakMenu(msg.Text, msg.ChatId, user, &env.users, pauseDurations)
 			case MENU_SETTINGS:
-				processedResult, err = processSettingsMenu(Update.Message.Text, user)
+				processedResult, err = processSettingsMenu(msg.Text, msg.ChatId, user, env)
 			case MENU_SETTINGS_FOCUS_DURATION:
-				processedResult, err = processSettingsFocusDurationMenu(Update.Message.Text, Update.GetChatId(), user, &env.users, focusDurations)
+				processedResult, err = processSettingsFocusDurationMenu(msg.Text, msg.ChatId, user, &env.users, focusDurations)
 			case MENU_SETTINGS_BREAK_DURATION:
-				processedResult, err = processSettingsBreakDurationMenu(Update.Message.Text, Update.GetChatId(), user, &env.users, pauseDurations)
+				processedResult, err = processSettingsBreakDurationMenu(msg.Text, msg.ChatId, user, &env.users, pauseDurations)
+			case MENU_CHOOSE_TAG:
+				processedResult, err = processChooseTagMenu(msg.Text, user, msg.ChatId, env)
+			case MENU_REFLECTION_NOTE:
+				processedResult, err = processReflectionNoteMenu(msg.Text, user, msg.ChatId, env)
+			case MENU_REFLECTION_RATING:
+				processedResult, err = processReflectionRatingMenu(msg.Text, user, msg.ChatId, env)
+			case MENU_INTERRUPTION_KIND:
+				processedResult, err = processInterruptionKindMenu(msg.Text, user, msg.ChatId, env)
+			case MENU_INTERRUPTION_NOTE:
+				processedResult, err = processInterruptionNoteMenu(msg.Text, user, msg.ChatId, env)
+			case MENU_STOP_REASON:
+				processedResult, err = processStopReasonMenu(msg.Text, user, msg.ChatId, env)
+			case MENU_SETTINGS_QUIET_HOURS:
+				processedResult, err = processSettingsQuietHoursMenu(msg.Text, msg.ChatId, user, &env.users)
+			case MENU_SETTINGS_NUDGES:
+				processedResult, err = processSettingsNudgesMenu(msg.Text, msg.ChatId, user, &env.users)
+			case MENU_NUDGE:
+				processedResult, err = processNudgeMenu(msg.Text, user, msg.ChatId, env)
+			case MENU_PARTNERS:
+				processedResult, err = processPartnersMenu(msg.Text, msg.ChatId, user, env)
+			case MENU_SCHEDULES:
+				processedResult, err = processSchedulesMenu(msg.Text, msg.ChatId, user, env)
+			case MENU_SCHEDULE_PROMPT:
+				processedResult, err = processSchedulePromptMenu(msg.Text, msg.ChatId, user, env)
+			case MENU_CONFIRM_DELETE:
+				processedResult, err = processConfirmDeleteMenu(msg.Text, msg.ChatId, env)
 			}
 
 			if err != nil {
-				log.Println(err)
+				ulog.error("failed to process menu", "err", err)
 				return
 			}
 		}
 	}
 
-	if processedResult.responseType != RESPONSE_TYPE_NONE {
-		user, ok := env.users.data[Update.GetChatId()]
+	if processedResult.forgetUser {
+		err = env.forgetUser(msg.ChatId)
+		if err != nil {
+			ulog.error("failed to delete user data", "err", err)
+			processedResult = MenuProcessorResult{
+				responseType: RESPONSE_TYPE_TEXT,
+				replyText:    "Sorry, I couldn't delete your data. Please try again later",
+			}
+		} else {
+			ulog.info("user data deleted")
+		}
+	} else if processedResult.responseType != RESPONSE_TYPE_NONE {
+		user, ok := env.users.data[msg.ChatId]
 		if !ok {
-			log.Printf("user with chat id - [%v] is not found", Update.GetChatId())
+			ulog.warn("user is not found")
 		} else {
-			env.users.saveLastUserAction(Update.GetChatId(), processedResult.userAction)
-			env.db.saveUserData(Update.GetChatId(), user)
+			ulog.debug("menu changed", "next_menu", getMenuName(processedResult.userAction.CurrentMenu), "menu_action", processedResult.userAction.Action)
+			menuTransitions.inc(getMenuName(user.LastAction.CurrentMenu), getMenuName(processedResult.userAction.CurrentMenu))
+			env.users.saveLastUserAction(msg.ChatId, processedResult.userAction)
+			env.persistUser(msg.ChatId)
 		}
 	}
 
-	fmt.Printf("Processed result - [%v]", processedResult)
+	ulog.debug("update processed", "response_type", processedResult.responseType)
 	switch processedResult.responseType {
 	case RESPONSE_TYPE_KEYBOARD:
-		keyboardMsg = TKeyboardMessageSend{
-			ChatId:         Update.GetChatId(),
-			Text:           processedResult.replyText,
-			KeyboardMarkup: processedResult.replyKeyboard,
-			ParseMode:      "HTML",
-		}
-		env.marshalAndSendMessage(keyboardMsg)
+		env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{
+			ChatId:   msg.ChatId,
+			Text:     processedResult.replyText,
+			Format:   FORMAT_HTML,
+			Keyboard: processedResult.replyKeyboard,
+		})
 	case RESPONSE_TYPE_TEXT:
-		Msg = TMessageSend{
-			ChatId: Update.GetChatId(),
-			Text:   processedResult.replyText,
-		}
-		env.marshalAndSendMessage(Msg)
+		env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{ChatId: msg.ChatId, Text: processedResult.replyText})
+	case RESPONSE_TYPE_REMOVE_KEYBOARD:
+		env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{ChatId: msg.ChatId, Text: processedResult.replyText, RemoveKeyboard: true})
 	}
-	log.Printf("Successfully processed message from user - [%v]", Update.Message.From.FirstName)
 }
 
-type timeekeepStoppedCallback func(chatId ChatId, finishMessage string)
-
-func (env *environment) onTimekeepStopped(chatId ChatId, finishMessage string) {
-	user, ok := env.users.data[chatId]
-	if !ok {
-		log.Printf("user with chat id - [%v] is not found", chatId)
-	} else {
-		env.users.saveLastUserAction(chatId, UserAction{CurrentMenu: MENU_MAIN_MENU})
-		env.db.saveUserData(chatId, user)
+// updateLogger returns a logger carrying the correlation fields of the update.
+func (env *environment) updateLogger(updateId string, chatId ChatId) *hLogger {
+	menu := "none"
+	if user, ok := env.users.data[chatId]; ok {
+		menu = getMenuName(user.LastAction.CurrentMenu)
 	}
-
-	delete(env.timeKeepers, chatId)
-	msg := TKeyboardMessageSend{
-		ChatId:         chatId,
-		Text:           finishMessage,
-		KeyboardMarkup: GenerateMainKeyboard(),
-	}
-
-	env.marshalAndSendMessage(msg)
+	return logger.with("update_id", updateId, "chat_id", chatId, "menu", menu)
 }
 
-func (env *environment) marshalAndSendMessage(msg interface{}) {
-	//Prepare message for sending
-	msgBytes, err := json.Marshal(msg)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	err = env.sendHttpMessage(msgBytes)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-}
+type timeekeepStoppedCallback func(chatId ChatId, tk *TimeKeeper)
 
-func (env *environment) setupWebhook(certificateFilePath string, url string) error {
-	keyFile, err := os.Open(certificateFilePath)
-	if err != nil {
-		return err
+func (env *environment) onTimekeepStopped(chatId ChatId, tk *TimeKeeper) {
+	env.finishSession(chatId, tk, SESSION_STATUS_COMPLETED)
+	if tk.kind == SESSION_KIND_FOCUS {
+		env.notifyPartners(chatId, fmt.Sprintf("%v %v completed a focus session", EMOJI_HERB, env.userName(chatId)))
 	}
-	defer keyFile.Close()
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, _ := writer.CreateFormFile("certificate", keyFile.Name())
-	io.Copy(part, keyFile)
-	err = writer.WriteField("url", "https://"+url+"/")
-	if err != nil {
-		return err
+	msg := OutgoingMessage{
+		ChatId:   chatId,
+		Text:     tk.finishMessage,
+		Keyboard: GenerateMainKeyboard(),
 	}
-	err = writer.WriteField("ip_address", env.ipAddress)
-	writer.Close()
-
-	request, err := http.NewRequest("POST", "https://api.telegram.org/bot"+env.botKey+"/setWebhook", body)
-	if err != nil {
-		return err
-	}
-	request.Header.Add("Content-Type", writer.FormDataContentType())
-	response, err := env.client.Do(request)
-	if err != nil {
-		return err
+	user, ok := env.users.get(chatId)
+	if ok && tk.kind == SESSION_KIND_FOCUS {
+		if congrats := env.goalReachedText(chatId, user, tk.sessionId); congrats != "" {
+			msg.Text += "\n\n" + congrats
+		}
 	}
-
-	buf, err := io.ReadAll(response.Body)
-	if err != nil {
-		return err
+	if ok && tk.cycle.CyclesLeft > 0 {
+		env.continueCycle(chatId, user, tk, msg.Text)
+		return
 	}
-	log.Printf("reponse to the webhook instal - [%s]", buf)
-	return nil
-}
-
-func (env *environment) deleteWebhook() error {
-	resp, err := http.Get("https://api.telegram.org/bot" + env.botKey + "/deleteWebhook?url=https://" + env.ipAddress + "/")
-	if err != nil {
-		return err
+	if !ok {
+		logger.warn("user is not found", "chat_id", chatId)
+	} else if tk.kind == SESSION_KIND_FOCUS && !user.SkipReflection {
+		env.users.saveLastUserAction(chatId, sessionAction(MENU_REFLECTION_NOTE, tk.sessionId))
+		env.persistUser(chatId)
+		msg.Text += "\n\nWhat did you get done?"
+		msg.Keyboard = GenerateCustomKeyboard(TTEXT_SKIP)
+	} else {
+		env.users.saveLastUserAction(chatId, UserAction{CurrentMenu: MENU_MAIN_MENU})
+		env.persistUser(chatId)
 	}
 
-	buf, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-	log.Printf("reponse to the webhook delete - [%s]", buf)
-	return nil
+	env.notify(msg)
 }
 
-func (env *environment) getWebhookInfo() error {
-	resp, err := http.Get("https://api.telegram.org/bot" + env.botKey + "/getWebhookInfo?url=https://" + env.ipAddress + "/update")
-	if err != nil {
-		return err
+// persistUser writes the current in-memory state of the user to storage.
+func (env *environment) persistUser(chatId ChatId) {
+	env.users.mut.Lock()
+	user, ok := env.users.data[chatId]
+	env.users.mut.Unlock()
+	if !ok {
+		return
 	}
-
-	buf, err := io.ReadAll(resp.Body)
+	err := env.db.saveUserData(chatId, user)
 	if err != nil {
-		return err
+		logger.error("failed to save user", "chat_id", chatId, "err", err)
 	}
-	log.Printf("web hook info is - [%s]", buf)
-	return nil
 }
 
-func (env *environment) sendHttpMessage(buf []byte) error {
-	var resp *http.Response
-	retryCounter := 0
-	for {
-		bufReader := bytes.NewReader(buf)
-		request, err := http.NewRequest("POST", env.generateTelegramUrl("sendMessage"), bufReader)
-		if err != nil {
-			return err
-		}
-		request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-		resp, err = env.client.Do(request)
-		if err == nil && resp.StatusCode == http.StatusOK {
-			break
-		} else if resp.StatusCode == http.StatusTooManyRequests && retryCounter < 5 {
-			log.Printf("sent too many request, will sleep for 1 second. This is retry number %v", retryCounter)
-			time.Sleep(time.Second)
-			retryCounter++
-			continue
-		}
-
-		desc, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to send the message, error msg - [%v], status code - [%v], desciption - [%s]", err, resp.StatusCode, desc)
-	}
-
-	return nil
-}
-
-func createEnvironment(webhookAction string, botKey string, ipAddress string, certificateFilePath string, url string) *environment {
-	//Valid input parameters
-	if botKey == "" {
-		log.Fatal("error: telegram bot token is not set")
-	}
-	if url == "" {
-		log.Fatal("error: url is not set")
-	}
-	if ipAddress == "" {
-		log.Fatal("error: ip address is not set")
-	} else if !reIpAddress.MatchString(ipAddress) {
-		log.Fatal("error: ip address is not valid")
-	}
-
+func createEnvironment(messenger Messenger, db Storage) *environment {
 	env := environment{
-		client:    http.Client{},
-		botKey:    botKey,
-		ipAddress: ipAddress,
-		db:        &hDataBase{},
+		messenger: messenger,
+		db:        db,
 		users: Users{
 			data: make(map[ChatId]User),
 			mut:  sync.Mutex{},
 		},
-		timeKeepers: map[ChatId]*TimeKeeper{},
+		timeKeepers: TimeKeepers{
+			data: make(map[ChatId]*TimeKeeper),
+			mut:  sync.Mutex{},
+		},
 	}
-	tmpString := ""
-	env.db.initDB(&tmpString)
+	env.backgroundCtx, env.stopBackground = context.WithCancel(context.Background())
+	env.queue = newMessageQueue(env.sendQueuedRequest)
+	metricsRegistry.onScrape(env.queue.updateDepthMetrics)
 	var err error
 	env.users.data, err = env.db.getAllUsersData()
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	//process webhook action provided by the user
-	if webhookAction == "install" {
-		err := env.setupWebhook(certificateFilePath, url)
-		if err != nil {
-			log.Printf("error: failed to install webhook - %v", err)
-		}
-	} else if webhookAction == "delete" {
-		err := env.deleteWebhook()
-		if err != nil {
-			log.Printf("error: failed to delete webhook - %v", err)
-		}
-	} else {
-		err := env.getWebhookInfo()
-		if err != nil {
-			log.Printf("error: failed to get webhook info - %v", err)
-		}
+		logger.fatal("failed to load users", "err", err)
 	}
+	env.resumeTimeKeepers()
+	env.goBackground(func(ctx context.Context) {
+		env.runScheduler(ctx, scheduleCheckInterval)
+	})
 
 	return &env
 }
 
-func GenerateMainKeyboard() TReplyKeyboard {
-	keyboard := make([][]TKeyBoardButton, 3)
-	keyboard[0] = GenerateKeyboardRow(TTEXT_START_FOCUS)
-	keyboard[1] = GenerateKeyboardRow(TTEXT_START_BREAK)
-	keyboard[2] = GenerateKeyboardRow(TTEXT_SETTINGS)
-
-	return TReplyKeyboard{
-		Keyboard:       keyboard,
-		ResizeKeyboard: true,
-	}
+// goBackground runs task until shutdown, task must return once ctx is
+// done.
+func (env *environment) goBackground(task func(ctx context.Context)) {
+	env.background.Add(1)
+	go func() {
+		defer env.background.Done()
+		task(env.backgroundCtx)
+	}()
 }
 
-func GenerateCustomKeyboard(menuOptions ...string) TReplyKeyboard {
-	keyboard := make([][]TKeyBoardButton, len(menuOptions))
-	for i, option := range menuOptions {
-		keyboard[i] = GenerateKeyboardRow(option)
-	}
+func GenerateMainKeyboard() Keyboard {
+	return GenerateCustomKeyboard(TTEXT_START_FOCUS, TTEXT_START_BREAK, TTEXT_SETTINGS)
+}
 
-	return TReplyKeyboard{
-		Keyboard:        keyboard,
-		ResizeKeyboard:  true,
-		OneTimeKeyboard: false,
-	}
+func GenerateSettingsKeyboard() Keyboard {
+	return GenerateCustomKeyboard(TTEXT_FOCUS_DURATION, TTEXT_BREAK_DURATION, TTEXT_REFLECTION, TTEXT_QUIET_HOURS, TTEXT_NUDGES, TTEXT_MAIN_MENU)
 }
 
-func GenerateKeyboardRow(btnText string) []TKeyBoardButton {
-	keyboard := make([]TKeyBoardButton, 1)
-	keyboard[0] = TKeyBoardButton{
-		Text: btnText,
+func GenerateCustomKeyboard(menuOptions ...string) Keyboard {
+	keyboard := make(Keyboard, len(menuOptions))
+	for i, option := range menuOptions {
+		keyboard[i] = GenerateKeyboardRow(option)
 	}
 	return keyboard
 }
 
-func (env *environment) generateTelegramUrl(action string) string {
-	return "https://api.telegram.org/bot" + env.botKey + "/" + action
+func GenerateKeyboardRow(btnText string) []string {
+	return []string{btnText}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMessenger records what the bot sends instead of delivering it,
+// edits of sent messages are kept apart.
+type testMessenger struct {
+	mut      sync.Mutex
+	messages []OutgoingMessage
+	edits    []OutgoingMessage
+}
+
+func (m *testMessenger) name() string {
+	return "test"
+}
+
+func (m *testMessenger) start(handler updateHandler) error {
+	return nil
+}
+
+func (m *testMessenger) stop(ctx context.Context) error {
+	return nil
+}
+
+func (m *testMessenger) health() (string, healthComponent) {
+	return "test", newHealthComponent(nil, nil)
+}
+
+func (m *testMessenger) messageRequest(msg OutgoingMessage) (*outgoingRequest, error) {
+	return jsonRequest("message", msg)
+}
+
+func (m *testMessenger) editRequest(messageId string, msg OutgoingMessage) (*outgoingRequest, error) {
+	return jsonRequest("edit", msg)
+}
+
+func (m *testMessenger) fileRequest(chatId ChatId, kind string, fileName string, content []byte, caption string) (*outgoingRequest, error) {
+	return jsonRequest("file", OutgoingMessage{ChatId: chatId, Text: caption})
+}
+
+func (m *testMessenger) answerRequest(press ButtonPress, text string) (*outgoingRequest, error) {
+	return jsonRequest("answer", OutgoingMessage{ChatId: press.ChatId, Text: text})
+}
+
+func (m *testMessenger) send(req *outgoingRequest) error {
+	msg := OutgoingMessage{}
+	err := json.Unmarshal(req.body, &msg)
+	if err != nil {
+		return err
+	}
+	m.mut.Lock()
+	if req.method == "edit" {
+		m.edits = append(m.edits, msg)
+	} else {
+		m.messages = append(m.messages, msg)
+	}
+	m.mut.Unlock()
+	return nil
+}
+
+// newTestEnvironment runs the bot on memory storage with a user who went
+// through /start.
+func newTestEnvironment(t *testing.T, chatId ChatId) (*environment, *testMessenger) {
+	messenger := &testMessenger{}
+	env := createEnvironment(messenger, newMemoryStorage())
+	env.users.add(chatId, User{FirstName: "Ann", FocusDurationMins: 25, BreakDurationMins: 5})
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		env.shutdown(ctx)
+	})
+	return env, messenger
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	EXPORT_FORMAT_JSON = "json"
+	EXPORT_FORMAT_CSV  = "csv"
+	EXPORT_FORMAT_ICS  = "ics"
+)
+
+var exportFormats = []string{EXPORT_FORMAT_JSON, EXPORT_FORMAT_CSV, EXPORT_FORMAT_ICS}
+
+const icsTimeLayout = "20060102T150405Z"
+
+// Content lines of iCalendar must not be longer than 75 octets.
+const icsMaxLineLength = 75
+
+func isExportFormat(format string) bool {
+	return findStringInSlice(exportFormats, format) != -1
+}
+
+// sessionEnd returns when the session ended, a running session is shown
+// with its planned end.
+func sessionEnd(s Session) time.Time {
+	if s.EndedAt.IsZero() {
+		return s.StartedAt.Add(time.Duration(s.PlannedMins) * time.Minute)
+	}
+	return s.EndedAt
+}
+
+// filterSessionsByTag keeps the sessions with the tag, an empty tag keeps all.
+func filterSessionsByTag(sessions []Session, tag string) []Session {
+	if tag == "" {
+		return sessions
+	}
+	filtered := make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.Tag == tag {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// writeSessions writes the sessions in the given export format.
+func writeSessions(w io.Writer, format string, chatId ChatId, sessions []Session) error {
+	switch format {
+	case EXPORT_FORMAT_JSON:
+		jsonBuf, err := json.MarshalIndent(sessions, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(jsonBuf, '\n'))
+		return err
+	case EXPORT_FORMAT_CSV:
+		return writeSessionsCsv(w, sessions)
+	case EXPORT_FORMAT_ICS:
+		return writeSessionsIcs(w, chatId, sessions)
+	}
+	return fmt.Errorf("unknown export format [%v]", format)
+}
+
+func writeSessionsCsv(w io.Writer, sessions []Session) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"id", "kind", "status", "planned_minutes", "started_at", "ended_at", "duration_minutes", "tag", "rating", "note", "interruptions", "stop_reason"})
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		endedAt := ""
+		duration := ""
+		rating := ""
+		if s.Rating > 0 {
+			rating = fmt.Sprint(s.Rating)
+		}
+		if !s.EndedAt.IsZero() {
+			endedAt = s.EndedAt.UTC().Format(time.RFC3339)
+			duration = fmt.Sprintf("%.1f", s.duration().Minutes())
+		}
+		err = writer.Write([]string{
+			fmt.Sprint(s.Id),
+			s.Kind,
+			s.Status,
+			fmt.Sprint(s.PlannedMins),
+			s.StartedAt.UTC().Format(time.RFC3339),
+			endedAt,
+			duration,
+			s.Tag,
+			rating,
+			s.Note,
+			fmt.Sprint(len(s.Interruptions)),
+			s.StopReason,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeSessionsIcs writes an iCalendar document with one event per session.
+func writeSessionsIcs(w io.Writer, chatId ChatId, sessions []Session) error {
+	var buf bytes.Buffer
+	line := func(content string) {
+		buf.WriteString(foldIcsLine(content))
+		buf.WriteString("\r\n")
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//horae//focus sessions//EN")
+	line("CALSCALE:GREGORIAN")
+	stamp := time.Now().UTC().Format(icsTimeLayout)
+	for _, s := range sessions {
+		summary := strings.ToUpper(s.Kind[:1]) + s.Kind[1:]
+		categories := escapeIcsText(s.Kind)
+		if s.Tag != "" {
+			summary += " " + formatTag(s.Tag)
+			categories += "," + escapeIcsText(s.Tag)
+		}
+		if s.Status != SESSION_STATUS_COMPLETED {
+			summary += " (" + s.Status + ")"
+		}
+		description := fmt.Sprintf("Planned for %v minutes", s.PlannedMins)
+		if s.Rating > 0 {
+			description += fmt.Sprintf(", rated %v/%v", s.Rating, maxSessionRating)
+		}
+		if len(s.Interruptions) > 0 {
+			description += fmt.Sprintf(", interrupted %v times", len(s.Interruptions))
+		}
+		if s.StopReason != "" {
+			description += ", stopped early: " + s.StopReason
+		}
+		if s.Note != "" {
+			description += "\n" + s.Note
+		}
+		line("BEGIN:VEVENT")
+		line(fmt.Sprintf("UID:%v-%v@horae", chatId, s.Id))
+		line("DTSTAMP:" + stamp)
+		line("DTSTART:" + s.StartedAt.UTC().Format(icsTimeLayout))
+		line("DTEND:" + sessionEnd(s).UTC().Format(icsTimeLayout))
+		line("SUMMARY:" + escapeIcsText(summary))
+		line("DESCRIPTION:" + escapeIcsText(description))
+		line("CATEGORIES:" + categories)
+		line("TRANSP:TRANSPARENT")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func escapeIcsText(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+	return replacer.Replace(text)
+}
+
+// foldIcsLine splits long content lines, continuation lines start with a
+// space. Multi-byte characters are never split.
+func foldIcsLine(content string) string {
+	if len(content) <= icsMaxLineLength {
+		return content
+	}
+	var buf strings.Builder
+	lineLength := 0
+	for _, r := range content {
+		size := len(string(r))
+		if lineLength+size > icsMaxLineLength {
+			buf.WriteString("\r\n ")
+			lineLength = 1
+		}
+		buf.WriteRune(r)
+		lineLength += size
+	}
+	return buf.String()
+}
+
+// exportSessions sends the session history of the chat as a document.
+func (env *environment) exportSessions(chatId ChatId, format string) error {
+	sessions, err := env.db.getSessions(chatId, time.Time{}, time.Time{})
+	if err != nil {
+		return fmt.Errorf("load sessions: %s", err)
+	}
+	var buf bytes.Buffer
+	err = writeSessions(&buf, format, chatId, sessions)
+	if err != nil {
+		return err
+	}
+	fileName := fmt.Sprintf("horae-sessions-%v.%v", time.Now().UTC().Format("20060102"), format)
+	return env.sendDocument(chatId, PRIORITY_INTERACTIVE, fileName, buf.Bytes(), "")
+}
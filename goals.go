@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// the bot must understand time zones on hosts without tzdata
+	_ "time/tzdata"
+)
+
+const (
+	GOAL_MINUTES  = "minutes"
+	GOAL_SESSIONS = "sessions"
+)
+
+const (
+	maxGoalMinutes  = 16 * 60
+	maxGoalSessions = 30
+	// every streakFreezeEvery days with the goal met earn a freeze day, a
+	// freeze day keeps the streak going over a missed day
+	streakFreezeEvery = 7
+	maxStreakFreezes  = 2
+	dayLayout         = "2006-01-02"
+)
+
+// DailyGoal is the focus a user wants to get done every day, either minutes
+// of focus or completed focus sessions.
+type DailyGoal struct {
+	Kind  string `json:"kind"`
+	Value int    `json:"value"`
+}
+
+type dayProgress struct {
+	focus    time.Duration
+	sessions int
+}
+
+type streakInfo struct {
+	days    int
+	freezes int
+}
+
+func (g DailyGoal) isSet() bool {
+	return g.Kind != "" && g.Value > 0
+}
+
+func (g DailyGoal) String() string {
+	if g.Kind == GOAL_MINUTES {
+		return formatDuration(time.Duration(g.Value) * time.Minute)
+	}
+	if g.Value == 1 {
+		return "1 session"
+	}
+	return fmt.Sprintf("%v sessions", g.Value)
+}
+
+func (g DailyGoal) isMet(progress dayProgress) bool {
+	if g.Kind == GOAL_MINUTES {
+		return progress.focus >= time.Duration(g.Value)*time.Minute
+	}
+	return progress.sessions >= g.Value
+}
+
+func (g DailyGoal) formatProgress(progress dayProgress) string {
+	if g.Kind == GOAL_MINUTES {
+		return fmt.Sprintf("%v of %v", formatDuration(progress.focus), g)
+	}
+	return fmt.Sprintf("%v of %v", progress.sessions, g)
+}
+
+// parseGoalArgs parses the arguments of /goal, e.g. "90 minutes", "90m" or
+// "4 sessions".
+func parseGoalArgs(args []string) (DailyGoal, error) {
+	text := strings.ToLower(strings.Join(args, ""))
+	unitStart := strings.IndexFunc(text, func(r rune) bool { return r < '0' || r > '9' })
+	if unitStart <= 0 {
+		return DailyGoal{}, fmt.Errorf("expected a number and a unit, got [%v]", text)
+	}
+	value, err := strconv.Atoi(text[:unitStart])
+	if err != nil {
+		return DailyGoal{}, err
+	}
+
+	goal := DailyGoal{Value: value}
+	switch text[unitStart:] {
+	case "m", "min", "mins", "minute", "minutes":
+		goal.Kind = GOAL_MINUTES
+	case "h", "hour", "hours":
+		goal.Kind = GOAL_MINUTES
+		goal.Value *= 60
+	case "s", "session", "sessions":
+		goal.Kind = GOAL_SESSIONS
+	default:
+		return DailyGoal{}, fmt.Errorf("unknown goal unit [%v]", text[unitStart:])
+	}
+	if goal.Value < 1 || (goal.Kind == GOAL_MINUTES && goal.Value > maxGoalMinutes) ||
+		(goal.Kind == GOAL_SESSIONS && goal.Value > maxGoalSessions) {
+		return DailyGoal{}, fmt.Errorf("goal [%v] is out of range", goal)
+	}
+	return goal, nil
+}
+
+// location returns the time zone of the user, days and streaks follow it.
+func (u *User) location() *time.Location {
+	if u.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		logger.warn("unknown time zone", "timezone", u.Timezone, "err", err)
+		return time.UTC
+	}
+	return loc
+}
+
+// parseTimezone accepts UTC and IANA names like Europe/Berlin.
+func parseTimezone(name string) (string, error) {
+	if strings.EqualFold(name, "utc") {
+		return "UTC", nil
+	}
+	if name == "" || name == "Local" {
+		return "", fmt.Errorf("time zone name is empty")
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return "", err
+	}
+	return loc.String(), nil
+}
+
+// progressByDay sums up focus sessions per local day of the user.
+// Completed sessions count as sessions, all of them count with the time
+// actually spent.
+func progressByDay(sessions []Session, loc *time.Location) map[string]dayProgress {
+	days := make(map[string]dayProgress)
+	for _, s := range sessions {
+		if s.Kind != SESSION_KIND_FOCUS {
+			continue
+		}
+		day := s.StartedAt.In(loc).Format(dayLayout)
+		progress := days[day]
+		progress.focus += s.duration()
+		if s.Status == SESSION_STATUS_COMPLETED {
+			progress.sessions++
+		}
+		days[day] = progress
+	}
+	return days
+}
+
+// calculateStreak walks the days from the first focus session to today. A
+// day with the goal met extends the streak, a missed day uses up a freeze
+// day or breaks the streak. Today doesn't break the streak while it lasts.
+func calculateStreak(days map[string]dayProgress, goal DailyGoal, now time.Time) streakInfo {
+	var streak streakInfo
+	if !goal.isSet() || len(days) == 0 {
+		return streak
+	}
+	first := now.Format(dayLayout)
+	for day := range days {
+		if day < first {
+			first = day
+		}
+	}
+	start, err := time.ParseInLocation(dayLayout, first, now.Location())
+	if err != nil {
+		return streak
+	}
+
+	today := now.Format(dayLayout)
+	for i := 0; ; i++ {
+		day := time.Date(start.Year(), start.Month(), start.Day()+i, 0, 0, 0, 0, now.Location()).Format(dayLayout)
+		if day > today {
+			break
+		}
+		switch {
+		case goal.isMet(days[day]):
+			streak.days++
+			if streak.days%streakFreezeEvery == 0 && streak.freezes < maxStreakFreezes {
+				streak.freezes++
+			}
+		case day == today:
+		case streak.freezes > 0:
+			streak.freezes--
+		default:
+			streak.days = 0
+		}
+	}
+	return streak
+}
+
+func formatStreak(streak streakInfo) string {
+	text := "no streak yet"
+	if streak.days == 1 {
+		text = "streak 1 day"
+	} else if streak.days > 1 {
+		text = fmt.Sprintf("streak %v days %v", streak.days, EMOJI_FIRE)
+	}
+	if streak.freezes > 0 {
+		text += fmt.Sprintf(", %v freeze days saved", streak.freezes)
+	}
+	return text
+}
+
+// goalProgress returns today's progress and the streak of the user.
+func (env *environment) goalProgress(chatId ChatId, user User, now time.Time) (dayProgress, streakInfo, error) {
+	sessions, err := env.db.getSessions(chatId, time.Time{}, time.Time{})
+	if err != nil {
+		return dayProgress{}, streakInfo{}, fmt.Errorf("load sessions: %s", err)
+	}
+	now = now.In(user.location())
+	days := progressByDay(sessions, now.Location())
+	return days[now.Format(dayLayout)], calculateStreak(days, user.Goal, now), nil
+}
+
+// goalProgressLine is shown with the main menu, it is empty without a goal.
+func (env *environment) goalProgressLine(chatId ChatId, user User) string {
+	if !user.Goal.isSet() {
+		return ""
+	}
+	today, streak, err := env.goalProgress(chatId, user, time.Now())
+	if err != nil {
+		logger.error("failed to calculate goal progress", "chat_id", chatId, "err", err)
+		return ""
+	}
+	return fmt.Sprintf("Today %v, %v", user.Goal.formatProgress(today), formatStreak(streak))
+}
+
+// goalReachedText congratulates when the finished session is the one that
+// met today's goal.
+func (env *environment) goalReachedText(chatId ChatId, user User, sessionId int64) string {
+	if !user.Goal.isSet() {
+		return ""
+	}
+	sessions, err := env.db.getSessions(chatId, time.Time{}, time.Time{})
+	if err != nil {
+		logger.error("failed to check the daily goal", "chat_id", chatId, "err", err)
+		return ""
+	}
+	now := time.Now().In(user.location())
+	today := now.Format(dayLayout)
+	before := make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.Id != sessionId {
+			before = append(before, s)
+		}
+	}
+	days := progressByDay(sessions, now.Location())
+	if !user.Goal.isMet(days[today]) || user.Goal.isMet(progressByDay(before, now.Location())[today]) {
+		return ""
+	}
+	return fmt.Sprintf("%v You reached your daily goal of %v, %v!", EMOJI_PARTY_POPPER, user.Goal,
+		formatStreak(calculateStreak(days, user.Goal, now)))
+}
+
+// generateGoalText answers /goal, it sets or clears the goal and the time
+// zone or shows the progress.
+func (env *environment) generateGoalText(chatId ChatId, user User, args []string) (string, error) {
+	usage := fmt.Sprintf("Usage: %v [90 minutes | 4 sessions | off], %v tz Europe/Berlin", TTEXT_GOAL_COMMAND, TTEXT_GOAL_COMMAND)
+	switch {
+	case len(args) == 1 && strings.EqualFold(args[0], "off"):
+		user.Goal = DailyGoal{}
+		err := env.users.updateUser(chatId, user)
+		if err != nil {
+			return "", err
+		}
+		return "Your daily goal is turned off", nil
+	case len(args) > 0 && strings.EqualFold(args[0], "tz"):
+		if len(args) != 2 {
+			return fmt.Sprintf("Your time zone is %v. %v", user.location(), usage), nil
+		}
+		timezone, err := parseTimezone(args[1])
+		if err != nil {
+			return fmt.Sprintf("I don't know the time zone [%v]. Use a name like Europe/Berlin or UTC", args[1]), nil
+		}
+		user.Timezone = timezone
+		err = env.users.updateUser(chatId, user)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Your days now follow the %v time zone", timezone), nil
+	case len(args) > 0:
+		goal, err := parseGoalArgs(args)
+		if err != nil {
+			return usage, nil
+		}
+		user.Goal = goal
+		err = env.users.updateUser(chatId, user)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !user.Goal.isSet() {
+		return fmt.Sprintf("You don't have a daily goal yet. %v", usage), nil
+	}
+	today, streak, err := env.goalProgress(chatId, user, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Your daily goal is %v, days follow the %v time zone\nToday %v, %v",
+		user.Goal, user.location(), user.Goal.formatProgress(today), formatStreak(streak)), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalculateStreak(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("load time zone: %v", err)
+	}
+	goal := DailyGoal{Kind: GOAL_SESSIONS, Value: 1}
+	// sessionsOn starts a focus session at 9:00 UTC on each of the days
+	// before testDay, 0 is testDay itself
+	sessionsOn := func(daysAgo ...int) []Session {
+		sessions := make([]Session, 0, len(daysAgo))
+		for _, n := range daysAgo {
+			sessions = append(sessions, testSession(1, testDay.AddDate(0, 0, -n)))
+		}
+		return sessions
+	}
+	lateSession := testSession(1, testDay.Add(-9*time.Hour-30*time.Minute))
+	daysRange := func(from int, to int) []int {
+		days := make([]int, 0)
+		for n := from; n >= to; n-- {
+			days = append(days, n)
+		}
+		return days
+	}
+
+	tests := []struct {
+		name     string
+		sessions []Session
+		loc      *time.Location
+		streak   streakInfo
+	}{
+		{"goal met today only", sessionsOn(0), time.UTC, streakInfo{days: 1}},
+		{"today doesn't break the streak", sessionsOn(2, 1), time.UTC, streakInfo{days: 2}},
+		{"missed day breaks the streak", sessionsOn(3, 1), time.UTC, streakInfo{days: 1}},
+		{"freeze covers a missed day", sessionsOn(append(daysRange(9, 3), 1)...), time.UTC, streakInfo{days: 8}},
+		{"freeze days earned every 7 days", sessionsOn(daysRange(7, 1)...), time.UTC, streakInfo{days: 7, freezes: 1}},
+		{"freeze days are capped", sessionsOn(daysRange(28, 1)...), time.UTC, streakInfo{days: 28, freezes: maxStreakFreezes}},
+		{"no sessions", nil, time.UTC, streakInfo{}},
+		// 23:30 UTC the day before is already testDay in Berlin
+		{"late session in utc", append(sessionsOn(0), lateSession), time.UTC, streakInfo{days: 2}},
+		{"session moved to another day by the time zone", append(sessionsOn(0), lateSession), berlin, streakInfo{days: 1}},
+	}
+	for _, test := range tests {
+		days := progressByDay(test.sessions, test.loc)
+		streak := calculateStreak(days, goal, testDay.In(test.loc))
+		if streak != test.streak {
+			t.Errorf("%v: expected %+v, got %+v", test.name, test.streak, streak)
+		}
+	}
+
+	if streak := calculateStreak(progressByDay(sessionsOn(0), time.UTC), DailyGoal{}, testDay); streak != (streakInfo{}) {
+		t.Errorf("expected no streak without a goal, got %+v", streak)
+	}
+}
+
+func TestGoalReachedText(t *testing.T) {
+	const chatId ChatId = 1
+	env, _ := newTestEnvironment(t, chatId)
+	user := env.users.data[chatId]
+	user.Goal = DailyGoal{Kind: GOAL_SESSIONS, Value: 2}
+	// sessions right after midnight are today whenever the test runs
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	tests := []struct {
+		name    string
+		reached bool
+	}{
+		{"first session", false},
+		{"session that meets the goal", true},
+		{"session after the goal was met", false},
+	}
+	for i, test := range tests {
+		session := testSession(chatId, today.Add(time.Duration(i)*time.Minute))
+		err := env.db.saveSession(session)
+		if err != nil {
+			t.Fatalf("save session: %v", err)
+		}
+		text := env.goalReachedText(chatId, user, session.Id)
+		if reached := strings.Contains(text, "You reached your daily goal of 2 sessions"); reached != test.reached {
+			t.Errorf("%v: expected reached %v, got %q", test.name, test.reached, text)
+		}
+	}
+
+	user.Goal = DailyGoal{}
+	if text := env.goalReachedText(chatId, user, 0); text != "" {
+		t.Errorf("expected no congratulation without a goal, got %q", text)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CHAT_TYPE_GROUP      = "group"
+	CHAT_TYPE_SUPERGROUP = "supergroup"
+)
+
+// Callback data of the inline buttons under a shared focus session, the
+// id of the session follows after a colon.
+const (
+	CALLBACK_JOIN_FOCUS  = "join_focus"
+	CALLBACK_LEAVE_FOCUS = "leave_focus"
+)
+
+const defaultGroupFocusMins = 25
+
+// Participant is a member of a group chat who joined a shared focus
+// session. Their own copy of the session is stored under their user id,
+// which is also the id of their private chat with the bot.
+type Participant struct {
+	UserId    int64  `json:"user_id"`
+	FirstName string `json:"first_name"`
+	SessionId int64  `json:"session_id"`
+	Left      bool   `json:"left,omitempty"`
+}
+
+// isGroupChatId tells group chats from private ones where only the id is
+// known, every messenger gives groups negative ids.
+func isGroupChatId(chatId ChatId) bool {
+	return chatId < 0
+}
+
+func activeParticipants(session Session) []Participant {
+	active := make([]Participant, 0, len(session.Participants))
+	for _, p := range session.Participants {
+		if !p.Left {
+			active = append(active, p)
+		}
+	}
+	return active
+}
+
+// removeParticipant drops the user from the participants of a group
+// session, it tells whether they were there.
+func (s *Session) removeParticipant(userId int64) bool {
+	kept := make([]Participant, 0, len(s.Participants))
+	for _, p := range s.Participants {
+		if p.UserId != userId {
+			kept = append(kept, p)
+		}
+	}
+	removed := len(kept) != len(s.Participants)
+	s.Participants = kept
+	return removed
+}
+
+// groupIdsOf returns the groups whose shared sessions the user joined,
+// their own copies of the sessions keep the group id.
+func groupIdsOf(sessions []Session) []ChatId {
+	seen := make(map[ChatId]bool)
+	groupIds := make([]ChatId, 0)
+	for _, s := range sessions {
+		if s.GroupId != 0 && !seen[s.GroupId] {
+			seen[s.GroupId] = true
+			groupIds = append(groupIds, s.GroupId)
+		}
+	}
+	return groupIds
+}
+
+// joinNames lists the names like "Ann, Bob and Cat".
+func joinNames(participants []Participant) string {
+	names := make([]string, len(participants))
+	for i, p := range participants {
+		names[i] = p.FirstName
+	}
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+func minutesLeft(tk *TimeKeeper, now time.Time) int {
+	return int(math.Ceil(tk.endsAt.Sub(now).Minutes()))
+}
+
+func groupFocusButtons(sessionId int64) []InlineButton {
+	return []InlineButton{
+		{Text: "Join " + EMOJI_SEEDLING, Data: fmt.Sprintf("%v:%v", CALLBACK_JOIN_FOCUS, sessionId)},
+		{Text: "Leave", Data: fmt.Sprintf("%v:%v", CALLBACK_LEAVE_FOCUS, sessionId)},
+	}
+}
+
+// groupFocusText announces the shared session with everyone focusing, the
+// announcement carries the Join and Leave buttons while the session runs.
+func groupFocusText(group Session, withButtons bool) string {
+	text := fmt.Sprintf("%v started a focus session for %v minutes", group.Participants[0].FirstName, group.PlannedMins)
+	if group.Tag != "" {
+		text += " on " + formatTag(group.Tag)
+	}
+	active := activeParticipants(group)
+	if len(active) > 1 || len(active) == 1 && active[0].UserId != group.Participants[0].UserId {
+		text += ". Focusing: " + joinNames(active)
+	}
+	if !withButtons {
+		return text
+	}
+	return text + ". Tap Join to focus together!"
+}
+
+func parseCallbackData(data string) (action string, sessionId int64, err error) {
+	parts := strings.SplitN(data, ":", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("unexpected callback data [%v]", data)
+	}
+	sessionId, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("unexpected session id in callback data [%v]", data)
+	}
+	return parts[0], sessionId, nil
+}
+
+func (env *environment) sendGroupText(groupId ChatId, text string) {
+	env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{ChatId: groupId, Text: text})
+}
+
+// processGroupMessage handles commands sent to a group chat, everything
+// else said in the group is none of the bot's business.
+func (env *environment) processGroupMessage(msg IncomingMessage, ulog *hLogger) {
+	groupId := msg.ChatId
+	if msg.From.Id <= 0 {
+		ulog.warn("invalid user id", "user_id", msg.From.Id)
+		return
+	}
+	command, args := splitCommand(msg.Text)
+	switch command {
+	case TTEXT_START_COMMAND:
+		env.sendGroupText(groupId, fmt.Sprintf("Hello everyone! Type %v [minutes] [#tag] to start a focus session together, "+
+			"the others can join it with a button. %v shows who focused the most", TTEXT_FOCUS_COMMAND, TTEXT_LEADERBOARD_COMMAND))
+	case TTEXT_FOCUS_COMMAND:
+		mins, tag, err := parseFocusArgs(args, defaultGroupFocusMins)
+		if err != nil {
+			env.sendGroupText(groupId, fmt.Sprintf("Usage: %v [minutes] [#tag], e.g. %v 25 #writing", TTEXT_FOCUS_COMMAND, TTEXT_FOCUS_COMMAND))
+			return
+		}
+		err = env.startGroupFocus(groupId, msg.From, mins, tag)
+		if err != nil {
+			ulog.error("failed to start a group focus session", "err", err)
+			env.sendGroupText(groupId, "Sorry, I couldn't start the focus session. Please try again later")
+		}
+	case TTEXT_LEADERBOARD_COMMAND:
+		text, err := env.processLeaderboardCommand(msg, args)
+		if err != nil {
+			ulog.error("failed to generate the leaderboard", "err", err)
+			env.sendGroupText(groupId, "Sorry, I couldn't get the leaderboard. Please try again later")
+			return
+		}
+		env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{ChatId: groupId, Text: text, Format: FORMAT_HTML})
+	default:
+		ulog.debug("group message ignored")
+	}
+}
+
+// startGroupFocus starts a focus session the members of the group can
+// join, the one who started it joins right away.
+func (env *environment) startGroupFocus(groupId ChatId, from Sender, mins int, tag string) error {
+	env.groupMut.Lock()
+	defer env.groupMut.Unlock()
+
+	now := time.Now()
+	if tk, ok := env.timeKeepers.get(groupId); ok {
+		env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{
+			ChatId:  groupId,
+			Text:    fmt.Sprintf("A focus session is already running, %v minutes left. Tap Join to focus together", minutesLeft(tk, now)),
+			Buttons: groupFocusButtons(tk.sessionId),
+		})
+		return nil
+	}
+
+	session := Session{
+		Id:          now.UnixNano(),
+		ChatId:      groupId,
+		Kind:        SESSION_KIND_FOCUS,
+		Status:      SESSION_STATUS_RUNNING,
+		PlannedMins: mins,
+		StartedAt:   now,
+		Tag:         tag,
+		GroupId:     groupId,
+	}
+	participant, err := env.saveParticipantSession(session, from, now, mins)
+	if err != nil {
+		return err
+	}
+	session.Participants = []Participant{participant}
+	err = env.db.saveSession(session)
+	if err != nil {
+		return fmt.Errorf("save group session: %s", err)
+	}
+
+	tk := startTimeKeeper(groupId, session.Id, SESSION_KIND_FOCUS, mins, "", focusCycle{}, env.onGroupTimekeepStopped)
+	env.timeKeepers.add(groupId, tk)
+	logger.info("group focus started", "chat_id", groupId, "user_id", from.Id, "minutes", mins)
+
+	env.sendMessage(PRIORITY_INTERACTIVE, OutgoingMessage{
+		ChatId:  groupId,
+		Text:    groupFocusText(session, true),
+		Buttons: groupFocusButtons(session.Id),
+	})
+	return nil
+}
+
+// saveParticipantSession stores the copy of the group session of a member,
+// it starts when they join.
+func (env *environment) saveParticipantSession(group Session, member Sender, now time.Time, mins int) (Participant, error) {
+	session := Session{
+		Id:          now.UnixNano(),
+		ChatId:      ChatId(member.Id),
+		Kind:        group.Kind,
+		Status:      SESSION_STATUS_RUNNING,
+		PlannedMins: mins,
+		StartedAt:   now,
+		Tag:         group.Tag,
+		GroupId:     group.ChatId,
+	}
+	err := env.db.saveSession(session)
+	if err != nil {
+		return Participant{}, fmt.Errorf("save participant session: %s", err)
+	}
+	env.users.recordFocus(ChatId(member.Id), now.Add(time.Duration(mins)*time.Minute))
+	return Participant{UserId: member.Id, FirstName: member.FirstName, SessionId: session.Id}, nil
+}
+
+// finishParticipantSession ends the copy of the group session of a member.
+func (env *environment) finishParticipantSession(p Participant, status string, endedAt time.Time) {
+	err := env.updateSession(ChatId(p.UserId), p.SessionId, func(session *Session) {
+		session.Status = status
+		session.EndedAt = endedAt
+	})
+	if err != nil {
+		logger.error("failed to finish participant session", "user_id", p.UserId, "session_id", p.SessionId, "err", err)
+	}
+	env.users.recordFocus(ChatId(p.UserId), endedAt)
+}
+
+// processButtonPress handles the Join and Leave buttons under a shared
+// focus session and keeps the announcement up to date.
+func (env *environment) processButtonPress(press ButtonPress) {
+	groupId := press.ChatId
+	ulog := env.updateLogger(press.UpdateId, groupId)
+	action, sessionId, err := parseCallbackData(press.Data)
+	if err != nil || press.From.Id <= 0 || !isGroupChatId(groupId) {
+		ulog.warn("invalid button press", "user_id", press.From.Id, "data", press.Data)
+		env.answerButtonPress(press, "")
+		return
+	}
+
+	env.groupMut.Lock()
+	defer env.groupMut.Unlock()
+	tk, ok := env.timeKeepers.get(groupId)
+	if !ok || tk.sessionId != sessionId {
+		env.answerButtonPress(press, "This focus session is already over")
+		return
+	}
+	group, err := env.db.getSession(groupId, sessionId)
+	if err != nil {
+		ulog.error("failed to load group session", "session_id", sessionId, "err", err)
+		env.answerButtonPress(press, "Sorry, something went wrong. Please try again later")
+		return
+	}
+
+	now := time.Now()
+	index := -1
+	for i, p := range group.Participants {
+		if p.UserId == press.From.Id && !p.Left {
+			index = i
+		}
+	}
+	var answer string
+	switch action {
+	case CALLBACK_JOIN_FOCUS:
+		if index != -1 {
+			env.answerButtonPress(press, "You are already focusing with the group")
+			return
+		}
+		mins := minutesLeft(tk, now)
+		participant, err := env.saveParticipantSession(group, press.From, now, mins)
+		if err != nil {
+			ulog.error("failed to join group focus", "user_id", press.From.Id, "err", err)
+			env.answerButtonPress(press, "Sorry, something went wrong. Please try again later")
+			return
+		}
+		group.Participants = append(group.Participants, participant)
+		answer = fmt.Sprintf("You joined! %v minutes to go", mins)
+	case CALLBACK_LEAVE_FOCUS:
+		if index == -1 {
+			env.answerButtonPress(press, "You are not part of this focus session")
+			return
+		}
+		group.Participants[index].Left = true
+		env.finishParticipantSession(group.Participants[index], SESSION_STATUS_CANCELLED, now)
+		answer = "You left the focus session"
+	default:
+		ulog.warn("unknown callback action", "data", press.Data)
+		env.answerButtonPress(press, "")
+		return
+	}
+
+	err = env.db.saveSession(group)
+	if err != nil {
+		ulog.error("failed to save group session", "session_id", sessionId, "err", err)
+	}
+	ulog.info("group focus participation changed", "user_id", press.From.Id, "action", action)
+	env.answerButtonPress(press, answer)
+
+	if len(activeParticipants(group)) == 0 && tk.stopTimeKeep() {
+		env.finishSession(groupId, tk, SESSION_STATUS_CANCELLED)
+		sessionEvents.inc(SESSION_KIND_FOCUS, "cancelled")
+		env.editMessage(PRIORITY_INTERACTIVE, press.MessageId, OutgoingMessage{ChatId: groupId, Text: groupFocusText(group, false)})
+		env.sendGroupText(groupId, "Everyone left, the focus session is cancelled")
+		return
+	}
+	env.editMessage(PRIORITY_INTERACTIVE, press.MessageId, OutgoingMessage{
+		ChatId:  groupId,
+		Text:    groupFocusText(group, true),
+		Buttons: groupFocusButtons(group.Id),
+	})
+}
+
+// onGroupTimekeepStopped completes the session of everyone still focusing
+// and tells the group.
+func (env *environment) onGroupTimekeepStopped(groupId ChatId, tk *TimeKeeper) {
+	env.groupMut.Lock()
+	defer env.groupMut.Unlock()
+
+	env.finishSession(groupId, tk, SESSION_STATUS_COMPLETED)
+	group, err := env.db.getSession(groupId, tk.sessionId)
+	if err != nil {
+		logger.error("failed to load group session", "chat_id", groupId, "session_id", tk.sessionId, "err", err)
+		return
+	}
+	focused := activeParticipants(group)
+	for _, p := range focused {
+		env.finishParticipantSession(p, SESSION_STATUS_COMPLETED, group.EndedAt)
+	}
+
+	text := "The focus session is over, time for a break!"
+	switch {
+	case len(focused) == 1:
+		text = fmt.Sprintf("The focus session is over! %v focused for %v minutes, time for a break!", joinNames(focused), group.PlannedMins)
+	case len(focused) > 1:
+		text = fmt.Sprintf("The focus session is over! %v focused together for %v minutes, time for a break!",
+			joinNames(focused), group.PlannedMins)
+	}
+	env.sendMessage(PRIORITY_BROADCAST, OutgoingMessage{ChatId: groupId, Text: text})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupFocusText(t *testing.T) {
+	group := Session{PlannedMins: 25, Tag: "docs", Participants: []Participant{
+		{UserId: 1, FirstName: "Ann"},
+		{UserId: 2, FirstName: "Bob"},
+		{UserId: 3, FirstName: "Cid", Left: true},
+	}}
+	text := groupFocusText(group, true)
+	if text != "Ann started a focus session for 25 minutes on #docs. Focusing: Ann and Bob. Tap Join to focus together!" {
+		t.Fatalf("unexpected announcement %q", text)
+	}
+
+	// once the starter left only the others are still focusing
+	group.Participants[0].Left = true
+	text = groupFocusText(group, false)
+	if text != "Ann started a focus session for 25 minutes on #docs. Focusing: Bob" {
+		t.Fatalf("unexpected announcement %q", text)
+	}
+
+	group.Participants = group.Participants[:1]
+	group.Participants[0].Left = false
+	group.Tag = ""
+	text = groupFocusText(group, true)
+	if text != "Ann started a focus session for 25 minutes. Tap Join to focus together!" {
+		t.Fatalf("unexpected announcement %q", text)
+	}
+}
+
+func TestGroupAnnouncementShowsWhoJoined(t *testing.T) {
+	const groupId ChatId = -100
+	env, messenger := newTestEnvironment(t, 1)
+	err := env.startGroupFocus(groupId, Sender{Id: 1, FirstName: "Ann"}, 25, "")
+	if err != nil {
+		t.Fatalf("start group focus: %v", err)
+	}
+	tk, ok := env.timeKeepers.get(groupId)
+	if !ok {
+		t.Fatalf("group focus is not running")
+	}
+
+	env.processButtonPress(ButtonPress{
+		Id:        "press",
+		ChatId:    groupId,
+		MessageId: "announcement",
+		From:      Sender{Id: 2, FirstName: "Bob"},
+		Data:      fmt.Sprintf("%v:%v", CALLBACK_JOIN_FOCUS, tk.sessionId),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = env.queue.flush(ctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(messenger.edits) != 1 {
+		t.Fatalf("expected one edit of the announcement, got %+v", messenger.edits)
+	}
+	edited := messenger.edits[0]
+	if edited.ChatId != groupId || !strings.Contains(edited.Text, "Focusing: Ann and Bob") || len(edited.Buttons) != 2 {
+		t.Fatalf("announcement doesn't show who joined: %+v", edited)
+	}
+}
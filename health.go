@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// The queue is considered saturated when it is filled above this share.
+const queueSaturationRatio = 0.8
+
+const (
+	HEALTH_STATUS_OK   = "ok"
+	HEALTH_STATUS_FAIL = "fail"
+)
+
+type healthComponent struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type healthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]healthComponent `json:"components"`
+}
+
+func newHealthComponent(err error, details interface{}) healthComponent {
+	component := healthComponent{
+		Status:  HEALTH_STATUS_OK,
+		Details: details,
+	}
+	if err != nil {
+		component.Status = HEALTH_STATUS_FAIL
+		component.Error = err.Error()
+	}
+	return component
+}
+
+func writeHealthReport(w http.ResponseWriter, components map[string]healthComponent) {
+	report := healthReport{
+		Status:     HEALTH_STATUS_OK,
+		Components: components,
+	}
+	for _, component := range components {
+		if component.Status != HEALTH_STATUS_OK {
+			report.Status = HEALTH_STATUS_FAIL
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != HEALTH_STATUS_OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func (env *environment) checkDatabaseOpen() healthComponent {
+	return newHealthComponent(env.db.checkOpen(), nil)
+}
+
+func (env *environment) checkDatabaseReadable() healthComponent {
+	return newHealthComponent(env.db.checkReadable(), nil)
+}
+
+func (env *environment) checkQueue() healthComponent {
+	total := 0
+	depth := env.queue.depth()
+	details := map[string]int{}
+	for priority, count := range depth {
+		details[priorityNames[priority]] = count
+		total += count
+	}
+
+	var err error
+	if float64(total) >= float64(env.queue.capacity)*queueSaturationRatio {
+		err = fmt.Errorf("outgoing queue is saturated, %v of %v", total, env.queue.capacity)
+	}
+	return newHealthComponent(err, details)
+}
+
+// healthHandler answers the liveness probe, the process is alive as long as
+// it can answer and the database file is open.
+func (env *environment) healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, map[string]healthComponent{
+		"process":  newHealthComponent(nil, nil),
+		"database": env.checkDatabaseOpen(),
+	})
+}
+
+// readyHandler answers the readiness probe.
+func (env *environment) readyHandler(w http.ResponseWriter, r *http.Request) {
+	messengerName, messengerHealth := env.messenger.health()
+	writeHealthReport(w, map[string]healthComponent{
+		"database":    env.checkDatabaseReadable(),
+		messengerName: messengerHealth,
+		"queue":       env.checkQueue(),
+	})
+}
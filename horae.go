@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Config struct {
@@ -15,37 +20,160 @@ type Config struct {
 	KeyFile          string `json:"key-file"`
 	Url              string `json:"url"`
 	IpAddress        string `json:"ip-address"`
+	AdminAddress     string `json:"admin-address"`
+	LogLevel         string `json:"log-level"`
+	LogFormat        string `json:"log-format"`
+	ShutdownTimeout  int    `json:"shutdown-timeout-seconds"`
+	BackupDir        string `json:"backup-dir"`
+	BackupInterval   int    `json:"backup-interval-minutes"`
+	BackupKeep       int    `json:"backup-keep"`
+	Storage          string `json:"storage"`
+	DatabasePath     string `json:"database-path"`
+	SqlitePath       string `json:"sqlite-path"`
+	BotUsername      string `json:"bot-username"`
+	Messenger        string `json:"messenger"`
+	DiscordBotToken  string `json:"discord-bot-token"`
+	DiscordApiUrl    string `json:"discord-api-url"`
 }
 
 func loadConfig() Config {
 	cfgFile, err := os.ReadFile("config.json")
 	if err != nil {
-		log.Fatal(err)
+		logger.fatal("failed to read config", "err", err)
+	}
+	cfg := Config{
+		AdminAddress:    "127.0.0.1:9090",
+		LogLevel:        "info",
+		LogFormat:       LOG_FORMAT_LOGFMT,
+		ShutdownTimeout: 30,
+		BackupDir:       dataFolderPath + "/backups",
+		BackupInterval:  60,
+		BackupKeep:      24,
+		Storage:         STORAGE_BBOLT,
+		DatabasePath:    defaultDatabaseFilePath,
+		SqlitePath:      defaultSqliteFilePath,
+		Messenger:       MESSENGER_TELEGRAM,
+		DiscordApiUrl:   defaultDiscordApiUrl,
 	}
-	cfg := Config{}
 	err = json.Unmarshal(cfgFile, &cfg)
 	if err != nil {
-		log.Fatalf("error: failed to parse config %v", err)
+		logger.fatal("failed to parse config", "err", err)
 	}
 
 	return cfg
 }
 
-func main() {
-	tlsCert := os.Getenv("tls-certificate")
-	fmt.Println(tlsCert)
+func setupLogging(cfg Config) {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logger: logger})
+	logger.addSecret(cfg.TelegramBotToken)
+	logger.addSecret(cfg.DiscordBotToken)
+
+	err := logger.setFormat(cfg.LogFormat)
+	if err != nil {
+		logger.fatal("invalid log format", "err", err)
+	}
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		logger.fatal("invalid log level", "err", err)
+	}
+	logger.setLevel(level)
+}
 
+func main() {
 	webHookAction := flag.String("webhook", "", "install or delete webhook, empty string means no action")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "run pending database migrations in a rolled back transaction and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] | %v <command> [args]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+		printCommandsUsage(flag.CommandLine.Output())
+	}
 	flag.Parse()
 
 	cfg := loadConfig()
+	setupLogging(cfg)
+
+	if flag.NArg() > 0 {
+		if !runCommand(cfg, flag.Arg(0), flag.Args()[1:]) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		return
+	}
 
-	env := createEnvironment(*webHookAction, cfg.TelegramBotToken, cfg.IpAddress, cfg.CertificateFile, cfg.Url)
+	if *migrateDryRun {
+		db := &hDataBase{path: cfg.DatabasePath}
+		db.openDB()
+		defer db.closeDB()
+		err := db.migrate(true)
+		if err != nil {
+			logger.fatal("migration dry run failed", "err", err)
+		}
+		return
+	}
+	logger.debug("tls certificate from environment", "tls_certificate", os.Getenv("tls-certificate"))
+
+	env := createEnvironment(newMessenger(cfg, *webHookAction), openStorage(cfg))
 	if env == nil {
-		log.Fatal("error: failed to create environment")
+		logger.fatal("failed to create environment")
+	}
+
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", metricsRegistry)
+	adminMux.HandleFunc("/loglevel", logLevelHandler)
+	adminMux.HandleFunc("/healthz", env.healthHandler)
+	adminMux.HandleFunc("/readyz", env.readyHandler)
+	adminMux.HandleFunc("/backup", env.backupHandler)
+	adminServer := startAdminServer(cfg.AdminAddress, adminMux)
+
+	env.backupDir = cfg.BackupDir
+	env.backupKeep = cfg.BackupKeep
+	env.botUsername = strings.TrimPrefix(cfg.BotUsername, "@")
+	if db, ok := env.db.(*hDataBase); ok && cfg.BackupInterval > 0 {
+		env.goBackground(func(ctx context.Context) {
+			db.runPeriodicBackups(ctx, cfg.BackupDir, time.Duration(cfg.BackupInterval)*time.Minute, cfg.BackupKeep)
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := env.messenger.start(env)
+	if err != nil {
+		logger.fatal("failed to start messenger", "messenger", env.messenger.name(), "err", err)
 	}
-	http.HandleFunc("/update/", env.updateHandler)
-	http.HandleFunc("/", env.rootHandler)
 
-	log.Fatal(http.ListenAndServeTLS(":443", cfg.CertificateFile, cfg.KeyFile, nil))
-}
\ No newline at end of file
+	<-ctx.Done()
+	stop()
+	timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+	logger.info("shutting down", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err = env.messenger.stop(shutdownCtx)
+	if err != nil {
+		logger.error("failed to stop messenger", "messenger", env.messenger.name(), "err", err)
+	}
+	env.shutdown(shutdownCtx)
+	err = adminServer.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.error("failed to stop admin server", "err", err)
+	}
+	logger.info("shutdown complete")
+}
+
+// startAdminServer serves operational endpoints on a separate plain HTTP
+// listener so they are never exposed through the webhook port.
+func startAdminServer(address string, mux *http.ServeMux) *http.Server {
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.error("admin server stopped", "err", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	INTERRUPTION_INTERNAL = "internal"
+	INTERRUPTION_EXTERNAL = "external"
+)
+
+const (
+	maxStopReasonLength = 200
+	commonStopReasons   = 3
+)
+
+// Reasons offered when focus is stopped early, any other text is accepted too.
+var stopReasons = []string{"Finished early", "Someone interrupted me", "Lost focus", "Something urgent came up"}
+
+// Interruption is logged during a focus session without ending it.
+type Interruption struct {
+	At   time.Time `json:"at"`
+	Kind string    `json:"kind"`
+	Note string    `json:"note,omitempty"`
+}
+
+func GenerateFocusKeyboard() Keyboard {
+	return GenerateCustomKeyboard(TTEXT_TIME_LEFT_FOCUS, TTEXT_INTERRUPTED, TTEXT_STOP_FOCUS)
+}
+
+func generateInterruptionKindResult(sessionId int64, replyText string) MenuProcessorResult {
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(TTEXT_INTERRUPTION_INTERNAL, TTEXT_INTERRUPTION_EXTERNAL, TTEXT_BACK),
+		replyText:     replyText,
+		userAction:    sessionAction(MENU_INTERRUPTION_KIND, sessionId),
+	}
+}
+
+func generateStopReasonResult(sessionId int64, replyText string) MenuProcessorResult {
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(append(append([]string{}, stopReasons...), TTEXT_SKIP)...),
+		replyText:     replyText,
+		userAction:    sessionAction(MENU_STOP_REASON, sessionId),
+	}
+}
+
+// backToFocusResult returns to the focus menu, or to the main menu when the
+// focus ended in the meantime.
+func backToFocusResult(chatId ChatId, replyText string, env *environment) MenuProcessorResult {
+	if tk, ok := env.timeKeepers.get(chatId); ok && tk.kind == SESSION_KIND_FOCUS {
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateFocusKeyboard(),
+			replyText:     fmt.Sprintf("%v You have %v to go", replyText, generateTimeLeftString(tk)),
+			userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
+		}
+	}
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateMainKeyboard(),
+		replyText:     replyText,
+		userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+	}
+}
+
+func processInterruptionKindMenu(messageText string, user User, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	sessionId, err := contextSessionId(user)
+	if err != nil {
+		return MenuProcessorResult{}, fmt.Errorf("interruption without a session: %s", err)
+	}
+
+	kind := ""
+	switch messageText {
+	case TTEXT_BACK:
+		return backToFocusResult(chatId, "Back to focus!", env), nil
+	case TTEXT_INTERRUPTION_INTERNAL:
+		kind = INTERRUPTION_INTERNAL
+	case TTEXT_INTERRUPTION_EXTERNAL:
+		kind = INTERRUPTION_EXTERNAL
+	default:
+		return generateInterruptionKindResult(sessionId, "Sorry, I didn't get that. Please select one of the options below"), nil
+	}
+
+	err = env.updateSession(chatId, sessionId, func(session *Session) {
+		session.Interruptions = append(session.Interruptions, Interruption{At: time.Now(), Kind: kind})
+	})
+	if err != nil {
+		return MenuProcessorResult{}, err
+	}
+	sessionEvents.inc(SESSION_KIND_FOCUS, "interrupted")
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(TTEXT_SKIP),
+		replyText:     "Noted. What was it? Type a short note or skip",
+		userAction:    sessionAction(MENU_INTERRUPTION_NOTE, sessionId),
+	}, nil
+}
+
+func processInterruptionNoteMenu(messageText string, user User, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	sessionId, err := contextSessionId(user)
+	if err != nil {
+		return MenuProcessorResult{}, fmt.Errorf("interruption without a session: %s", err)
+	}
+
+	interruptions := 0
+	err = env.updateSession(chatId, sessionId, func(session *Session) {
+		interruptions = len(session.Interruptions)
+		if messageText != TTEXT_SKIP && interruptions > 0 {
+			session.Interruptions[interruptions-1].Note = truncateText(strings.TrimSpace(messageText), maxNoteLength)
+		}
+	})
+	if err != nil {
+		return MenuProcessorResult{}, err
+	}
+	return backToFocusResult(chatId, fmt.Sprintf("Back to focus! Interruptions in this session: %v.", interruptions), env), nil
+}
+
+func processStopReasonMenu(messageText string, user User, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	result = MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateMainKeyboard(),
+		replyText:     "Back to main menu",
+		userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+	}
+	if messageText == TTEXT_SKIP {
+		return result, nil
+	}
+
+	sessionId, err := contextSessionId(user)
+	if err != nil {
+		return MenuProcessorResult{}, fmt.Errorf("stop reason without a session: %s", err)
+	}
+	err = env.updateSession(chatId, sessionId, func(session *Session) {
+		session.StopReason = truncateText(strings.TrimSpace(messageText), maxStopReasonLength)
+	})
+	if err != nil {
+		return MenuProcessorResult{}, err
+	}
+	result.replyText = "Got it, thanks!"
+	return result, nil
+}
+
+func truncateText(text string, maxLength int) string {
+	if utf8.RuneCountInString(text) > maxLength {
+		return string([]rune(text)[:maxLength])
+	}
+	return text
+}
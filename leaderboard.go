@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	LEADERBOARD_TODAY = "today"
+	LEADERBOARD_WEEK  = "week"
+	LEADERBOARD_MONTH = "month"
+)
+
+var leaderboardTitles = map[string]string{
+	LEADERBOARD_TODAY: "today",
+	LEADERBOARD_WEEK:  "this week",
+	LEADERBOARD_MONTH: "this month",
+}
+
+var leaderboardMedals = []string{EMOJI_FIRST_PLACE_MEDAL, EMOJI_SECOND_PLACE_MEDAL, EMOJI_THIRD_PLACE_MEDAL}
+
+type leaderboardEntry struct {
+	userId    int64
+	firstName string
+	focus     time.Duration
+}
+
+// leaderboardStart returns when the period around now began, weeks start
+// on Monday.
+func leaderboardStart(period string, now time.Time) time.Time {
+	today := startOfDay(now)
+	switch period {
+	case LEADERBOARD_WEEK:
+		return today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	case LEADERBOARD_MONTH:
+		return today.AddDate(0, 0, 1-today.Day())
+	}
+	return today
+}
+
+// groupMembers returns everyone who ever joined a shared focus session of
+// the group with the name they used last.
+func groupMembers(groupSessions []Session) map[int64]string {
+	members := make(map[int64]string)
+	for _, s := range groupSessions {
+		for _, p := range s.Participants {
+			members[p.UserId] = p.FirstName
+		}
+	}
+	return members
+}
+
+// rankFocus sums up the focus of the sessions started since from, members
+// without any focus are left out.
+func rankFocus(members map[int64]string, sessions map[int64][]Session, from time.Time) []leaderboardEntry {
+	entries := make([]leaderboardEntry, 0, len(members))
+	for userId, firstName := range members {
+		entry := leaderboardEntry{userId: userId, firstName: firstName}
+		for _, s := range sessions[userId] {
+			if s.Kind == SESSION_KIND_FOCUS && !s.StartedAt.Before(from) {
+				entry.focus += s.duration()
+			}
+		}
+		if entry.focus >= time.Minute {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].focus != entries[j].focus {
+			return entries[i].focus > entries[j].focus
+		}
+		return entries[i].firstName < entries[j].firstName
+	})
+	return entries
+}
+
+func formatLeaderboard(entries []leaderboardEntry, period string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<b>Focus leaderboard, %v</b>\n", leaderboardTitles[period])
+	if len(entries) == 0 {
+		b.WriteString("\nNobody has focused yet, start with " + TTEXT_FOCUS_COMMAND)
+		return b.String()
+	}
+	for i, entry := range entries {
+		place := fmt.Sprintf("%v.", i+1)
+		if i < len(leaderboardMedals) {
+			place = leaderboardMedals[i]
+		}
+		fmt.Fprintf(&b, "\n%v %v - <b>%v</b>", place, html.EscapeString(entry.firstName), formatDuration(entry.focus))
+	}
+	return b.String()
+}
+
+// generateLeaderboardText ranks the members of the group by the focus in
+// their whole history, not only in the shared sessions. Days follow the
+// time zone of the member who asked.
+func (env *environment) generateLeaderboardText(groupId ChatId, period string, now time.Time) (string, error) {
+	groupSessions, err := env.db.getSessions(groupId, time.Time{}, time.Time{})
+	if err != nil {
+		return "", fmt.Errorf("load group sessions: %s", err)
+	}
+	optOuts, err := env.db.getLeaderboardOptOuts(groupId)
+	if err != nil {
+		return "", err
+	}
+	members := groupMembers(groupSessions)
+	from := leaderboardStart(period, now)
+	sessions := make(map[int64][]Session, len(members))
+	for userId := range members {
+		if optOuts[userId] {
+			delete(members, userId)
+			continue
+		}
+		sessions[userId], err = env.db.getSessions(ChatId(userId), from, time.Time{})
+		if err != nil {
+			return "", fmt.Errorf("load sessions of member [%v]: %s", userId, err)
+		}
+	}
+	return formatLeaderboard(rankFocus(members, sessions, from), period), nil
+}
+
+// processLeaderboardCommand answers /leaderboard in a group chat.
+func (env *environment) processLeaderboardCommand(msg IncomingMessage, args []string) (string, error) {
+	groupId := msg.ChatId
+	period := LEADERBOARD_WEEK
+	if len(args) > 0 {
+		period = strings.ToLower(args[0])
+	}
+	switch period {
+	case "off", "on":
+		err := env.db.setLeaderboardOptOut(groupId, msg.From.Id, period == "off")
+		if err != nil {
+			return "", err
+		}
+		name := html.EscapeString(msg.From.FirstName)
+		if period == "off" {
+			return fmt.Sprintf("%v won't be shown on the leaderboard of this group", name), nil
+		}
+		return fmt.Sprintf("%v is back on the leaderboard of this group", name), nil
+	case LEADERBOARD_TODAY, LEADERBOARD_WEEK, LEADERBOARD_MONTH:
+		env.users.mut.Lock()
+		user := env.users.data[ChatId(msg.From.Id)]
+		env.users.mut.Unlock()
+		return env.generateLeaderboardText(groupId, period, time.Now().In(user.location()))
+	}
+	return fmt.Sprintf("Usage: %v [%v | %v | %v | off | on]", TTEXT_LEADERBOARD_COMMAND,
+		LEADERBOARD_TODAY, LEADERBOARD_WEEK, LEADERBOARD_MONTH), nil
+}
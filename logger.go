@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LOG_LEVEL_DEBUG = iota
+	LOG_LEVEL_INFO
+	LOG_LEVEL_WARN
+	LOG_LEVEL_ERROR
+)
+
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+)
+
+var logLevelNames = []string{
+	LOG_LEVEL_DEBUG: "debug",
+	LOG_LEVEL_INFO:  "info",
+	LOG_LEVEL_WARN:  "warn",
+	LOG_LEVEL_ERROR: "error",
+}
+
+// Bot tokens end up in Bot API urls and therefore in http client errors.
+var reBotToken = regexp.MustCompile(`bot\d+:[A-Za-z0-9_-]+`)
+
+const redactedValue = "[REDACTED]"
+
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(levelName, name) {
+			return level, nil
+		}
+	}
+	return LOG_LEVEL_INFO, fmt.Errorf("unknown log level [%v]", name)
+}
+
+type logOutput struct {
+	mut     sync.Mutex
+	out     io.Writer
+	format  string
+	level   int32
+	secrets []string
+}
+
+// hLogger writes structured lines, every logger derived with with() carries
+// its fields into all the lines it writes.
+type hLogger struct {
+	output *logOutput
+	fields []interface{}
+}
+
+var logger = &hLogger{
+	output: &logOutput{
+		out:    os.Stderr,
+		format: LOG_FORMAT_LOGFMT,
+		level:  LOG_LEVEL_INFO,
+	},
+}
+
+func (l *hLogger) setLevel(level int) {
+	atomic.StoreInt32(&l.output.level, int32(level))
+}
+
+func (l *hLogger) getLevel() int {
+	return int(atomic.LoadInt32(&l.output.level))
+}
+
+func (l *hLogger) setFormat(format string) error {
+	if format != LOG_FORMAT_LOGFMT && format != LOG_FORMAT_JSON {
+		return fmt.Errorf("unknown log format [%v]", format)
+	}
+	l.output.mut.Lock()
+	l.output.format = format
+	l.output.mut.Unlock()
+	return nil
+}
+
+// addSecret makes the logger replace every occurrence of secret.
+func (l *hLogger) addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	l.output.mut.Lock()
+	l.output.secrets = append(l.output.secrets, secret)
+	l.output.mut.Unlock()
+}
+
+func (l *hLogger) with(keyvals ...interface{}) *hLogger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &hLogger{
+		output: l.output,
+		fields: fields,
+	}
+}
+
+func (l *hLogger) debug(msg string, keyvals ...interface{}) {
+	l.log(LOG_LEVEL_DEBUG, msg, keyvals)
+}
+
+func (l *hLogger) info(msg string, keyvals ...interface{}) {
+	l.log(LOG_LEVEL_INFO, msg, keyvals)
+}
+
+func (l *hLogger) warn(msg string, keyvals ...interface{}) {
+	l.log(LOG_LEVEL_WARN, msg, keyvals)
+}
+
+func (l *hLogger) error(msg string, keyvals ...interface{}) {
+	l.log(LOG_LEVEL_ERROR, msg, keyvals)
+}
+
+// fatal logs the message and exits, the replacement for log.Fatal.
+func (l *hLogger) fatal(msg string, keyvals ...interface{}) {
+	l.log(LOG_LEVEL_ERROR, msg, keyvals)
+	os.Exit(1)
+}
+
+func (l *hLogger) log(level int, msg string, keyvals []interface{}) {
+	if level < l.getLevel() {
+		return
+	}
+
+	keys := []string{"time", "level", "msg"}
+	values := []interface{}{time.Now().UTC().Format(time.RFC3339Nano), logLevelNames[level], msg}
+	all := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(all); i += 2 {
+		keys = append(keys, fmt.Sprint(all[i]))
+		if i+1 < len(all) {
+			values = append(values, all[i+1])
+		} else {
+			values = append(values, "MISSING")
+		}
+	}
+
+	l.output.mut.Lock()
+	defer l.output.mut.Unlock()
+	var line string
+	if l.output.format == LOG_FORMAT_JSON {
+		line = formatJsonLine(keys, values)
+	} else {
+		line = formatLogfmtLine(keys, values)
+	}
+	io.WriteString(l.output.out, l.output.redact(line)+"\n")
+}
+
+func (o *logOutput) redact(line string) string {
+	for _, secret := range o.secrets {
+		line = strings.ReplaceAll(line, secret, redactedValue)
+	}
+	return reBotToken.ReplaceAllString(line, "bot"+redactedValue)
+}
+
+func stringifyLogValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func formatLogfmtLine(keys []string, values []interface{}) string {
+	var buf bytes.Buffer
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		value := fmt.Sprint(stringifyLogValue(values[i]))
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			buf.WriteString(fmt.Sprintf("%q", value))
+		} else {
+			buf.WriteString(value)
+		}
+	}
+	return buf.String()
+}
+
+func formatJsonLine(keys []string, values []interface{}) string {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		keyBytes, _ := json.Marshal(key)
+		valueBytes, err := json.Marshal(stringifyLogValue(values[i]))
+		if err != nil {
+			valueBytes, _ = json.Marshal(fmt.Sprint(values[i]))
+		}
+		buf.Write(keyBytes)
+		buf.WriteByte(':')
+		buf.Write(valueBytes)
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// stdLogWriter routes the standard library logger, used by net/http and
+// bbolt, through the structured logger.
+type stdLogWriter struct {
+	logger *hLogger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.logger.error(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// logLevelHandler reports the current level on GET and changes it on PUT or
+// POST with a level query parameter, e.g. PUT /loglevel?level=debug.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := parseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.setLevel(level)
+		logger.info("log level changed", "level", logLevelNames[level])
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, logLevelNames[logger.getLevel()])
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Buckets that can be emptied with db wipe-bucket, meta holds the schema
+// version and must never be wiped.
+var wipeableBuckets = []string{"users", "timers", "sessions", "partners", "deferred", optOutsBucketName}
+
+// openMaintenanceDB opens the bbolt file for the maintenance commands. The
+// database has to be migrated to the latest schema, which the bot does on
+// start, and the bot must not be running.
+func openMaintenanceDB(cfg Config) (*hDataBase, error) {
+	db := &hDataBase{path: cfg.DatabasePath}
+	err := db.openExisting()
+	if err == bbolt.ErrTimeout {
+		return nil, fmt.Errorf("database %v is locked, stop the bot first", cfg.DatabasePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %s", cfg.DatabasePath, err)
+	}
+	version, err := db.schemaVersion()
+	if err != nil {
+		db.closeDB()
+		return nil, err
+	}
+	if version != latestSchemaVersion() {
+		db.closeDB()
+		return nil, fmt.Errorf("database schema version is %v, start the bot once to migrate it to %v first", version, latestSchemaVersion())
+	}
+	return db, nil
+}
+
+// openCommandStorage opens the configured storage for commands that only
+// read it. SQLite can be read while the bot is running, bbolt can't.
+func openCommandStorage(cfg Config) (Storage, error) {
+	switch cfg.Storage {
+	case STORAGE_BBOLT:
+		return openMaintenanceDB(cfg)
+	case STORAGE_SQLITE:
+		return openSqliteStorage(cfg.SqlitePath)
+	}
+	return nil, fmt.Errorf("storage [%v] can't be opened by commands", cfg.Storage)
+}
+
+// printResult writes value as indented JSON or through the human readable
+// printer.
+func printResult(asJson bool, value interface{}, human func(w io.Writer)) error {
+	if asJson {
+		jsonBuf, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jsonBuf))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	human(w)
+	return w.Flush()
+}
+
+// parseArgs parses flags given before, between and after the positional
+// arguments and returns the positional ones, flag.Parse alone stops at
+// the first of them.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func parseChatIdArg(args []string) (ChatId, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected a single chat id")
+	}
+	chatId, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chat id [%v]", args[0])
+	}
+	return ChatId(chatId), nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+type userSummary struct {
+	ChatId   ChatId `json:"chat_id"`
+	User     User   `json:"user"`
+	Menu     string `json:"menu"`
+	Sessions int    `json:"sessions"`
+	Running  string `json:"running,omitempty"`
+}
+
+type userDetails struct {
+	userSummary
+	Timer          *TimeKeeperState `json:"timer,omitempty"`
+	RecentSessions []Session        `json:"recent_sessions"`
+}
+
+const recentSessionsShown = 10
+
+func usersCommand(cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected list, show or delete")
+	}
+	flags := flag.NewFlagSet("users "+args[0], flag.ExitOnError)
+	asJson := flags.Bool("json", false, "print the result as JSON")
+	positional := parseArgs(flags, args[1:])
+
+	db, err := openMaintenanceDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.closeDB()
+
+	switch args[0] {
+	case "list":
+		return listUsers(db, *asJson)
+	case "show":
+		chatId, err := parseChatIdArg(positional)
+		if err != nil {
+			return err
+		}
+		return showUser(db, chatId, *asJson)
+	case "delete":
+		chatId, err := parseChatIdArg(positional)
+		if err != nil {
+			return err
+		}
+		return deleteUser(db, chatId, *asJson)
+	}
+	return fmt.Errorf("unknown users command [%v]", args[0])
+}
+
+func summarizeUser(db *hDataBase, chatId ChatId, user User, timers map[ChatId]TimeKeeperState) (userSummary, []Session, error) {
+	sessions, err := db.getSessions(chatId, time.Time{}, time.Time{})
+	if err != nil {
+		return userSummary{}, nil, err
+	}
+	summary := userSummary{
+		ChatId:   chatId,
+		User:     user,
+		Menu:     getMenuName(user.LastAction.CurrentMenu),
+		Sessions: len(sessions),
+	}
+	if state, ok := timers[chatId]; ok {
+		summary.Running = state.Kind
+	}
+	return summary, sessions, nil
+}
+
+func listUsers(db *hDataBase, asJson bool) error {
+	users, err := db.getAllUsersData()
+	if err != nil {
+		return err
+	}
+	timers, err := db.getAllTimers()
+	if err != nil {
+		return err
+	}
+	summaries := make([]userSummary, 0, len(users))
+	for chatId, user := range users {
+		summary, _, err := summarizeUser(db, chatId, user, timers)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].ChatId < summaries[j].ChatId
+	})
+
+	return printResult(asJson, summaries, func(w io.Writer) {
+		fmt.Fprintln(w, "CHAT ID\tNAME\tFOCUS\tBREAK\tMENU\tSESSIONS\tSAVED TIMER")
+		for _, s := range summaries {
+			running := s.Running
+			if running == "" {
+				running = "-"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.ChatId, s.User.FirstName, s.User.FocusDurationMins,
+				s.User.BreakDurationMins, s.Menu, s.Sessions, running)
+		}
+	})
+}
+
+func showUser(db *hDataBase, chatId ChatId, asJson bool) error {
+	users, err := db.getAllUsersData()
+	if err != nil {
+		return err
+	}
+	user, ok := users[chatId]
+	if !ok {
+		return fmt.Errorf("user with chat id [%v] not found", chatId)
+	}
+	timers, err := db.getAllTimers()
+	if err != nil {
+		return err
+	}
+	summary, sessions, err := summarizeUser(db, chatId, user, timers)
+	if err != nil {
+		return err
+	}
+	details := userDetails{userSummary: summary}
+	if state, ok := timers[chatId]; ok {
+		details.Timer = &state
+	}
+	if len(sessions) > recentSessionsShown {
+		sessions = sessions[len(sessions)-recentSessionsShown:]
+	}
+	details.RecentSessions = sessions
+
+	return printResult(asJson, details, func(w io.Writer) {
+		fmt.Fprintf(w, "Chat id:\t%v\n", details.ChatId)
+		fmt.Fprintf(w, "Name:\t%v\n", details.User.FirstName)
+		fmt.Fprintf(w, "Focus duration:\t%v min\n", details.User.FocusDurationMins)
+		fmt.Fprintf(w, "Break duration:\t%v min\n", details.User.BreakDurationMins)
+		fmt.Fprintf(w, "Menu:\t%v\n", details.Menu)
+		fmt.Fprintf(w, "Sessions:\t%v\n", details.Sessions)
+		if len(details.User.Tags) > 0 {
+			tags := make([]string, 0, len(details.User.Tags))
+			for _, tag := range details.User.Tags {
+				tags = append(tags, formatTag(tag))
+			}
+			fmt.Fprintf(w, "Recent tags:\t%v\n", strings.Join(tags, " "))
+		}
+		if details.User.Goal.isSet() {
+			fmt.Fprintf(w, "Daily goal:\t%v\n", details.User.Goal)
+		}
+		if details.User.Timezone != "" {
+			fmt.Fprintf(w, "Time zone:\t%v\n", details.User.Timezone)
+		}
+		if details.Timer != nil {
+			fmt.Fprintf(w, "Saved timer:\t%v until %v\n", details.Timer.Kind, formatTime(details.Timer.EndsAt))
+		}
+		if len(details.RecentSessions) == 0 {
+			return
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "STARTED\tKIND\tSTATUS\tPLANNED\tDURATION\tTAG")
+		for _, s := range details.RecentSessions {
+			duration := "-"
+			if !s.EndedAt.IsZero() {
+				duration = s.duration().Round(time.Second).String()
+			}
+			tag := "-"
+			if s.Tag != "" {
+				tag = formatTag(s.Tag)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v min\t%v\t%v\n", formatTime(s.StartedAt), s.Kind, s.Status, s.PlannedMins, duration, tag)
+		}
+	})
+}
+
+func deleteUser(db *hDataBase, chatId ChatId, asJson bool) error {
+	users, err := db.getAllUsersData()
+	if err != nil {
+		return err
+	}
+	if _, ok := users[chatId]; !ok {
+		return fmt.Errorf("user with chat id [%v] not found", chatId)
+	}
+	err = db.deleteUserData(chatId)
+	if err != nil {
+		return err
+	}
+	result := map[string]interface{}{"chat_id": chatId, "deleted": true}
+	return printResult(asJson, result, func(w io.Writer) {
+		fmt.Fprintf(w, "deleted user %v with its timer and session history\n", chatId)
+	})
+}
+
+type bucketStats struct {
+	Name string `json:"name"`
+	Keys int    `json:"keys"`
+}
+
+type databaseStats struct {
+	Path           string        `json:"path"`
+	SizeBytes      int64         `json:"size_bytes"`
+	SchemaVersion  int           `json:"schema_version"`
+	Buckets        []bucketStats `json:"buckets"`
+	Sessions       int           `json:"sessions"`
+	LastShutdownAt string        `json:"last_shutdown_at,omitempty"`
+}
+
+func dbCommand(cfg Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected stats or wipe-bucket")
+	}
+	flags := flag.NewFlagSet("db "+args[0], flag.ExitOnError)
+	asJson := flags.Bool("json", false, "print the result as JSON")
+	positional := parseArgs(flags, args[1:])
+
+	db, err := openMaintenanceDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.closeDB()
+
+	switch args[0] {
+	case "stats":
+		return printDatabaseStats(db, *asJson)
+	case "wipe-bucket":
+		if len(positional) != 1 {
+			return fmt.Errorf("expected a bucket name, one of %v", wipeableBuckets)
+		}
+		return wipeBucketCommand(db, cfg, positional[0], *asJson)
+	}
+	return fmt.Errorf("unknown db command [%v]", args[0])
+}
+
+func printDatabaseStats(db *hDataBase, asJson bool) error {
+	stats := databaseStats{Path: db.path}
+	err := db.view("stats", func(tx *bbolt.Tx) error {
+		stats.SizeBytes = tx.Size()
+		stats.SchemaVersion = readSchemaVersion(tx)
+		stats.LastShutdownAt = string(tx.Bucket([]byte(metaBucketName)).Get([]byte(lastShutdownMetaKey)))
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			keys := 0
+			err := b.ForEach(func(k, v []byte) error {
+				keys++
+				// session buckets are nested per chat
+				if v == nil && string(name) == "sessions" {
+					stats.Sessions += b.Bucket(k).Stats().KeyN
+				}
+				return nil
+			})
+			stats.Buckets = append(stats.Buckets, bucketStats{Name: string(name), Keys: keys})
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return printResult(asJson, stats, func(w io.Writer) {
+		fmt.Fprintf(w, "Path:\t%v\n", stats.Path)
+		fmt.Fprintf(w, "Size:\t%v bytes\n", stats.SizeBytes)
+		fmt.Fprintf(w, "Schema version:\t%v\n", stats.SchemaVersion)
+		fmt.Fprintf(w, "Sessions:\t%v\n", stats.Sessions)
+		if stats.LastShutdownAt != "" {
+			fmt.Fprintf(w, "Last shutdown:\t%v\n", stats.LastShutdownAt)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "BUCKET\tKEYS")
+		for _, b := range stats.Buckets {
+			fmt.Fprintf(w, "%v\t%v\n", b.Name, b.Keys)
+		}
+	})
+}
+
+// wipeBucketCommand backs the database up before emptying the bucket, the
+// backup is the only way back.
+func wipeBucketCommand(db *hDataBase, cfg Config, bucketName string, asJson bool) error {
+	wipeable := false
+	for _, name := range wipeableBuckets {
+		if name == bucketName {
+			wipeable = true
+		}
+	}
+	if !wipeable {
+		return fmt.Errorf("bucket [%v] can't be wiped, expected one of %v", bucketName, wipeableBuckets)
+	}
+
+	backupPath, err := db.createBackup(cfg.BackupDir, cfg.BackupKeep)
+	if err != nil {
+		return fmt.Errorf("backup before wipe: %s", err)
+	}
+	err = db.wipeBucket([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+	result := map[string]interface{}{"bucket": bucketName, "wiped": true, "backup": backupPath}
+	return printResult(asJson, result, func(w io.Writer) {
+		fmt.Fprintf(w, "wiped bucket %v, the previous data is in %v\n", bucketName, backupPath)
+	})
+}
+
+func webhookCommand(cfg Config, args []string) error {
+	if len(args) == 0 || args[0] != "info" {
+		return fmt.Errorf("expected info")
+	}
+	flags := flag.NewFlagSet("webhook info", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "print the result as JSON")
+	flags.Parse(args[1:])
+
+	info, err := fetchWebhookInfo(cfg.TelegramBotToken, cfg.IpAddress)
+	if err != nil {
+		return err
+	}
+	return printResult(*asJson, info, func(w io.Writer) {
+		url := info.Url
+		if url == "" {
+			url = "- (not installed)"
+		}
+		fmt.Fprintf(w, "Url:\t%v\n", url)
+		fmt.Fprintf(w, "Custom certificate:\t%v\n", info.HasCustomCertificate)
+		fmt.Fprintf(w, "Pending updates:\t%v\n", info.PendingUpdateCount)
+		if info.IpAddress != "" {
+			fmt.Fprintf(w, "Ip address:\t%v\n", info.IpAddress)
+		}
+		if info.MaxConnections > 0 {
+			fmt.Fprintf(w, "Max connections:\t%v\n", info.MaxConnections)
+		}
+		if info.LastErrorMessage != "" {
+			fmt.Fprintf(w, "Last error:\t%v at %v\n", info.LastErrorMessage, formatTime(time.Unix(info.LastErrorDate, 0)))
+		}
+	})
+}
+
+const exportDateLayout = "2006-01-02"
+
+func exportCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	chat := flags.Int64("chat", 0, "chat id of the user")
+	from := flags.String("from", "", "first day to export, YYYY-MM-DD in UTC")
+	to := flags.String("to", "", "last day to export, YYYY-MM-DD in UTC")
+	format := flags.String("format", EXPORT_FORMAT_CSV, "output format, one of json, csv or ics")
+	out := flags.String("out", "", "output file, defaults to stdout")
+	tagFilter := flags.String("tag", "", "export only sessions with this tag")
+	flags.Parse(args)
+
+	if *chat == 0 {
+		return fmt.Errorf("-chat is required")
+	}
+	if !isExportFormat(*format) {
+		return fmt.Errorf("unknown format [%v], expected one of %v", *format, exportFormats)
+	}
+	var fromTime, toTime time.Time
+	var err error
+	if *from != "" {
+		fromTime, err = time.Parse(exportDateLayout, *from)
+		if err != nil {
+			return fmt.Errorf("invalid -from: %s", err)
+		}
+	}
+	if *to != "" {
+		toTime, err = time.Parse(exportDateLayout, *to)
+		if err != nil {
+			return fmt.Errorf("invalid -to: %s", err)
+		}
+		// the last day is included
+		toTime = toTime.AddDate(0, 0, 1)
+	}
+
+	db, err := openCommandStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.closeDB()
+	sessions, err := db.getSessions(ChatId(*chat), fromTime, toTime)
+	if err != nil {
+		return err
+	}
+	sessions = filterSessionsByTag(sessions, strings.TrimPrefix(strings.ToLower(*tagFilter), "#"))
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	return writeSessions(w, *format, ChatId(*chat), sessions)
+}
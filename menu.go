@@ -2,13 +2,22 @@ package main
 
 import (
 	"fmt"
-	"log"
 )
 
 const (
-	TTEXT_START_COMMAND     = "/start"
-	TTEXT_DURATIONS_COMMAND = "/durations"
-	TTEXT_MAIN_MENU_COMMAND = "/main"
+	TTEXT_START_COMMAND       = "/start"
+	TTEXT_DURATIONS_COMMAND   = "/durations"
+	TTEXT_MAIN_MENU_COMMAND   = "/main"
+	TTEXT_EXPORT_COMMAND      = "/export"
+	TTEXT_DELETE_ME_COMMAND   = "/deleteme"
+	TTEXT_FOCUS_COMMAND       = "/focus"
+	TTEXT_STATS_COMMAND       = "/stats"
+	TTEXT_JOURNAL_COMMAND     = "/journal"
+	TTEXT_GOAL_COMMAND        = "/goal"
+	TTEXT_CHART_COMMAND       = "/chart"
+	TTEXT_SCHEDULE_COMMAND    = "/schedule"
+	TTEXT_PARTNER_COMMAND     = "/partner"
+	TTEXT_LEADERBOARD_COMMAND = "/leaderboard"
 
 	TTEXT_MAIN_MENU             = "Main menu"
 	TTEXT_START_FOCUS           = "Let's focus " + EMOJI_SEEDLING
@@ -23,6 +32,28 @@ const (
 	TTEXT_CHANGE_FOCUS_DURATION = "Change focus duration"
 	TTEXT_CHANGE_BREAK_DURATION = "Change break duration"
 	TTEXT_BACK                  = EMOJI_BACK
+	TTEXT_CONFIRM_DELETE        = "Yes, delete my data " + EMOJI_CROSS_MARK
+	TTEXT_CANCEL                = "Cancel"
+	TTEXT_NO_TAG                = "No tag"
+	TTEXT_SKIP                  = "Skip"
+	TTEXT_REFLECTION            = "Reflection after focus"
+	TTEXT_INTERRUPTED           = "I got interrupted " + EMOJI_HIGH_VOLTAGE
+	TTEXT_INTERRUPTION_INTERNAL = "My own thoughts " + EMOJI_THOUGHT_BALLOON
+	TTEXT_INTERRUPTION_EXTERNAL = "Someone or something else " + EMOJI_BELL
+	TTEXT_CANCEL_SCHEDULE       = "Cancel schedule "
+	TTEXT_START_SCHEDULED       = "Start planned focus " + EMOJI_SEEDLING
+	TTEXT_QUIET_HOURS           = "Quiet hours"
+	TTEXT_QUIET_DEFER           = "Hold messages until the end"
+	TTEXT_QUIET_SILENT          = "Send messages muted"
+	TTEXT_QUIET_OFF             = "Turn quiet hours off"
+	TTEXT_NUDGES                = "Reminders to focus"
+	TTEXT_REMIND_AFTER          = "Remind me after "
+	TTEXT_WORK_WEEKDAYS         = "Only on weekdays"
+	TTEXT_WORK_EVERY_DAY        = "Every day"
+	TTEXT_NUDGES_OFF            = "Turn reminders off"
+	TTEXT_NOT_NOW               = "Not now"
+	TTEXT_INVITE_PARTNER        = "Invite a partner"
+	TTEXT_END_PARTNERSHIP       = "Stop partnering with "
 
 	EMOJI_SEEDLING                  = "\U0001F331"
 	EMOJI_HERB                      = "\U0001F33F"
@@ -35,6 +66,14 @@ const (
 	EMOJI_WHITE_MEDIUM_SMALL_SQUARE = "\u25FD"
 	EMOJI_PERSON_IN_LOTUS_POSITION  = "\U0001F9D8"
 	EMOJI_PERSON_RUNNING            = "\U0001F3C3"
+	EMOJI_HIGH_VOLTAGE              = "\u26A1"
+	EMOJI_THOUGHT_BALLOON           = "\U0001F4AD"
+	EMOJI_BELL                      = "\U0001F514"
+	EMOJI_FIRE                      = "\U0001F525"
+	EMOJI_PARTY_POPPER              = "\U0001F389"
+	EMOJI_FIRST_PLACE_MEDAL         = "\U0001F947"
+	EMOJI_SECOND_PLACE_MEDAL        = "\U0001F948"
+	EMOJI_THIRD_PLACE_MEDAL         = "\U0001F949"
 )
 
 const (
@@ -46,53 +85,84 @@ const (
 	MENU_SETTINGS
 	MENU_SETTINGS_FOCUS_DURATION
 	MENU_SETTINGS_BREAK_DURATION
+	MENU_CONFIRM_DELETE
+	MENU_CHOOSE_TAG
+	MENU_REFLECTION_NOTE
+	MENU_REFLECTION_RATING
+	MENU_INTERRUPTION_KIND
+	MENU_INTERRUPTION_NOTE
+	MENU_STOP_REASON
+	MENU_SCHEDULES
+	MENU_SCHEDULE_PROMPT
+	MENU_SETTINGS_QUIET_HOURS
+	MENU_SETTINGS_NUDGES
+	MENU_NUDGE
+	MENU_PARTNERS
 )
 
+var menuNames = map[int]string{
+	MENU_MAIN_MENU:               "main",
+	MENU_INIT_FOCUS:              "init_focus",
+	MENU_INIT_BREAK:              "init_break",
+	MENU_INFOCUS:                 "in_focus",
+	MENU_INBREAK:                 "in_break",
+	MENU_SETTINGS:                "settings",
+	MENU_SETTINGS_FOCUS_DURATION: "settings_focus_duration",
+	MENU_SETTINGS_BREAK_DURATION: "settings_break_duration",
+	MENU_CONFIRM_DELETE:          "confirm_delete",
+	MENU_CHOOSE_TAG:              "choose_tag",
+	MENU_REFLECTION_NOTE:         "reflection_note",
+	MENU_REFLECTION_RATING:       "reflection_rating",
+	MENU_INTERRUPTION_KIND:       "interruption_kind",
+	MENU_INTERRUPTION_NOTE:       "interruption_note",
+	MENU_STOP_REASON:             "stop_reason",
+	MENU_SCHEDULES:               "schedules",
+	MENU_SCHEDULE_PROMPT:         "schedule_prompt",
+	MENU_SETTINGS_QUIET_HOURS:    "settings_quiet_hours",
+	MENU_SETTINGS_NUDGES:         "settings_nudges",
+	MENU_NUDGE:                   "nudge",
+	MENU_PARTNERS:                "partners",
+}
+
+func getMenuName(menu int) string {
+	if name, ok := menuNames[menu]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 const (
 	RESPONSE_TYPE_NONE = iota
 	RESPONSE_TYPE_TEXT
 	RESPONSE_TYPE_KEYBOARD
+	RESPONSE_TYPE_REMOVE_KEYBOARD
 )
 
 type MenuProcessorResult struct {
 	responseType  int
-	replyKeyboard TReplyKeyboard
+	replyKeyboard Keyboard
 	replyText     string
 	userAction    UserAction
+	// forgetUser asks the update handler to delete everything stored about
+	// the user instead of saving the next menu
+	forgetUser bool
 }
 
 func processMainMenu(messageText string, user User, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
 	switch messageText {
 	case TTEXT_START_FOCUS:
-		_, ok := env.timeKeepers[chatId]
-		if ok {
-			return MenuProcessorResult{
-				responseType:  RESPONSE_TYPE_KEYBOARD,
-				replyKeyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_FOCUS, TTEXT_STOP_FOCUS),
-				replyText:     "Oops, looks like you already have an active time guard!",
-				userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
-			}, nil
-		}
-
-		env.timeKeepers[chatId] = startTimeKeeper(chatId, user.FocusDurationMins, "The focus session ended, you can rest now!", env.onTimekeepStopped)
-		result = MenuProcessorResult{
-			responseType:  RESPONSE_TYPE_KEYBOARD,
-			replyKeyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_FOCUS, TTEXT_STOP_FOCUS),
-			replyText:     fmt.Sprintf("Focus started! I will keep you focused for %v minutes", user.FocusDurationMins),
-			userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
+		_, ok := env.timeKeepers.get(chatId)
+		if !ok && len(user.Tags) > 0 {
+			return generateChooseTagResult(user, "What are you going to work on?"), nil
 		}
+		result = startFocus(chatId, user.FocusDurationMins, "", 1, env)
 	case TTEXT_START_BREAK:
-		_, ok := env.timeKeepers[chatId]
+		tk, ok := env.timeKeepers.get(chatId)
 		if ok {
-			return MenuProcessorResult{
-				responseType:  RESPONSE_TYPE_KEYBOARD,
-				replyKeyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_BREAK, TTEXT_STOP_BREAK),
-				replyText:     "Oops, looks like you already have an active time guard!",
-				userAction:    UserAction{CurrentMenu: MENU_INBREAK},
-			}, fmt.Errorf("user with chat id - [%v] already has a time keeper", chatId)
+			return activeTimerResult(tk), nil
 		}
 
-		env.timeKeepers[chatId] = startTimeKeeper(chatId, user.BreakDurationMins, "Break is over. Let's get back to work!", env.onTimekeepStopped)
+		env.startSession(chatId, SESSION_KIND_BREAK, user.BreakDurationMins, "", "Break is over. Let's get back to work!", focusCycle{})
 		result = MenuProcessorResult{
 			responseType:  RESPONSE_TYPE_KEYBOARD,
 			replyKeyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_BREAK, TTEXT_STOP_BREAK),
@@ -102,7 +172,7 @@ func processMainMenu(messageText string, user User, chatId ChatId, env *environm
 	case TTEXT_SETTINGS:
 		result = MenuProcessorResult{
 			responseType:  RESPONSE_TYPE_KEYBOARD,
-			replyKeyboard: GenerateCustomKeyboard(TTEXT_FOCUS_DURATION, TTEXT_BREAK_DURATION, TTEXT_MAIN_MENU),
+			replyKeyboard: GenerateSettingsKeyboard(),
 			replyText:     "Settings",
 			userAction:    UserAction{CurrentMenu: MENU_SETTINGS},
 		}
@@ -110,47 +180,145 @@ func processMainMenu(messageText string, user User, chatId ChatId, env *environm
 	return
 }
 
-func processInFocusMenu(messageText string, chatId ChatId, timeKeepers *map[ChatId]*TimeKeeper) (result MenuProcessorResult, err error) {
+// startFocus starts a focus session unless a timer is already running.
+// With more than one cycle breaks and focus sessions alternate until all
+// cycles are done.
+func startFocus(chatId ChatId, durationMins int, tag string, cycles int, env *environment) MenuProcessorResult {
+	tk, ok := env.timeKeepers.get(chatId)
+	if ok {
+		return activeTimerResult(tk)
+	}
+
+	replyText := fmt.Sprintf("Focus started! I will keep you focused for %v minutes", durationMins)
+	if tag != "" {
+		env.users.rememberTag(chatId, tag)
+		replyText += " on " + formatTag(tag)
+	}
+	cycle := focusCycle{}
+	if cycles > 1 {
+		cycle = focusCycle{CyclesLeft: cycles - 1, Tag: tag}
+		replyText += fmt.Sprintf(", cycle 1 of %v", cycles)
+	}
+	env.startSession(chatId, SESSION_KIND_FOCUS, durationMins, tag, "The focus session ended, you can rest now!", cycle)
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateFocusKeyboard(),
+		replyText:     replyText,
+		userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
+	}
+}
+
+// activeTimerResult answers an attempt to start a timer while another one
+// runs with the menu of the running one, so a break is never handled as a
+// focus or the other way round.
+func activeTimerResult(tk *TimeKeeper) MenuProcessorResult {
+	if tk.kind == SESSION_KIND_BREAK {
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_BREAK, TTEXT_STOP_BREAK),
+			replyText:     "Oops, looks like you already have an active break!",
+			userAction:    UserAction{CurrentMenu: MENU_INBREAK},
+		}
+	}
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateFocusKeyboard(),
+		replyText:     "Oops, looks like you already have an active focus!",
+		userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
+	}
+}
+
+func generateChooseTagResult(user User, replyText string) MenuProcessorResult {
+	options := make([]string, 0, len(user.Tags)+2)
+	for _, tag := range user.Tags {
+		options = append(options, formatTag(tag))
+	}
+	options = append(options, TTEXT_NO_TAG, TTEXT_BACK)
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(options...),
+		replyText:     replyText + " Pick a recent tag or type a new one like #backend",
+		userAction:    UserAction{CurrentMenu: MENU_CHOOSE_TAG},
+	}
+}
+
+func processChooseTagMenu(messageText string, user User, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	switch messageText {
+	case TTEXT_NO_TAG:
+		result = startFocus(chatId, user.FocusDurationMins, "", 1, env)
+	case TTEXT_BACK:
+		result = MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateMainKeyboard(),
+			replyText:     "Back to main menu",
+			userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+		}
+	default:
+		tag, ok := parseTag(messageText)
+		if !ok {
+			return generateChooseTagResult(user, "Sorry, that doesn't look like a tag."), nil
+		}
+		result = startFocus(chatId, user.FocusDurationMins, tag, 1, env)
+	}
+	return
+}
+
+func processInFocusMenu(messageText string, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	if tk, ok := env.timeKeepers.get(chatId); ok && tk.kind != SESSION_KIND_FOCUS {
+		return activeTimerResult(tk), nil
+	}
 	switch messageText {
 	case TTEXT_STOP_FOCUS:
-		tk, ok := (*timeKeepers)[chatId]
+		tk, ok := env.timeKeepers.get(chatId)
 		if !ok {
 			return MenuProcessorResult{
 				responseType:  RESPONSE_TYPE_KEYBOARD,
-				replyKeyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_FOCUS, TTEXT_STOP_FOCUS),
+				replyKeyboard: GenerateFocusKeyboard(),
 				replyText:     "Oops, looks like you don't have an active focus!",
 				userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
 			}, nil
 		} else {
 			ok = tk.stopTimeKeep()
 			if !ok {
-				log.Printf("Failed to stop timekeeper for chat id - [%v]", chatId)
 				return MenuProcessorResult{
 					responseType: RESPONSE_TYPE_NONE,
-				}, nil
+				}, fmt.Errorf("failed to stop timekeeper for chat id - [%v]", chatId)
 			} else {
-				delete(*timeKeepers, chatId)
-				result = MenuProcessorResult{
-					responseType:  RESPONSE_TYPE_KEYBOARD,
-					replyKeyboard: GenerateMainKeyboard(),
-					replyText:     "Focus stopped",
-					userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+				env.finishSession(chatId, tk, SESSION_STATUS_CANCELLED)
+				sessionEvents.inc(SESSION_KIND_FOCUS, "cancelled")
+				replyText := "Focus stopped. What made you stop early?"
+				if user, ok := env.users.data[chatId]; ok {
+					if congrats := env.goalReachedText(chatId, user, tk.sessionId); congrats != "" {
+						replyText = "Focus stopped. " + congrats + "\n\nWhat made you stop early?"
+					}
 				}
+				result = generateStopReasonResult(tk.sessionId, replyText)
 			}
 		}
+	case TTEXT_INTERRUPTED:
+		tk, ok := env.timeKeepers.get(chatId)
+		if !ok {
+			return MenuProcessorResult{
+				responseType:  RESPONSE_TYPE_KEYBOARD,
+				replyKeyboard: GenerateFocusKeyboard(),
+				replyText:     "Oops, looks like you don't have an active focus!",
+				userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
+			}, nil
+		}
+		result = generateInterruptionKindResult(tk.sessionId, "What interrupted you? The focus keeps going")
 	case TTEXT_TIME_LEFT_FOCUS:
-		tk, ok := (*timeKeepers)[chatId]
+		tk, ok := env.timeKeepers.get(chatId)
 		if !ok {
 			return MenuProcessorResult{
 				responseType:  RESPONSE_TYPE_KEYBOARD,
-				replyKeyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_FOCUS, TTEXT_STOP_FOCUS),
+				replyKeyboard: GenerateFocusKeyboard(),
 				replyText:     "Oops, looks like you don't have an active focus!",
 				userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
 			}, nil
 		} else {
 			result = MenuProcessorResult{
 				responseType:  RESPONSE_TYPE_KEYBOARD,
-				replyKeyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_FOCUS, TTEXT_STOP_FOCUS),
+				replyKeyboard: GenerateFocusKeyboard(),
 				replyText:     fmt.Sprintf("You have %v to go", generateTimeLeftString(tk)),
 				userAction:    UserAction{CurrentMenu: MENU_INFOCUS},
 			}
@@ -159,10 +327,13 @@ func processInFocusMenu(messageText string, chatId ChatId, timeKeepers *map[Chat
 	return
 }
 
-func processInBreakMenu(messageText string, chatId ChatId, timeKeepers *map[ChatId]*TimeKeeper) (result MenuProcessorResult, err error) {
+func processInBreakMenu(messageText string, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	if tk, ok := env.timeKeepers.get(chatId); ok && tk.kind != SESSION_KIND_BREAK {
+		return activeTimerResult(tk), nil
+	}
 	switch messageText {
 	case TTEXT_STOP_BREAK:
-		tk, ok := (*timeKeepers)[chatId]
+		tk, ok := env.timeKeepers.get(chatId)
 		if !ok {
 			return MenuProcessorResult{
 				responseType:  RESPONSE_TYPE_KEYBOARD,
@@ -173,12 +344,12 @@ func processInBreakMenu(messageText string, chatId ChatId, timeKeepers *map[Chat
 		} else {
 			ok = tk.stopTimeKeep()
 			if !ok {
-				log.Printf("Failed to stop timekeeper for chat id - [%v]", chatId)
 				return MenuProcessorResult{
 					responseType: RESPONSE_TYPE_NONE,
-				}, nil
+				}, fmt.Errorf("failed to stop timekeeper for chat id - [%v]", chatId)
 			} else {
-				delete(*timeKeepers, chatId)
+				env.finishSession(chatId, tk, SESSION_STATUS_CANCELLED)
+				sessionEvents.inc(SESSION_KIND_BREAK, "cancelled")
 				result = MenuProcessorResult{
 					responseType:  RESPONSE_TYPE_KEYBOARD,
 					replyKeyboard: GenerateMainKeyboard(),
@@ -188,7 +359,7 @@ func processInBreakMenu(messageText string, chatId ChatId, timeKeepers *map[Chat
 			}
 		}
 	case TTEXT_TIME_LEFT_BREAK:
-		tk, ok := (*timeKeepers)[chatId]
+		tk, ok := env.timeKeepers.get(chatId)
 		if !ok {
 			return MenuProcessorResult{
 				responseType:  RESPONSE_TYPE_KEYBOARD,
@@ -209,17 +380,38 @@ func processInBreakMenu(messageText string, chatId ChatId, timeKeepers *map[Chat
 }
 
 func generateTimeLeftString(tk *TimeKeeper) string {
-	if tk.secondsLeft > 0 && tk.secondsLeft%60 == 0 {
-		return fmt.Sprintf("<b>%v minutes</b>", tk.secondsLeft/60)
-	} else if tk.secondsLeft/60 == 0 {
-		return fmt.Sprintf("<b>%v seconds</b>", tk.secondsLeft)
+	secondsLeft := tk.remainingSeconds()
+	if secondsLeft > 0 && secondsLeft%60 == 0 {
+		return fmt.Sprintf("<b>%v minutes</b>", secondsLeft/60)
+	} else if secondsLeft/60 == 0 {
+		return fmt.Sprintf("<b>%v seconds</b>", secondsLeft)
 	} else {
-		return fmt.Sprintf("<b>%v minutes and %v seconds</b>", tk.secondsLeft/60, tk.secondsLeft%60)
+		return fmt.Sprintf("<b>%v minutes and %v seconds</b>", secondsLeft/60, secondsLeft%60)
 	}
 }
 
-func processSettingsMenu(messageText string, user User) (result MenuProcessorResult, err error) {
+func processSettingsMenu(messageText string, chatId ChatId, user User, env *environment) (result MenuProcessorResult, err error) {
 	switch messageText {
+	case TTEXT_REFLECTION:
+		user.SkipReflection = !user.SkipReflection
+		err = env.users.updateUser(chatId, user)
+		if err != nil {
+			return MenuProcessorResult{}, err
+		}
+		state := "on"
+		if user.SkipReflection {
+			state = "off"
+		}
+		result = MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateSettingsKeyboard(),
+			replyText:     fmt.Sprintf("Questions about what you got done after a focus session are now %v", state),
+			userAction:    UserAction{CurrentMenu: MENU_SETTINGS},
+		}
+	case TTEXT_QUIET_HOURS:
+		result = generateQuietHoursResult(user, quietHoursText(user))
+	case TTEXT_NUDGES:
+		result = generateNudgesResult(user, nudgesText(user))
 	case TTEXT_FOCUS_DURATION:
 		result = MenuProcessorResult{
 			responseType:  RESPONSE_TYPE_KEYBOARD,
@@ -241,6 +433,9 @@ func processSettingsMenu(messageText string, user User) (result MenuProcessorRes
 			replyText:     "Back to main menu",
 			userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
 		}
+		if progress := env.goalProgressLine(chatId, user); progress != "" {
+			result.replyText += "\n" + progress
+		}
 	}
 	return
 }
@@ -283,7 +478,7 @@ func processSettingsFocusDurationMenu(messageText string, chatId ChatId, user Us
 	case TTEXT_BACK:
 		result = MenuProcessorResult{
 			responseType:  RESPONSE_TYPE_KEYBOARD,
-			replyKeyboard: GenerateCustomKeyboard(TTEXT_FOCUS_DURATION, TTEXT_BREAK_DURATION, TTEXT_MAIN_MENU),
+			replyKeyboard: GenerateSettingsKeyboard(),
 			replyText:     "Going back to the settings menu",
 			userAction:    UserAction{CurrentMenu: MENU_SETTINGS},
 		}
@@ -325,7 +520,7 @@ func processSettingsBreakDurationMenu(messageText string, chatId ChatId, user Us
 	case TTEXT_BACK:
 		result = MenuProcessorResult{
 			responseType:  RESPONSE_TYPE_KEYBOARD,
-			replyKeyboard: GenerateCustomKeyboard(TTEXT_FOCUS_DURATION, TTEXT_BREAK_DURATION, TTEXT_MAIN_MENU),
+			replyKeyboard: GenerateSettingsKeyboard(),
 			replyText:     "Going back to the settings menu",
 			userAction:    UserAction{CurrentMenu: MENU_SETTINGS},
 		}
@@ -382,3 +577,45 @@ func processInitBreakMenu(messageText string, id ChatId, user User, users *Users
 	}
 	return
 }
+
+func processConfirmDeleteMenu(messageText string, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	switch messageText {
+	case TTEXT_CONFIRM_DELETE:
+		result = MenuProcessorResult{
+			responseType: RESPONSE_TYPE_REMOVE_KEYBOARD,
+			replyText: fmt.Sprintf("Done, I have deleted everything I knew about you. Type %v if you want to use me again",
+				TTEXT_START_COMMAND),
+			forgetUser: true,
+		}
+	case TTEXT_CANCEL:
+		result = MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateMainKeyboard(),
+			replyText:     "Nothing was deleted",
+			userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+		}
+		// a running timer keeps its menu
+		if tk, ok := env.timeKeepers.get(chatId); ok {
+			if tk.kind == SESSION_KIND_FOCUS {
+				result.replyKeyboard = GenerateFocusKeyboard()
+				result.userAction = UserAction{CurrentMenu: MENU_INFOCUS}
+			} else {
+				result.replyKeyboard = GenerateCustomKeyboard(TTEXT_TIME_LEFT_BREAK, TTEXT_STOP_BREAK)
+				result.userAction = UserAction{CurrentMenu: MENU_INBREAK}
+			}
+		}
+	default:
+		result = generateConfirmDeleteResult()
+	}
+	return
+}
+
+func generateConfirmDeleteResult() MenuProcessorResult {
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(TTEXT_CONFIRM_DELETE, TTEXT_CANCEL),
+		replyText: "This will delete your settings, running timer and the whole session history. " +
+			"It can't be undone, you can save a copy with " + TTEXT_EXPORT_COMMAND + " first. Are you sure?",
+		userAction: UserAction{CurrentMenu: MENU_CONFIRM_DELETE},
+	}
+}
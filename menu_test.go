@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFocusDuringBreakKeepsBreakMenu(t *testing.T) {
+	const chatId ChatId = 1
+	env, _ := newTestEnvironment(t, chatId)
+	breakKeyboard := GenerateCustomKeyboard(TTEXT_TIME_LEFT_BREAK, TTEXT_STOP_BREAK)
+
+	result, err := processMainMenu(TTEXT_START_BREAK, env.users.data[chatId], chatId, env)
+	if err != nil {
+		t.Fatalf("start break: %v", err)
+	}
+	if result.userAction.CurrentMenu != MENU_INBREAK {
+		t.Fatalf("expected the break menu after starting a break, got %v", getMenuName(result.userAction.CurrentMenu))
+	}
+
+	result = startFocus(chatId, 25, "", 1, env)
+	if result.userAction.CurrentMenu != MENU_INBREAK || !reflect.DeepEqual(result.replyKeyboard, breakKeyboard) {
+		t.Fatalf("focus during a break shows %v with %v", getMenuName(result.userAction.CurrentMenu), result.replyKeyboard)
+	}
+
+	// a user left in the focus menu can't stop the break as a focus
+	result, err = processInFocusMenu(TTEXT_STOP_FOCUS, chatId, env)
+	if err != nil {
+		t.Fatalf("stop focus: %v", err)
+	}
+	if result.userAction.CurrentMenu != MENU_INBREAK || !reflect.DeepEqual(result.replyKeyboard, breakKeyboard) {
+		t.Fatalf("stop focus during a break shows %v with %v", getMenuName(result.userAction.CurrentMenu), result.replyKeyboard)
+	}
+	tk, ok := env.timeKeepers.get(chatId)
+	if !ok || tk.kind != SESSION_KIND_BREAK {
+		t.Fatalf("the break is not running anymore")
+	}
+
+	result, err = processInBreakMenu(TTEXT_STOP_BREAK, chatId, env)
+	if err != nil {
+		t.Fatalf("stop break: %v", err)
+	}
+	if result.userAction.CurrentMenu != MENU_MAIN_MENU {
+		t.Fatalf("expected the main menu after stopping the break, got %v", getMenuName(result.userAction.CurrentMenu))
+	}
+	sessions, err := env.db.getSessions(chatId, testDay.AddDate(-1, 0, 0), testDay.AddDate(10, 0, 0))
+	if err != nil {
+		t.Fatalf("get sessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Kind != SESSION_KIND_BREAK || sessions[0].Status != SESSION_STATUS_CANCELLED {
+		t.Fatalf("expected a single cancelled break, got %+v", sessions)
+	}
+}
+
+func TestStartBreakDuringFocusReplies(t *testing.T) {
+	const chatId ChatId = 1
+	env, messenger := newTestEnvironment(t, chatId)
+	startFocus(chatId, 25, "", 1, env)
+	// the focus was started elsewhere, e.g. by a schedule, and the user is
+	// still looking at the main menu
+	env.users.saveLastUserAction(chatId, UserAction{CurrentMenu: MENU_MAIN_MENU})
+
+	env.processMessage(IncomingMessage{UpdateId: "1", ChatId: chatId, From: Sender{Id: int64(chatId), FirstName: "Ann"}, Text: TTEXT_START_BREAK})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := env.queue.flush(ctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(messenger.messages) != 1 || messenger.messages[0].Text != "Oops, looks like you already have an active focus!" ||
+		!reflect.DeepEqual(messenger.messages[0].Keyboard, GenerateFocusKeyboard()) {
+		t.Fatalf("unexpected reply to start break during focus: %+v", messenger.messages)
+	}
+	if menu := env.users.data[chatId].LastAction.CurrentMenu; menu != MENU_INFOCUS {
+		t.Fatalf("expected the focus menu, got %v", getMenuName(menu))
+	}
+	tk, ok := env.timeKeepers.get(chatId)
+	if !ok || tk.kind != SESSION_KIND_FOCUS {
+		t.Fatalf("the focus is not running anymore")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	MESSENGER_TELEGRAM = "telegram"
+	MESSENGER_DISCORD  = "discord"
+	// MESSENGER_CONSOLE is used by the repl command only
+	MESSENGER_CONSOLE = "console"
+)
+
+// Formats of the text of an outgoing message, every messenger renders
+// the few HTML tags the bot uses in its own way.
+const (
+	FORMAT_PLAIN = ""
+	FORMAT_HTML  = "html"
+)
+
+const (
+	FILE_KIND_PHOTO    = "photo"
+	FILE_KIND_DOCUMENT = "document"
+)
+
+// Keyboard is a reply keyboard, a list of rows of button texts. Pressing a
+// button sends its text back as if the user typed it.
+type Keyboard [][]string
+
+// InlineButton is attached to a message, pressing it sends Data back as a
+// ButtonPress.
+type InlineButton struct {
+	Text string
+	Data string
+}
+
+// OutgoingMessage is a message in terms every messenger understands.
+type OutgoingMessage struct {
+	ChatId   ChatId
+	Text     string
+	Format   string
+	Keyboard Keyboard
+	// RemoveKeyboard hides the reply keyboard of an earlier message
+	RemoveKeyboard bool
+	Buttons        []InlineButton
+	// Silent delivers the message without a sound
+	Silent bool
+}
+
+// Sender is the user who sent a message or pressed a button. In private
+// chats the id of the user is also the id of the chat.
+type Sender struct {
+	Id        int64
+	FirstName string
+}
+
+// IncomingMessage is a text sent to the bot, commands included.
+type IncomingMessage struct {
+	// UpdateId correlates the log lines of one update
+	UpdateId string
+	ChatId   ChatId
+	Group    bool
+	From     Sender
+	Text     string
+}
+
+// ButtonPress is a press of an inline button.
+type ButtonPress struct {
+	// Id is what the messenger needs to answer the press
+	Id       string
+	UpdateId string
+	ChatId   ChatId
+	// MessageId is the message the button is attached to
+	MessageId string
+	From      Sender
+	Data      string
+}
+
+// updateHandler receives what users send, whichever messenger they use.
+type updateHandler interface {
+	processMessage(msg IncomingMessage)
+	processButtonPress(press ButtonPress)
+}
+
+// Messenger connects the bot to a chat platform. The request methods
+// encode what to send once, the queue paces the requests and hands them
+// back to send, retrying failures reported as *apiError.
+type Messenger interface {
+	name() string
+	start(handler updateHandler) error
+	// stop returns once no more updates are delivered to the handler
+	stop(ctx context.Context) error
+	health() (string, healthComponent)
+	messageRequest(msg OutgoingMessage) (*outgoingRequest, error)
+	editRequest(messageId string, msg OutgoingMessage) (*outgoingRequest, error)
+	fileRequest(chatId ChatId, kind string, fileName string, content []byte, caption string) (*outgoingRequest, error)
+	answerRequest(press ButtonPress, text string) (*outgoingRequest, error)
+	send(req *outgoingRequest) error
+}
+
+// newMessenger picks the messenger the config asks for.
+func newMessenger(cfg Config, webhookAction string) Messenger {
+	switch cfg.Messenger {
+	case MESSENGER_TELEGRAM:
+		return newTelegramMessenger(cfg, webhookAction)
+	case MESSENGER_DISCORD:
+		return newDiscordMessenger(cfg)
+	}
+	logger.fatal("unknown messenger", "messenger", cfg.Messenger)
+	return nil
+}
+
+// sendMessage queues the message for delivery, interactive replies use
+// PRIORITY_INTERACTIVE so they overtake broadcasts waiting in the queue.
+func (env *environment) sendMessage(priority int, msg OutgoingMessage) {
+	req, err := env.messenger.messageRequest(msg)
+	if err != nil {
+		logger.error("failed to encode message", "chat_id", msg.ChatId, "err", err)
+		return
+	}
+	env.enqueueRequest(msg.ChatId, priority, req)
+}
+
+// editMessage replaces the text and the buttons of a message sent before.
+func (env *environment) editMessage(priority int, messageId string, msg OutgoingMessage) {
+	req, err := env.messenger.editRequest(messageId, msg)
+	if err != nil {
+		logger.error("failed to encode message edit", "chat_id", msg.ChatId, "err", err)
+		return
+	}
+	env.enqueueRequest(msg.ChatId, priority, req)
+}
+
+// answerButtonPress confirms the press to the user, the text is shown to
+// them only.
+func (env *environment) answerButtonPress(press ButtonPress, text string) {
+	req, err := env.messenger.answerRequest(press, text)
+	if err != nil {
+		logger.error("failed to encode button answer", "user_id", press.From.Id, "err", err)
+		return
+	}
+	// the answer goes to the member only, so it is paced like their
+	// private chat and leaves the group's rate to announcements
+	env.enqueueRequest(ChatId(press.From.Id), PRIORITY_INTERACTIVE, req)
+}
+
+// sendDocument queues a file upload.
+func (env *environment) sendDocument(chatId ChatId, priority int, fileName string, content []byte, caption string) error {
+	return env.sendFile(chatId, priority, FILE_KIND_DOCUMENT, fileName, content, caption)
+}
+
+// sendPhoto queues an image upload, messengers show it inline.
+func (env *environment) sendPhoto(chatId ChatId, priority int, fileName string, content []byte, caption string) error {
+	return env.sendFile(chatId, priority, FILE_KIND_PHOTO, fileName, content, caption)
+}
+
+// sendFile encodes the upload once, so retries send exactly the same
+// request.
+func (env *environment) sendFile(chatId ChatId, priority int, kind string, fileName string, content []byte, caption string) error {
+	req, err := env.messenger.fileRequest(chatId, kind, fileName, content, caption)
+	if err != nil {
+		return err
+	}
+	req.chatId = chatId
+	req.priority = priority
+	req.enqueuedAt = time.Now()
+	return env.queue.enqueue(req)
+}
+
+func (env *environment) enqueueRequest(chatId ChatId, priority int, req *outgoingRequest) {
+	req.chatId = chatId
+	req.priority = priority
+	req.enqueuedAt = time.Now()
+	err := env.queue.enqueue(req)
+	if err != nil {
+		logger.error("failed to queue request", "chat_id", chatId, "method", req.method, "err", err)
+	}
+}
+
+// messageType classifies incoming messages for metrics.
+func messageType(text string) string {
+	switch {
+	case strings.HasPrefix(text, "/"):
+		return "command"
+	case text != "":
+		return "text"
+	default:
+		return "other"
+	}
+}
+
+// jsonRequest encodes the payload of a request as JSON.
+func jsonRequest(method string, payload interface{}) (*outgoingRequest, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &outgoingRequest{
+		method:      method,
+		contentType: "application/json; charset=UTF-8",
+		body:        body,
+	}, nil
+}
+
+func (env *environment) sendQueuedRequest(req *outgoingRequest) error {
+	return env.messenger.send(req)
+}
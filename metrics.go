@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tiny Prometheus registry, the text exposition format is simple enough
+// that pulling the whole client library in is not worth it.
+
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type labeledValues struct {
+	mut    sync.Mutex
+	labels []string
+	values map[string][]string
+}
+
+func (l *labeledValues) key(labelValues []string) string {
+	if len(labelValues) != len(l.labels) {
+		panic(fmt.Sprintf("expected %v label values, got %v", len(l.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := l.values[key]; !ok {
+		l.values[key] = append([]string(nil), labelValues...)
+	}
+	return key
+}
+
+func (l *labeledValues) sortedKeys() []string {
+	keys := make([]string, 0, len(l.values))
+	for key := range l.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (l *labeledValues) format(key string, extra ...string) string {
+	pairs := make([]string, 0, len(l.labels)+1)
+	for i, name := range l.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, l.values[key][i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	labeledValues
+	name    string
+	help    string
+	counter map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		labeledValues: labeledValues{labels: labels, values: map[string][]string{}},
+		name:          name,
+		help:          help,
+		counter:       map[string]float64{},
+	}
+	metricsRegistry.register(c)
+	return c
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(value float64, labelValues ...string) {
+	c.mut.Lock()
+	c.counter[c.key(labelValues)] += value
+	c.mut.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, c.format(key), formatFloat(c.counter[key]))
+	}
+}
+
+type gaugeVec struct {
+	labeledValues
+	name  string
+	help  string
+	gauge map[string]float64
+}
+
+func newGaugeVec(name string, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{
+		labeledValues: labeledValues{labels: labels, values: map[string][]string{}},
+		name:          name,
+		help:          help,
+		gauge:         map[string]float64{},
+	}
+	metricsRegistry.register(g)
+	return g
+}
+
+func (g *gaugeVec) set(value float64, labelValues ...string) {
+	g.mut.Lock()
+	g.gauge[g.key(labelValues)] = value
+	g.mut.Unlock()
+}
+
+func (g *gaugeVec) add(value float64, labelValues ...string) {
+	g.mut.Lock()
+	g.gauge[g.key(labelValues)] += value
+	g.mut.Unlock()
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %v\n", g.name, g.format(key), formatFloat(g.gauge[key]))
+	}
+}
+
+type histogramData struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	labeledValues
+	name    string
+	help    string
+	buckets []float64
+	data    map[string]*histogramData
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		labeledValues: labeledValues{labels: labels, values: map[string][]string{}},
+		name:          name,
+		help:          help,
+		buckets:       buckets,
+		data:          map[string]*histogramData{},
+	}
+	metricsRegistry.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	key := h.key(labelValues)
+	data, ok := h.data[key]
+	if !ok {
+		data = &histogramData{counts: make([]uint64, len(h.buckets))}
+		h.data[key] = data
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			data.counts[i]++
+		}
+	}
+	data.count++
+	data.sum += value
+}
+
+func (h *histogramVec) observeSince(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range h.sortedKeys() {
+		data := h.data[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %v\n", h.name, h.format(key, "le", formatFloat(bound)), data.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %v\n", h.name, h.format(key, "le", "+Inf"), data.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, h.format(key), formatFloat(data.sum))
+		fmt.Fprintf(w, "%s_count%s %v\n", h.name, h.format(key), data.count)
+	}
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type registry struct {
+	mut       sync.Mutex
+	metrics   []metric
+	onScrapes []func()
+}
+
+var metricsRegistry = &registry{}
+
+func (r *registry) register(m metric) {
+	r.mut.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mut.Unlock()
+}
+
+// onScrape registers a callback that refreshes gauges right before they
+// are written out.
+func (r *registry) onScrape(callback func()) {
+	r.mut.Lock()
+	r.onScrapes = append(r.onScrapes, callback)
+	r.mut.Unlock()
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mut.Lock()
+	callbacks := append([]func(){}, r.onScrapes...)
+	metrics := append([]metric{}, r.metrics...)
+	r.mut.Unlock()
+
+	for _, callback := range callbacks {
+		callback()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+var (
+	updatesReceived = newCounterVec("horae_updates_received_total",
+		"Updates received from the messenger by type.", "type")
+	menuTransitions = newCounterVec("horae_menu_transitions_total",
+		"User transitions between menus.", "from", "to")
+	sessionEvents = newCounterVec("horae_sessions_total",
+		"Focus and break sessions by kind and event.", "kind", "event")
+	scheduleRuns = newCounterVec("horae_schedule_runs_total",
+		"Schedules that came due by mode.", "mode")
+	nudgesSent = newCounterVec("horae_nudges_sent_total",
+		"Reminders sent to idle users.")
+	partnersCreated = newCounterVec("horae_partnerships_created_total",
+		"Accountability partnerships created from invites.")
+	telegramCalls = newCounterVec("horae_telegram_api_calls_total",
+		"Telegram Bot API calls by method and response status.", "method", "status")
+	telegramCallDuration = newHistogramVec("horae_telegram_api_call_duration_seconds",
+		"Latency of Telegram Bot API calls.", defaultLatencyBuckets, "method")
+	discordCalls = newCounterVec("horae_discord_api_calls_total",
+		"Discord API calls by method and response status.", "method", "status")
+	discordCallDuration = newHistogramVec("horae_discord_api_call_duration_seconds",
+		"Latency of Discord API calls.", defaultLatencyBuckets, "method")
+	messageDeliveryDuration = newHistogramVec("horae_message_delivery_duration_seconds",
+		"Time from queueing an outgoing message until it is delivered.", defaultLatencyBuckets, "priority")
+	activeTimers = newGaugeVec("horae_active_timers",
+		"Currently running focus and break timers.", "kind")
+	messageQueueDepth = newGaugeVec("horae_message_queue_depth",
+		"Outgoing messages waiting in the queue.", "priority")
+	dbTransactionDuration = newHistogramVec("horae_db_transaction_duration_seconds",
+		"Duration of storage transactions.", defaultLatencyBuckets, "operation")
+)
+
+var priorityNames = [PRIORITY_COUNT]string{
+	PRIORITY_INTERACTIVE: "interactive",
+	PRIORITY_BROADCAST:   "broadcast",
+}
+
+// observeTelegramCall records a single Bot API call, err and resp follow
+// the http.Client.Do contract.
+func observeTelegramCall(method string, start time.Time, resp *http.Response, err error) {
+	observeApiCall(telegramCalls, telegramCallDuration, method, start, resp, err)
+}
+
+func observeDiscordCall(method string, start time.Time, resp *http.Response, err error) {
+	observeApiCall(discordCalls, discordCallDuration, method, start, resp, err)
+}
+
+func observeApiCall(calls *counterVec, duration *histogramVec, method string, start time.Time, resp *http.Response, err error) {
+	status := "error"
+	if err == nil && resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	calls.inc(method, status)
+	duration.observeSince(start, method)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	metaBucketName    = "meta"
+	optOutsBucketName = "leaderboard_opt_outs"
+	schemaVersionKey  = "schema_version"
+)
+
+var errMigrationDryRun = errors.New("dry run, migrations rolled back")
+
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *bbolt.Tx) error
+}
+
+// migrations are applied in order, append new ones to the end and never
+// change a migration that has already been released.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create users bucket",
+		apply:       createBuckets("users"),
+	},
+	{
+		version:     2,
+		description: "create timers bucket for timekeepers persisted on shutdown",
+		apply:       createBuckets("timers"),
+	},
+	{
+		version:     3,
+		description: "create sessions bucket for the session history",
+		apply:       createBuckets("sessions"),
+	},
+	{
+		version:     4,
+		description: "create partners bucket for accountability partnerships",
+		apply:       createBuckets("partners"),
+	},
+	{
+		version:     5,
+		description: "create deferred bucket for messages held back for quiet hours",
+		apply:       createBuckets("deferred"),
+	},
+	{
+		version:     6,
+		description: "move leaderboard opt-outs from meta keys into their own bucket",
+		apply:       moveLeaderboardOptOuts,
+	},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func createBuckets(bucketNames ...string) func(tx *bbolt.Tx) error {
+	return func(tx *bbolt.Tx) error {
+		for _, bucketName := range bucketNames {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+			if err != nil {
+				return fmt.Errorf("create bucket [%v]: %s", bucketName, err)
+			}
+		}
+		return nil
+	}
+}
+
+// moveLeaderboardOptOuts turns the JSON lists of user ids kept under a meta
+// key per group into one key per group and member.
+func moveLeaderboardOptOuts(tx *bbolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(optOutsBucketName))
+	if err != nil {
+		return fmt.Errorf("create bucket [%v]: %s", optOutsBucketName, err)
+	}
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	const prefix = "leaderboard_opt_out_"
+	keys := make([][]byte, 0)
+	err = meta.ForEach(func(k, v []byte) error {
+		if !strings.HasPrefix(string(k), prefix) {
+			return nil
+		}
+		groupId, err := strconv.ParseInt(strings.TrimPrefix(string(k), prefix), 10, 64)
+		if err != nil {
+			return fmt.Errorf("parse group id of [%v]: %s", string(k), err)
+		}
+		var userIds []int64
+		err = json.Unmarshal(v, &userIds)
+		if err != nil {
+			return fmt.Errorf("unmarshal leaderboard opt-outs: %s", err)
+		}
+		for _, userId := range userIds {
+			err = b.Put(optOutKey(ChatId(groupId), userId), []byte{})
+			if err != nil {
+				return fmt.Errorf("save leaderboard opt-out: %s", err)
+			}
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = meta.Delete(k)
+		if err != nil {
+			return fmt.Errorf("delete meta key [%v]: %s", string(k), err)
+		}
+	}
+	return nil
+}
+
+// readSchemaVersion returns 0 for databases created before versioning.
+func readSchemaVersion(tx *bbolt.Tx) int {
+	b := tx.Bucket([]byte(metaBucketName))
+	if b == nil {
+		return 0
+	}
+	value := b.Get([]byte(schemaVersionKey))
+	if len(value) != 8 {
+		return 0
+	}
+	return int(btoi(value))
+}
+
+func writeSchemaVersion(tx *bbolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return fmt.Errorf("create meta bucket: %s", err)
+	}
+	return b.Put([]byte(schemaVersionKey), itob(int64(version)))
+}
+
+// isEmptyDatabase tells a freshly created file from an old one without a
+// schema version, a new file has no buckets at all.
+func isEmptyDatabase(tx *bbolt.Tx) bool {
+	empty := true
+	tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+		empty = false
+		return nil
+	})
+	return empty
+}
+
+func (db *hDataBase) schemaVersion() (version int, err error) {
+	err = db.view("schema_version", func(tx *bbolt.Tx) error {
+		version = readSchemaVersion(tx)
+		return nil
+	})
+	return
+}
+
+func (db *hDataBase) isEmpty() (empty bool, err error) {
+	err = db.view("is_empty", func(tx *bbolt.Tx) error {
+		empty = isEmptyDatabase(tx)
+		return nil
+	})
+	return
+}
+
+// migrate brings the database to the latest schema version. All pending
+// migrations run in a single transaction, so either all of them are applied
+// or none. A copy of the database file is made before anything is changed,
+// unless the database is new and there is nothing to lose. In dry run mode
+// the migrations are executed and rolled back.
+func (db *hDataBase) migrate(dryRun bool) error {
+	current, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+	empty, err := db.isEmpty()
+	if err != nil {
+		return err
+	}
+	latest := latestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %v is newer than the latest known version %v", current, latest)
+	}
+	if current == latest {
+		logger.info("database schema is up to date", "schema_version", current)
+		return nil
+	}
+
+	if !dryRun && !empty {
+		backupPath := fmt.Sprintf("%v.v%v-%v.bak", db.db.Path(), current, time.Now().UTC().Format("20060102T150405"))
+		_, err = db.backupTo(backupPath)
+		if err != nil {
+			return fmt.Errorf("backup before migration: %s", err)
+		}
+		logger.info("database backed up before migration", "path", backupPath)
+	}
+
+	err = db.update("migrate", func(tx *bbolt.Tx) error {
+		for _, m := range migrations {
+			if m.version <= current {
+				continue
+			}
+			logger.info("applying migration", "schema_version", m.version, "description", m.description, "dry_run", dryRun)
+			err := m.apply(tx)
+			if err != nil {
+				return fmt.Errorf("migration %v [%v]: %s", m.version, m.description, err)
+			}
+			err = writeSchemaVersion(tx, m.version)
+			if err != nil {
+				return err
+			}
+		}
+		if dryRun {
+			return errMigrationDryRun
+		}
+		return nil
+	})
+	if dryRun && errors.Is(err, errMigrationDryRun) {
+		logger.info("migration dry run succeeded", "from", current, "to", latest)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger.info("database migrated", "from", current, "to", latest)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestMoveLeaderboardOptOuts(t *testing.T) {
+	db := &hDataBase{path: filepath.Join(t.TempDir(), "horae.db")}
+	db.initDB()
+	defer db.closeDB()
+	// go back to the schema with the opt-outs in meta
+	err := db.update("downgrade", func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte(optOutsBucketName))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(metaBucketName)).Put([]byte("leaderboard_opt_out_-100"), []byte("[1,2]"))
+		if err != nil {
+			return err
+		}
+		return writeSchemaVersion(tx, 5)
+	})
+	if err != nil {
+		t.Fatalf("downgrade: %v", err)
+	}
+
+	err = db.migrate(false)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	optOuts, err := db.getLeaderboardOptOuts(-100)
+	if err != nil || len(optOuts) != 2 || !optOuts[1] || !optOuts[2] {
+		t.Fatalf("unexpected opt-outs %v, err %v", optOuts, err)
+	}
+	value, err := db.getMeta("leaderboard_opt_out_-100")
+	if err != nil || value != "" {
+		t.Fatalf("meta key is left behind: %q, err %v", value, err)
+	}
+}
+
+func TestSqliteMoveLeaderboardOptOuts(t *testing.T) {
+	db, err := openSqliteStorage(filepath.Join(t.TempDir(), "horae.sqlite"))
+	if err != nil {
+		t.Fatalf("open sqlite storage: %v", err)
+	}
+	defer db.closeDB()
+	_, err = db.db.Exec("DROP TABLE leaderboard_opt_outs; PRAGMA user_version = 7;" +
+		"INSERT INTO meta (key, value) VALUES ('leaderboard_opt_out_-100', '[1,2]'), ('leaderboard_opt_outs', 'kept')")
+	if err != nil {
+		t.Fatalf("downgrade: %v", err)
+	}
+
+	err = db.migrate()
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	optOuts, err := db.getLeaderboardOptOuts(-100)
+	if err != nil || len(optOuts) != 2 || !optOuts[1] || !optOuts[2] {
+		t.Fatalf("unexpected opt-outs %v, err %v", optOuts, err)
+	}
+	value, err := db.getMeta("leaderboard_opt_out_-100")
+	if err != nil || value != "" {
+		t.Fatalf("meta key is left behind: %q, err %v", value, err)
+	}
+	value, err = db.getMeta("leaderboard_opt_outs")
+	if err != nil || value != "kept" {
+		t.Fatalf("unrelated meta key is changed: %q, err %v", value, err)
+	}
+}
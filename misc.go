@@ -1,5 +1,7 @@
 package main
 
+import "strings"
+
 //Find string in slice and return index
 func findStringInSlice(slice []string, str string) int {
 	for i, v := range slice {
@@ -8,4 +10,19 @@ func findStringInSlice(slice []string, str string) int {
 		}
 	}
 	return -1
-}
\ No newline at end of file
+}
+
+// splitCommand splits a bot command like "/export csv" into the command and
+// its arguments, the "@botname" suffix used in groups is dropped. Text that
+// is not a command gives an empty command.
+func splitCommand(text string) (string, []string) {
+	if !strings.HasPrefix(text, "/") {
+		return "", nil
+	}
+	fields := strings.Fields(text)
+	command := fields[0]
+	if i := strings.Index(command, "@"); i != -1 {
+		command = command[:i]
+	}
+	return command, fields[1:]
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	maxNudgesPerDay  = 3
+	defaultWorkStart = "09:00"
+	defaultWorkEnd   = "18:00"
+)
+
+// Idle times offered on the keyboard, in minutes.
+var nudgeIdleOptions = []int{60, 90, 120}
+
+// Nudges remind a user to focus after being idle during working hours.
+// They are off until the user picks an idle time.
+type Nudges struct {
+	IdleMins    int            `json:"idle_mins"`
+	WorkStart   string         `json:"work_start"`
+	WorkEnd     string         `json:"work_end"`
+	WorkDays    []time.Weekday `json:"work_days"`
+	LastNudgeAt time.Time      `json:"last_nudge_at,omitempty"`
+	// SentOn and Sent count the nudges of a day to keep to maxNudgesPerDay
+	SentOn string `json:"sent_on,omitempty"`
+	Sent   int    `json:"sent,omitempty"`
+}
+
+func (n Nudges) isOn() bool {
+	return n.IdleMins > 0
+}
+
+func (n Nudges) String() string {
+	if !n.isOn() {
+		return "off"
+	}
+	return fmt.Sprintf("%v %v - %v, after %v without focus", formatWeekdays(n.WorkDays), n.WorkStart, n.WorkEnd,
+		formatDuration(time.Duration(n.IdleMins)*time.Minute))
+}
+
+// workStartedAt returns when the working hours around now began, the zero
+// time outside of working hours.
+func (n Nudges) workStartedAt(now time.Time) time.Time {
+	start, _ := clockWindowAt(n.WorkStart, n.WorkEnd, now)
+	if start.IsZero() || !containsWeekday(n.WorkDays, start.Weekday()) {
+		return time.Time{}
+	}
+	return start
+}
+
+// nudgeDue tells whether the user idled long enough for a nudge at now,
+// lastFocusAt is when their latest focus session ended or will end.
+func nudgeDue(nudges Nudges, quiet QuietHours, lastFocusAt time.Time, now time.Time) bool {
+	if !nudges.isOn() || !quiet.endsAt(now).IsZero() {
+		return false
+	}
+	if nudges.SentOn == now.Format(dayLayout) && nudges.Sent >= maxNudgesPerDay {
+		return false
+	}
+	idleSince := nudges.workStartedAt(now)
+	if idleSince.IsZero() {
+		return false
+	}
+	for _, t := range []time.Time{lastFocusAt, nudges.LastNudgeAt} {
+		if t.After(idleSince) {
+			idleSince = t
+		}
+	}
+	return now.Sub(idleSince) >= time.Duration(nudges.IdleMins)*time.Minute
+}
+
+// recordNudge counts a sent nudge for the day of now.
+func (u *Users) recordNudge(chatId ChatId, now time.Time) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	user, ok := u.data[chatId]
+	if !ok {
+		return
+	}
+	day := now.Format(dayLayout)
+	if user.Nudges.SentOn != day {
+		user.Nudges.SentOn = day
+		user.Nudges.Sent = 0
+	}
+	user.Nudges.Sent++
+	user.Nudges.LastNudgeAt = now
+	u.data[chatId] = user
+}
+
+// recordFocus remembers when the latest focus session of the user ended,
+// or when it is planned to end while it runs, for the idle nudges.
+func (u *Users) recordFocus(chatId ChatId, endsAt time.Time) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	user, ok := u.data[chatId]
+	if !ok {
+		return
+	}
+	user.LastFocusAt = endsAt
+	u.data[chatId] = user
+}
+
+// sendDueNudges reminds idle users to focus. Users in the middle of a menu
+// flow or with a running timer are left alone.
+func (env *environment) sendDueNudges(now time.Time) {
+	candidates := make(map[ChatId]User)
+	env.users.mut.Lock()
+	for chatId, user := range env.users.data {
+		menu := user.LastAction.CurrentMenu
+		if user.Nudges.isOn() && (menu == MENU_MAIN_MENU || menu == MENU_NUDGE) {
+			candidates[chatId] = user
+		}
+	}
+	env.users.mut.Unlock()
+
+	for chatId, user := range candidates {
+		if _, running := env.timeKeepers.get(chatId); running {
+			continue
+		}
+		local := now.In(user.location())
+		if !nudgeDue(user.Nudges, user.QuietHours, user.LastFocusAt, local) {
+			continue
+		}
+
+		logger.info("nudging idle user", "chat_id", chatId)
+		nudgesSent.inc()
+		env.users.recordNudge(chatId, local)
+		env.users.saveLastUserAction(chatId, UserAction{CurrentMenu: MENU_NUDGE})
+		env.persistUser(chatId)
+		text := fmt.Sprintf("You haven't focused for a while. How about %v minutes now?", user.FocusDurationMins)
+		if tag := nudgeTag(user); tag != "" {
+			text = fmt.Sprintf("You haven't focused for a while. How about %v minutes on %v now?", user.FocusDurationMins, formatTag(tag))
+		}
+		env.notify(OutgoingMessage{
+			ChatId:   chatId,
+			Text:     text,
+			Format:   FORMAT_HTML,
+			Keyboard: GenerateCustomKeyboard(TTEXT_START_FOCUS, TTEXT_NOT_NOW, TTEXT_NUDGES_OFF),
+		})
+	}
+}
+
+// nudgeTag is the tag a focus started from a nudge gets, the one used
+// last.
+func nudgeTag(user User) string {
+	if len(user.Tags) == 0 {
+		return ""
+	}
+	return user.Tags[0]
+}
+
+func processNudgeMenu(messageText string, user User, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	switch messageText {
+	case TTEXT_START_FOCUS:
+		// the nudge already offered a focus, so it starts without asking for
+		// the tag
+		return startFocus(chatId, user.FocusDurationMins, nudgeTag(user), 1, env), nil
+	case TTEXT_NOT_NOW:
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateMainKeyboard(),
+			replyText:     "No problem, I'll check on you later",
+			userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+		}, nil
+	case TTEXT_NUDGES_OFF:
+		user.Nudges.IdleMins = 0
+		err = env.users.updateUser(chatId, user)
+		if err != nil {
+			return MenuProcessorResult{}, err
+		}
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateMainKeyboard(),
+			replyText:     "Reminders are off, you can turn them on again in the settings",
+			userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+		}, nil
+	}
+	return processMainMenu(messageText, user, chatId, env)
+}
+
+func generateNudgesResult(user User, replyText string) MenuProcessorResult {
+	options := make([]string, 0, len(nudgeIdleOptions)+3)
+	for _, mins := range nudgeIdleOptions {
+		options = append(options, fmt.Sprintf("%v%v", TTEXT_REMIND_AFTER, formatDuration(time.Duration(mins)*time.Minute)))
+	}
+	if user.Nudges.isOn() {
+		if len(user.Nudges.WorkDays) == 7 {
+			options = append(options, TTEXT_WORK_WEEKDAYS)
+		} else {
+			options = append(options, TTEXT_WORK_EVERY_DAY)
+		}
+		options = append(options, TTEXT_NUDGES_OFF)
+	}
+	options = append(options, TTEXT_BACK)
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(options...),
+		replyText:     replyText,
+		userAction:    UserAction{CurrentMenu: MENU_SETTINGS_NUDGES},
+	}
+}
+
+func nudgesText(user User) string {
+	if !user.Nudges.isOn() {
+		return "Reminders to focus are off. Pick how long to wait before I remind you"
+	}
+	return fmt.Sprintf("Reminders to focus: %v, at most %v a day. Type other working hours like 08:30-17:00, times are in %v",
+		user.Nudges, maxNudgesPerDay, user.location())
+}
+
+func processSettingsNudgesMenu(messageText string, chatId ChatId, user User, users *Users) (result MenuProcessorResult, err error) {
+	switch {
+	case messageText == TTEXT_BACK:
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateSettingsKeyboard(),
+			replyText:     "Going back to the settings menu",
+			userAction:    UserAction{CurrentMenu: MENU_SETTINGS},
+		}, nil
+	case messageText == TTEXT_NUDGES_OFF:
+		user.Nudges.IdleMins = 0
+	case messageText == TTEXT_WORK_WEEKDAYS:
+		user.Nudges.WorkDays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	case messageText == TTEXT_WORK_EVERY_DAY:
+		user.Nudges.WorkDays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+	case strings.HasPrefix(messageText, TTEXT_REMIND_AFTER):
+		mins := 0
+		for _, option := range nudgeIdleOptions {
+			if messageText == TTEXT_REMIND_AFTER+formatDuration(time.Duration(option)*time.Minute) {
+				mins = option
+			}
+		}
+		if mins == 0 {
+			return generateNudgesResult(user, "Sorry, I didn't get that. Please select one of the options below"), nil
+		}
+		user.Nudges.IdleMins = mins
+		if user.Nudges.WorkStart == "" {
+			user.Nudges.WorkStart = defaultWorkStart
+			user.Nudges.WorkEnd = defaultWorkEnd
+		}
+		if len(user.Nudges.WorkDays) == 0 {
+			user.Nudges.WorkDays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+		}
+	default:
+		start, end, parseErr := parseClockWindow(messageText)
+		if parseErr != nil || !user.Nudges.isOn() {
+			return generateNudgesResult(user, "Sorry, I didn't get that. Please select one of the options below"), nil
+		}
+		user.Nudges.WorkStart = start
+		user.Nudges.WorkEnd = end
+	}
+
+	err = users.updateUser(chatId, user)
+	if err != nil {
+		return MenuProcessorResult{}, err
+	}
+	return generateNudgesResult(user, nudgesText(user)), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNudgeDue(t *testing.T) {
+	nudges := Nudges{
+		IdleMins:  60,
+		WorkStart: "09:00",
+		WorkEnd:   "18:00",
+		WorkDays:  []time.Weekday{testDay.Weekday()},
+	}
+	now := testDay.Add(3 * time.Hour)
+	tests := []struct {
+		name        string
+		lastFocusAt time.Time
+		due         bool
+	}{
+		{"no focus today", time.Time{}, true},
+		{"focus yesterday", now.Add(-24 * time.Hour), true},
+		{"recent focus", now.Add(-30 * time.Minute), false},
+		{"running focus", now.Add(10 * time.Minute), false},
+		{"idle long enough", now.Add(-time.Hour), true},
+	}
+	for _, test := range tests {
+		if due := nudgeDue(nudges, QuietHours{}, test.lastFocusAt, now); due != test.due {
+			t.Errorf("%v: expected due %v, got %v", test.name, test.due, due)
+		}
+	}
+}
+
+func TestNudgeStartsFocusWithLastTag(t *testing.T) {
+	const chatId ChatId = 1
+	env, _ := newTestEnvironment(t, chatId)
+	env.users.rememberTag(chatId, "docs")
+	user := env.users.data[chatId]
+
+	result, err := processNudgeMenu(TTEXT_START_FOCUS, user, chatId, env)
+	if err != nil {
+		t.Fatalf("start focus: %v", err)
+	}
+	if result.userAction.CurrentMenu != MENU_INFOCUS {
+		t.Fatalf("expected the focus menu, got %v", getMenuName(result.userAction.CurrentMenu))
+	}
+	tk, ok := env.timeKeepers.get(chatId)
+	if !ok {
+		t.Fatalf("focus is not running")
+	}
+	session, err := env.db.getSession(chatId, tk.sessionId)
+	if err != nil || session.Tag != "docs" {
+		t.Fatalf("unexpected session %+v, err %v", session, err)
+	}
+	if !env.users.data[chatId].LastFocusAt.After(time.Now()) {
+		t.Fatalf("a running focus doesn't count as the last focus")
+	}
+}
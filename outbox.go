@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Telegram allows roughly 30 messages per second across all chats, about
+// one message per second inside a single chat and 20 per minute in a group.
+// Discord is more generous, so pacing by Telegram's limits suits both.
+const (
+	globalMessagesPerSecond = 30
+	chatMessagesPerSecond   = 1
+	groupMessagesPerSecond  = 20.0 / 60
+	chatMessagesBurst       = 2
+	messageQueueCapacity    = 1000
+	messageMaxAttempts      = 5
+	messageSenderWorkers    = 4
+	messageRetryBaseDelay   = time.Second
+	idleChatBucketLifetime  = time.Minute
+)
+
+const (
+	PRIORITY_INTERACTIVE = iota
+	PRIORITY_BROADCAST
+	PRIORITY_COUNT
+)
+
+var (
+	errQueueFull   = errors.New("outgoing message queue is full")
+	errQueueClosed = errors.New("outgoing message queue is closed")
+)
+
+type outgoingRequest struct {
+	chatId      ChatId
+	method      string
+	contentType string
+	body        []byte
+	// target is what the request acts on besides the chat, like the
+	// message to edit, when the body can't carry it
+	target     string
+	priority   int
+	attempts   int
+	enqueuedAt time.Time
+	notBefore  time.Time
+}
+
+// tokenBucket is a classic token bucket limiter. It is not safe for
+// concurrent use, the owning messageQueue guards it with its mutex.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	paused time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// delay returns how long to wait before a token becomes available.
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	if now.Before(b.paused) {
+		return b.paused.Sub(now)
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(now time.Time) {
+	b.refill(now)
+	b.tokens--
+}
+
+// pause empties the bucket until the given moment, used when the
+// messenger answers with an explicit retry_after.
+func (b *tokenBucket) pause(until time.Time) {
+	if until.After(b.paused) {
+		b.paused = until
+	}
+	b.tokens = 0
+}
+
+func (b *tokenBucket) isIdle(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst && now.Sub(b.last) > idleChatBucketLifetime
+}
+
+type requestSender func(req *outgoingRequest) error
+
+type messageQueue struct {
+	mut      sync.Mutex
+	pending  [PRIORITY_COUNT][]*outgoingRequest
+	capacity int
+	global   *tokenBucket
+	chats    map[ChatId]*tokenBucket
+	inFlight map[ChatId]bool
+	work     chan *outgoingRequest
+	wake     chan struct{}
+	send     requestSender
+	closed   bool
+}
+
+func newMessageQueue(send requestSender) *messageQueue {
+	q := &messageQueue{
+		capacity: messageQueueCapacity,
+		global:   newTokenBucket(globalMessagesPerSecond, globalMessagesPerSecond),
+		chats:    make(map[ChatId]*tokenBucket),
+		inFlight: make(map[ChatId]bool),
+		work:     make(chan *outgoingRequest),
+		wake:     make(chan struct{}, 1),
+		send:     send,
+	}
+	go q.dispatch()
+	for i := 0; i < messageSenderWorkers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+func (q *messageQueue) enqueue(req *outgoingRequest) error {
+	q.mut.Lock()
+	if q.closed {
+		q.mut.Unlock()
+		return errQueueClosed
+	}
+	if q.lenLocked() >= q.capacity {
+		q.mut.Unlock()
+		return errQueueFull
+	}
+	q.pending[req.priority] = append(q.pending[req.priority], req)
+	q.mut.Unlock()
+
+	q.signal()
+	return nil
+}
+
+// flush stops accepting new requests and waits until everything already
+// queued is delivered or dropped, or until ctx is done.
+func (q *messageQueue) flush(ctx context.Context) error {
+	q.mut.Lock()
+	q.closed = true
+	q.mut.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		q.mut.Lock()
+		left := q.lenLocked() + len(q.inFlight)
+		q.mut.Unlock()
+		if left == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v outgoing requests were not delivered: %w", left, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// dropChat removes the queued requests of the chat, a request that is
+// already being sent is still delivered.
+func (q *messageQueue) dropChat(chatId ChatId) int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	dropped := 0
+	for priority, requests := range q.pending {
+		kept := requests[:0]
+		for _, req := range requests {
+			if req.chatId == chatId {
+				dropped++
+				continue
+			}
+			kept = append(kept, req)
+		}
+		q.pending[priority] = kept
+	}
+	return dropped
+}
+
+// pendingFor returns the number of requests of the chat that are queued
+// or being sent.
+func (q *messageQueue) pendingFor(chatId ChatId) int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	pending := 0
+	for _, requests := range q.pending {
+		for _, req := range requests {
+			if req.chatId == chatId {
+				pending++
+			}
+		}
+	}
+	if q.inFlight[chatId] {
+		pending++
+	}
+	return pending
+}
+
+// depth returns the number of queued requests for every priority.
+func (q *messageQueue) depth() [PRIORITY_COUNT]int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	var result [PRIORITY_COUNT]int
+	for priority, requests := range q.pending {
+		result[priority] = len(requests)
+	}
+	return result
+}
+
+func (q *messageQueue) updateDepthMetrics() {
+	for priority, depth := range q.depth() {
+		messageQueueDepth.set(float64(depth), priorityNames[priority])
+	}
+}
+
+func (q *messageQueue) lenLocked() int {
+	total := 0
+	for _, requests := range q.pending {
+		total += len(requests)
+	}
+	return total
+}
+
+func (q *messageQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *messageQueue) chatBucket(chatId ChatId) *tokenBucket {
+	bucket, ok := q.chats[chatId]
+	if !ok {
+		rate := float64(chatMessagesPerSecond)
+		if isGroupChatId(chatId) {
+			rate = groupMessagesPerSecond
+		}
+		bucket = newTokenBucket(rate, chatMessagesBurst)
+		q.chats[chatId] = bucket
+	}
+	return bucket
+}
+
+// next picks the first request that may be sent right now. Requests of a
+// higher priority are always preferred and messages inside one chat keep
+// their order. When nothing is ready it returns how long to wait.
+func (q *messageQueue) next(now time.Time) (*outgoingRequest, time.Duration) {
+	wait := time.Minute
+	if d := q.global.delay(now); d > 0 {
+		return nil, d
+	}
+
+	for priority := range q.pending {
+		blocked := make(map[ChatId]bool)
+		for i, req := range q.pending[priority] {
+			if blocked[req.chatId] || q.inFlight[req.chatId] {
+				blocked[req.chatId] = true
+				continue
+			}
+			d := req.notBefore.Sub(now)
+			if bucketDelay := q.chatBucket(req.chatId).delay(now); bucketDelay > d {
+				d = bucketDelay
+			}
+			if d > 0 {
+				blocked[req.chatId] = true
+				if d < wait {
+					wait = d
+				}
+				continue
+			}
+
+			q.pending[priority] = append(q.pending[priority][:i], q.pending[priority][i+1:]...)
+			q.global.take(now)
+			q.chatBucket(req.chatId).take(now)
+			q.inFlight[req.chatId] = true
+			return req, 0
+		}
+	}
+	return nil, wait
+}
+
+func (q *messageQueue) dropIdleBuckets(now time.Time) {
+	for chatId, bucket := range q.chats {
+		if !q.inFlight[chatId] && bucket.isIdle(now) {
+			delete(q.chats, chatId)
+		}
+	}
+}
+
+func (q *messageQueue) dispatch() {
+	lastCleanup := time.Now()
+	for {
+		now := time.Now()
+		q.mut.Lock()
+		if now.Sub(lastCleanup) > idleChatBucketLifetime {
+			q.dropIdleBuckets(now)
+			lastCleanup = now
+		}
+		req, wait := q.next(now)
+		q.mut.Unlock()
+
+		if req != nil {
+			q.work <- req
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (q *messageQueue) worker() {
+	for req := range q.work {
+		err := q.send(req)
+
+		q.mut.Lock()
+		delete(q.inFlight, req.chatId)
+		if err != nil {
+			q.retryLocked(req, err)
+		} else {
+			messageDeliveryDuration.observeSince(req.enqueuedAt, priorityNames[req.priority])
+		}
+		q.mut.Unlock()
+		q.signal()
+	}
+}
+
+// retryLocked puts a failed request back at the front of its queue unless
+// the error is permanent or the request ran out of attempts.
+func (q *messageQueue) retryLocked(req *outgoingRequest, err error) {
+	req.attempts++
+	var apiErr *apiError
+	isApiErr := errors.As(err, &apiErr)
+	if isApiErr && !apiErr.isRetryable() {
+		logger.warn("dropping outgoing request", "chat_id", req.chatId, "method", req.method, "err", err)
+		return
+	}
+	if req.attempts >= messageMaxAttempts {
+		logger.warn("dropping outgoing request, out of attempts", "chat_id", req.chatId, "method", req.method, "attempts", req.attempts, "err", err)
+		return
+	}
+
+	now := time.Now()
+	delay := messageRetryBaseDelay << (req.attempts - 1)
+	if isApiErr && apiErr.retryAfter > 0 {
+		delay = apiErr.retryAfter
+		q.chatBucket(req.chatId).pause(now.Add(delay))
+		if apiErr.statusCode == 429 {
+			q.global.pause(now.Add(delay))
+		}
+	}
+	req.notBefore = now.Add(delay)
+	logger.info("retrying outgoing request", "chat_id", req.chatId, "method", req.method, "delay", delay, "attempts", req.attempts, "err", err)
+	q.pending[req.priority] = append([]*outgoingRequest{req}, q.pending[req.priority]...)
+}
+
+// apiError is a request the messenger answered with an error.
+type apiError struct {
+	messenger   string
+	method      string
+	statusCode  int
+	description string
+	retryAfter  time.Duration
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%v method [%v] failed, status code - [%v], description - [%v]", e.messenger, e.method, e.statusCode, e.description)
+}
+
+func (e *apiError) isRetryable() bool {
+	return e.statusCode == 429 || e.statusCode >= 500
+}
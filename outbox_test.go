@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newIdleMessageQueue builds a queue without its dispatcher and workers,
+// the tests pick requests with next and play the worker themselves.
+func newIdleMessageQueue() *messageQueue {
+	return &messageQueue{
+		capacity: messageQueueCapacity,
+		global:   newTokenBucket(globalMessagesPerSecond, globalMessagesPerSecond),
+		chats:    make(map[ChatId]*tokenBucket),
+		inFlight: make(map[ChatId]bool),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func testRequest(chatId ChatId, priority int, method string) *outgoingRequest {
+	return &outgoingRequest{chatId: chatId, method: method, priority: priority, enqueuedAt: time.Now()}
+}
+
+// finishRequest finishes the request the way a worker does after a delivery.
+func finishRequest(q *messageQueue, req *outgoingRequest) {
+	delete(q.inFlight, req.chatId)
+}
+
+func TestMessageQueueInteractiveOvertakesBroadcast(t *testing.T) {
+	q := newIdleMessageQueue()
+	for _, req := range []*outgoingRequest{
+		testRequest(1, PRIORITY_BROADCAST, "broadcast 1"),
+		testRequest(2, PRIORITY_BROADCAST, "broadcast 2"),
+		testRequest(3, PRIORITY_INTERACTIVE, "interactive"),
+	} {
+		if err := q.enqueue(req); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	now := time.Now()
+	for _, expected := range []string{"interactive", "broadcast 1", "broadcast 2"} {
+		req, _ := q.next(now)
+		if req == nil || req.method != expected {
+			t.Fatalf("expected %v, got %+v", expected, req)
+		}
+		finishRequest(q, req)
+	}
+	if req, _ := q.next(now); req != nil {
+		t.Fatalf("expected an empty queue, got %+v", req)
+	}
+}
+
+func TestMessageQueueKeepsChatOrderOnRetry(t *testing.T) {
+	q := newIdleMessageQueue()
+	q.enqueue(testRequest(1, PRIORITY_INTERACTIVE, "first"))
+	q.enqueue(testRequest(1, PRIORITY_INTERACTIVE, "second"))
+
+	now := time.Now()
+	first, _ := q.next(now)
+	if first == nil || first.method != "first" {
+		t.Fatalf("expected the first request, got %+v", first)
+	}
+	if req, _ := q.next(now); req != nil {
+		t.Fatalf("the chat has a request in flight, got %+v", req)
+	}
+
+	finishRequest(q, first)
+	q.retryLocked(first, &apiError{statusCode: 502})
+	if req, wait := q.next(now); req != nil || wait <= 0 {
+		t.Fatalf("the failed request waits before its retry and blocks the chat, got %+v after %v", req, wait)
+	}
+	later := now.Add(2 * messageRetryBaseDelay)
+	for _, expected := range []string{"first", "second"} {
+		req, _ := q.next(later)
+		if req == nil || req.method != expected {
+			t.Fatalf("expected %v after the retry delay, got %+v", expected, req)
+		}
+		finishRequest(q, req)
+	}
+	if first.attempts != 1 {
+		t.Fatalf("expected one failed attempt, got %v", first.attempts)
+	}
+}
+
+func TestMessageQueueDropsPermanentFailures(t *testing.T) {
+	q := newIdleMessageQueue()
+	q.enqueue(testRequest(1, PRIORITY_INTERACTIVE, "rejected"))
+	req, _ := q.next(time.Now())
+	finishRequest(q, req)
+	q.retryLocked(req, &apiError{statusCode: 400, description: "chat not found"})
+	if q.lenLocked() != 0 {
+		t.Fatalf("a request the messenger rejected is retried: %+v", q.pending)
+	}
+
+	// other errors are retried until the attempts run out
+	req.attempts = messageMaxAttempts - 1
+	q.retryLocked(req, context.DeadlineExceeded)
+	if q.lenLocked() != 0 {
+		t.Fatalf("a request out of attempts is retried: %+v", q.pending)
+	}
+}
+
+func TestMessageQueueRetryAfterPausesBuckets(t *testing.T) {
+	q := newIdleMessageQueue()
+	q.enqueue(testRequest(1, PRIORITY_INTERACTIVE, "limited"))
+	now := time.Now()
+	req, _ := q.next(now)
+	finishRequest(q, req)
+	q.retryLocked(req, &apiError{statusCode: 429, retryAfter: 3 * time.Second})
+	q.enqueue(testRequest(2, PRIORITY_INTERACTIVE, "other chat"))
+
+	soon := now.Add(time.Second)
+	if d := q.chatBucket(1).delay(soon); d <= 0 {
+		t.Fatalf("the chat is not paused after a 429")
+	}
+	if d := q.global.delay(soon); d <= 0 {
+		t.Fatalf("the global bucket is not paused after a 429")
+	}
+	if req, _ := q.next(soon); req != nil {
+		t.Fatalf("a request is sent during the pause: %+v", req)
+	}
+
+	after := now.Add(4 * time.Second)
+	for _, expected := range []string{"limited", "other chat"} {
+		req, _ := q.next(after)
+		if req == nil || req.method != expected {
+			t.Fatalf("expected %v after the pause, got %+v", expected, req)
+		}
+		finishRequest(q, req)
+	}
+
+	// a retry_after without 429 only holds back its own chat
+	q.enqueue(testRequest(3, PRIORITY_INTERACTIVE, "unavailable"))
+	req, _ = q.next(after)
+	finishRequest(q, req)
+	q.retryLocked(req, &apiError{statusCode: 503, retryAfter: 3 * time.Second})
+	if d := q.global.delay(after); d > 0 {
+		t.Fatalf("the global bucket is paused by a 503, for %v", d)
+	}
+	if d := q.chatBucket(3).delay(after); d <= 0 {
+		t.Fatalf("the chat is not paused after a 503 with retry_after")
+	}
+}
+
+func TestMessageQueueFlush(t *testing.T) {
+	var mut sync.Mutex
+	var sent []string
+	q := newMessageQueue(func(req *outgoingRequest) error {
+		mut.Lock()
+		sent = append(sent, req.method)
+		mut.Unlock()
+		return nil
+	})
+	for i, chatId := range []ChatId{1, 2, 3} {
+		q.enqueue(testRequest(chatId, i%PRIORITY_COUNT, "message"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	mut.Lock()
+	delivered := len(sent)
+	mut.Unlock()
+	if delivered != 3 {
+		t.Fatalf("flush returned before the queue was idle, %v of 3 delivered", delivered)
+	}
+	if err := q.enqueue(testRequest(1, PRIORITY_INTERACTIVE, "late")); err != errQueueClosed {
+		t.Fatalf("expected a flushed queue to refuse requests, got %v", err)
+	}
+	if err := q.flush(ctx); err != nil {
+		t.Fatalf("flushing an idle queue: %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxPartners           = 5
+	partnerInviteLifetime = 7 * 24 * time.Hour
+	partnerInviteBytes    = 12
+)
+
+// Partnership connects two users who keep each other accountable. A is
+// always the lower chat id, so a pair is the same whoever invited whom.
+type Partnership struct {
+	A     ChatId    `json:"a"`
+	B     ChatId    `json:"b"`
+	Since time.Time `json:"since"`
+}
+
+// PartnerInvite is the token of the deep link a user sends to a future
+// partner, it works once.
+type PartnerInvite struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newPartnership(a ChatId, b ChatId, since time.Time) Partnership {
+	if a > b {
+		a, b = b, a
+	}
+	return Partnership{A: a, B: b, Since: since}
+}
+
+func (p Partnership) key() []byte {
+	return append(itob(int64(p.A)), itob(int64(p.B))...)
+}
+
+func (p Partnership) includes(chatId ChatId) bool {
+	return p.A == chatId || p.B == chatId
+}
+
+func (p Partnership) partnerOf(chatId ChatId) ChatId {
+	if p.A == chatId {
+		return p.B
+	}
+	return p.A
+}
+
+func newInviteToken() (string, error) {
+	buf := make([]byte, partnerInviteBytes)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// setPartnerInvite replaces the invite of the user, an empty one revokes it.
+func (u *Users) setPartnerInvite(chatId ChatId, invite PartnerInvite) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	user, ok := u.data[chatId]
+	if !ok {
+		return
+	}
+	user.PartnerInvite = invite
+	u.data[chatId] = user
+}
+
+// findPartnerInvite returns the user who created the invite with the token.
+func (u *Users) findPartnerInvite(token string, now time.Time) (ChatId, User, bool) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	for chatId, user := range u.data {
+		if user.PartnerInvite.Token == token && now.Before(user.PartnerInvite.ExpiresAt) {
+			return chatId, user, true
+		}
+	}
+	return 0, User{}, false
+}
+
+func (env *environment) userName(chatId ChatId) string {
+	env.users.mut.Lock()
+	defer env.users.mut.Unlock()
+	return env.users.data[chatId].FirstName
+}
+
+// notifyPartners tells every partner of the user, quiet hours of the
+// partner apply.
+func (env *environment) notifyPartners(chatId ChatId, text string) {
+	partnerships, err := env.db.getPartnerships(chatId)
+	if err != nil {
+		logger.error("failed to load partnerships", "chat_id", chatId, "err", err)
+		return
+	}
+	for _, p := range partnerships {
+		partnerId := p.partnerOf(chatId)
+		env.notify(OutgoingMessage{ChatId: partnerId, Text: text})
+	}
+}
+
+// acceptPartnerInvite makes the user a partner of whoever created the
+// invite and returns the reply for the user, formatted as HTML.
+func (env *environment) acceptPartnerInvite(chatId ChatId, token string) (string, error) {
+	now := time.Now()
+	inviterId, inviter, ok := env.users.findPartnerInvite(token, now)
+	switch {
+	case !ok:
+		return "This invite link is not valid anymore, ask your partner for a new one", nil
+	case inviterId == chatId:
+		return "This is your own invite link, send it to the one you want to keep you accountable", nil
+	}
+
+	partnerships, err := env.db.getPartnerships(chatId)
+	if err != nil {
+		return "", fmt.Errorf("load partnerships: %s", err)
+	}
+	for _, p := range partnerships {
+		if p.partnerOf(chatId) == inviterId {
+			return fmt.Sprintf("You are already partners with %v", html.EscapeString(inviter.FirstName)), nil
+		}
+	}
+	inviterPartnerships, err := env.db.getPartnerships(inviterId)
+	if err != nil {
+		return "", fmt.Errorf("load partnerships: %s", err)
+	}
+	if len(partnerships) >= maxPartners || len(inviterPartnerships) >= maxPartners {
+		return fmt.Sprintf("Sorry, one can have at most %v partners", maxPartners), nil
+	}
+
+	err = env.db.savePartnership(newPartnership(inviterId, chatId, now))
+	if err != nil {
+		return "", fmt.Errorf("save partnership: %s", err)
+	}
+	env.users.setPartnerInvite(inviterId, PartnerInvite{})
+	env.persistUser(inviterId)
+	logger.info("partnership created", "chat_id", chatId, "partner_chat_id", inviterId)
+	partnersCreated.inc()
+
+	env.notify(OutgoingMessage{
+		ChatId: inviterId,
+		Text: fmt.Sprintf("%v accepted your invite, you are accountability partners now! See %v for each other's progress",
+			env.userName(chatId), TTEXT_PARTNER_COMMAND),
+	})
+	return fmt.Sprintf("You are accountability partners with %v now! You'll hear when the other one focuses, see %v for each other's progress",
+		html.EscapeString(inviter.FirstName), TTEXT_PARTNER_COMMAND), nil
+}
+
+// inviteText creates a new invite, without the user name of the bot the
+// partner has to type the command.
+func (env *environment) inviteText(chatId ChatId) (string, error) {
+	token, err := newInviteToken()
+	if err != nil {
+		return "", fmt.Errorf("create invite token: %s", err)
+	}
+	env.users.setPartnerInvite(chatId, PartnerInvite{Token: token, ExpiresAt: time.Now().Add(partnerInviteLifetime)})
+	env.persistUser(chatId)
+
+	days := int(partnerInviteLifetime.Hours() / 24)
+	if env.botUsername == "" {
+		return fmt.Sprintf("Ask your partner to send me %v %v, it works once within %v days", TTEXT_START_COMMAND, token, days), nil
+	}
+	return fmt.Sprintf("Send this link to your partner, it works once within %v days:\nhttps://t.me/%v?start=%v",
+		days, env.botUsername, token), nil
+}
+
+// partnersText shows today's focus of the user and of every partner, each
+// in their own time zone.
+func (env *environment) partnersText(chatId ChatId, user User, partnerships []Partnership) string {
+	if len(partnerships) == 0 {
+		return "You have no accountability partners yet. Invite someone and you'll hear from each other when you focus"
+	}
+	var b strings.Builder
+	b.WriteString("Focus today")
+	now := time.Now()
+	chats := []ChatId{chatId}
+	for _, p := range partnerships {
+		chats = append(chats, p.partnerOf(chatId))
+	}
+	for i, id := range chats {
+		env.users.mut.Lock()
+		member, ok := env.users.data[id]
+		env.users.mut.Unlock()
+		name := html.EscapeString(member.FirstName)
+		if i == 0 {
+			name = "You"
+			member, ok = user, true
+		}
+		if !ok {
+			continue
+		}
+		today, _, err := env.goalProgress(id, member, now)
+		if err != nil {
+			logger.error("failed to calculate partner progress", "chat_id", id, "err", err)
+			continue
+		}
+		if today.sessions == 0 {
+			fmt.Fprintf(&b, "\n%v - no focus yet", name)
+			continue
+		}
+		fmt.Fprintf(&b, "\n%v - %v in %v sessions", name, formatDuration(today.focus), today.sessions)
+	}
+	return b.String()
+}
+
+func (env *environment) generatePartnersResult(chatId ChatId, user User, replyText string) (MenuProcessorResult, error) {
+	partnerships, err := env.db.getPartnerships(chatId)
+	if err != nil {
+		return MenuProcessorResult{}, fmt.Errorf("load partnerships: %s", err)
+	}
+	if replyText == "" {
+		replyText = env.partnersText(chatId, user, partnerships)
+	}
+	options := []string{TTEXT_INVITE_PARTNER}
+	// the buttons carry names only, the context maps them to the partners
+	action := UserAction{CurrentMenu: MENU_PARTNERS, Context: map[string]string{}}
+	for _, p := range partnerships {
+		partnerId := p.partnerOf(chatId)
+		option := TTEXT_END_PARTNERSHIP + env.userName(partnerId)
+		if _, taken := action.Context[option]; taken {
+			option += fmt.Sprintf(" (%v)", len(options))
+		}
+		action.Context[option] = strconv.FormatInt(int64(partnerId), 10)
+		options = append(options, option)
+	}
+	options = append(options, TTEXT_MAIN_MENU)
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(options...),
+		replyText:     replyText,
+		userAction:    action,
+	}, nil
+}
+
+func processPartnersMenu(messageText string, chatId ChatId, user User, env *environment) (result MenuProcessorResult, err error) {
+	switch {
+	case messageText == TTEXT_MAIN_MENU:
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateMainKeyboard(),
+			replyText:     "Back to main menu",
+			userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+		}, nil
+	case messageText == TTEXT_INVITE_PARTNER:
+		text, err := env.inviteText(chatId)
+		if err != nil {
+			return MenuProcessorResult{}, err
+		}
+		return env.generatePartnersResult(chatId, user, text)
+	case strings.HasPrefix(messageText, TTEXT_END_PARTNERSHIP):
+		value, ok := user.LastAction.Context[messageText]
+		partnerId, parseErr := strconv.ParseInt(value, 10, 64)
+		if !ok || parseErr != nil {
+			return env.generatePartnersResult(chatId, user, "Sorry, I didn't get that. Please select one of the options below")
+		}
+		err = env.db.deletePartnership(newPartnership(chatId, ChatId(partnerId), time.Time{}))
+		if err != nil {
+			return MenuProcessorResult{}, fmt.Errorf("delete partnership: %s", err)
+		}
+		logger.info("partnership ended", "chat_id", chatId, "partner_chat_id", partnerId)
+		env.notify(OutgoingMessage{
+			ChatId: ChatId(partnerId),
+			Text:   fmt.Sprintf("%v ended your accountability partnership", user.FirstName),
+		})
+		return env.generatePartnersResult(chatId, user, fmt.Sprintf("You are no longer partners with %v", html.EscapeString(env.userName(ChatId(partnerId)))))
+	}
+	return env.generatePartnersResult(chatId, user, "Sorry, I didn't get that. Please select one of the options below")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartnerNamesAreEscaped(t *testing.T) {
+	const chatId, inviterId ChatId = 1, 2
+	env, _ := newTestEnvironment(t, chatId)
+	env.users.add(inviterId, User{FirstName: "<b>Bob & co</b>", FocusDurationMins: 25, BreakDurationMins: 5})
+	env.users.setPartnerInvite(inviterId, PartnerInvite{Token: "token", ExpiresAt: time.Now().Add(time.Hour)})
+	const escaped = "&lt;b&gt;Bob &amp; co&lt;/b&gt;"
+
+	reply, err := env.acceptPartnerInvite(chatId, "token")
+	if err != nil {
+		t.Fatalf("accept invite: %v", err)
+	}
+	if !strings.Contains(reply, escaped) {
+		t.Fatalf("name is not escaped in %q", reply)
+	}
+
+	user := env.users.data[chatId]
+	result, err := env.generatePartnersResult(chatId, user, "")
+	if err != nil {
+		t.Fatalf("partners: %v", err)
+	}
+	if !strings.Contains(result.replyText, escaped) {
+		t.Fatalf("name is not escaped in %q", result.replyText)
+	}
+
+	user.LastAction = result.userAction
+	result, err = processPartnersMenu(TTEXT_END_PARTNERSHIP+"<b>Bob & co</b>", chatId, user, env)
+	if err != nil {
+		t.Fatalf("end partnership: %v", err)
+	}
+	if result.replyText != "You are no longer partners with "+escaped {
+		t.Fatalf("name is not escaped in %q", result.replyText)
+	}
+}
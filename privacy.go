@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// userExport is the document sent by /export, it holds everything the bot
+// stores about the chat.
+type userExport struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	ChatId     ChatId           `json:"chat_id"`
+	Profile    User             `json:"profile"`
+	Timer      *TimeKeeperState `json:"running_timer,omitempty"`
+	Sessions   []Session        `json:"sessions"`
+	Partners   []Partnership    `json:"partners,omitempty"`
+}
+
+func (env *environment) exportUserData(chatId ChatId, user User) error {
+	sessions, err := env.db.getSessions(chatId, time.Time{}, time.Time{})
+	if err != nil {
+		return fmt.Errorf("load sessions: %s", err)
+	}
+	partnerships, err := env.db.getPartnerships(chatId)
+	if err != nil {
+		return fmt.Errorf("load partnerships: %s", err)
+	}
+	export := userExport{
+		ExportedAt: time.Now().UTC(),
+		ChatId:     chatId,
+		Profile:    user,
+		Sessions:   sessions,
+		Partners:   partnerships,
+	}
+	if tk, ok := env.timeKeepers.get(chatId); ok {
+		state := tk.state()
+		export.Timer = &state
+	}
+
+	jsonBuf, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal export: %s", err)
+	}
+	fileName := fmt.Sprintf("horae-export-%v.json", export.ExportedAt.Format("20060102"))
+	return env.sendDocument(chatId, PRIORITY_INTERACTIVE, fileName, jsonBuf, "")
+}
+
+// forgetUser cancels the running timer of the chat, drops its queued
+// messages and removes it from memory, from every bucket and from the
+// group sessions it joined.
+func (env *environment) forgetUser(chatId ChatId) error {
+	if tk, ok := env.timeKeepers.get(chatId); ok {
+		if tk.stopTimeKeep() {
+			sessionEvents.inc(tk.kind, "cancelled")
+		}
+		env.timeKeepers.remove(chatId)
+	}
+	dropped := env.queue.dropChat(chatId)
+	if dropped > 0 {
+		logger.debug("dropped queued messages of deleted user", "chat_id", chatId, "count", dropped)
+	}
+	env.users.remove(chatId)
+	// a button press in a group must not save a group session with the
+	// user back in
+	env.groupMut.Lock()
+	defer env.groupMut.Unlock()
+	return env.db.deleteUserData(chatId)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QUIET_MODE_SILENT = "silent"
+	QUIET_MODE_DEFER  = "defer"
+)
+
+// DeferredMessage is a message held back until quiet hours end. It waits
+// in the storage rather than in the message queue, so it survives restarts
+// and doesn't hold up the chat or take a place in the queue.
+type DeferredMessage struct {
+	Id      int64           `json:"id"`
+	SendAt  time.Time       `json:"send_at"`
+	Message OutgoingMessage `json:"message"`
+}
+
+// key orders the messages by when they are due.
+func (m DeferredMessage) key() []byte {
+	return append(append(itob(m.SendAt.UnixNano()), itob(int64(m.Message.ChatId))...), itob(m.Id)...)
+}
+
+// Quiet hours offered on the keyboard, any other window can be typed.
+var quietHourPresets = []string{"22:00-07:00", "23:00-08:00", "21:00-06:00"}
+
+var reClockWindow = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):([0-5][0-9])\s*-\s*([01]?[0-9]|2[0-3]):([0-5][0-9])$`)
+
+// QuietHours is a daily window in the time zone of the user when messages
+// the user didn't ask for, like finished timers or due schedules, either
+// arrive without a sound or wait until the window ends. The window may
+// cross midnight.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Mode  string `json:"mode"`
+}
+
+func (q QuietHours) isSet() bool {
+	return q.Start != "" && q.End != "" && q.Start != q.End
+}
+
+func (q QuietHours) String() string {
+	mode := "muted"
+	if q.Mode == QUIET_MODE_DEFER {
+		mode = "held back"
+	}
+	return fmt.Sprintf("%v - %v, messages are %v", q.Start, q.End, mode)
+}
+
+// parseClockWindow parses a daily window like 22:00-07:00.
+func parseClockWindow(text string) (start string, end string, err error) {
+	m := reClockWindow.FindStringSubmatch(strings.TrimSpace(text))
+	if m == nil {
+		return "", "", fmt.Errorf("expected a window like 22:00-07:00, got [%v]", text)
+	}
+	startHour, _ := strconv.Atoi(m[1])
+	endHour, _ := strconv.Atoi(m[3])
+	start = fmt.Sprintf("%02d:%v", startHour, m[2])
+	end = fmt.Sprintf("%02d:%v", endHour, m[4])
+	if start == end {
+		return "", "", fmt.Errorf("window [%v] is empty", text)
+	}
+	return start, end, nil
+}
+
+// clockOn returns the time of the day given as "15:04" on the day of t.
+func clockOn(t time.Time, clock string) time.Time {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), parsed.Hour(), parsed.Minute(), 0, 0, t.Location())
+}
+
+// clockWindowAt returns when the daily window from start to end around now
+// began and ends, zero times when now is outside of it. The window may
+// cross midnight.
+func clockWindowAt(startClock string, endClock string, now time.Time) (time.Time, time.Time) {
+	start := clockOn(now, startClock)
+	end := clockOn(now, endClock)
+	if start.Before(end) {
+		if !now.Before(start) && now.Before(end) {
+			return start, end
+		}
+		return time.Time{}, time.Time{}
+	}
+	if now.Before(end) {
+		return start.AddDate(0, 0, -1), end
+	}
+	if !now.Before(start) {
+		return start, end.AddDate(0, 0, 1)
+	}
+	return time.Time{}, time.Time{}
+}
+
+// endsAt returns when the quiet hours around now end, the zero time when
+// now is outside of them.
+func (q QuietHours) endsAt(now time.Time) time.Time {
+	if !q.isSet() {
+		return time.Time{}
+	}
+	_, end := clockWindowAt(q.Start, q.End, now)
+	return end
+}
+
+// notify queues a message the user didn't ask for. During quiet hours it
+// is sent without a sound or held back until they end.
+func (env *environment) notify(msg OutgoingMessage) {
+	user, ok := env.users.get(msg.ChatId)
+	if !ok || !user.QuietHours.isSet() {
+		env.sendMessage(PRIORITY_BROADCAST, msg)
+		return
+	}
+	end := user.QuietHours.endsAt(time.Now().In(user.location()))
+	if end.IsZero() {
+		env.sendMessage(PRIORITY_BROADCAST, msg)
+		return
+	}
+
+	if user.QuietHours.Mode == QUIET_MODE_DEFER {
+		env.deferMessage(msg, end)
+		return
+	}
+	msg.Silent = true
+	env.sendMessage(PRIORITY_BROADCAST, msg)
+}
+
+func (env *environment) deferMessage(msg OutgoingMessage, sendAt time.Time) {
+	err := env.db.saveDeferredMessage(DeferredMessage{Id: time.Now().UnixNano(), SendAt: sendAt, Message: msg})
+	if err != nil {
+		logger.error("failed to defer message, sending it now", "chat_id", msg.ChatId, "err", err)
+		msg.Silent = true
+		env.sendMessage(PRIORITY_BROADCAST, msg)
+		return
+	}
+	logger.debug("message held back for quiet hours", "chat_id", msg.ChatId, "until", sendAt)
+}
+
+// sendDeferredMessages queues the deferred messages that are due. A message
+// the queue has no room for stays stored for the next run.
+func (env *environment) sendDeferredMessages(now time.Time) {
+	messages, err := env.db.getDeferredMessages(now)
+	if err != nil {
+		logger.error("failed to load deferred messages", "err", err)
+		return
+	}
+	for _, deferred := range messages {
+		req, err := env.messenger.messageRequest(deferred.Message)
+		if err != nil {
+			logger.error("failed to encode deferred message", "chat_id", deferred.Message.ChatId, "err", err)
+		} else {
+			req.chatId = deferred.Message.ChatId
+			req.priority = PRIORITY_BROADCAST
+			req.enqueuedAt = now
+			err = env.queue.enqueue(req)
+			if err != nil {
+				logger.warn("failed to queue deferred message", "chat_id", deferred.Message.ChatId, "err", err)
+				return
+			}
+		}
+		err = env.db.deleteDeferredMessage(deferred)
+		if err != nil {
+			logger.error("failed to delete deferred message", "chat_id", deferred.Message.ChatId, "err", err)
+		}
+	}
+}
+
+func generateQuietHoursResult(user User, replyText string) MenuProcessorResult {
+	modeOption := TTEXT_QUIET_DEFER
+	if user.QuietHours.Mode == QUIET_MODE_DEFER {
+		modeOption = TTEXT_QUIET_SILENT
+	}
+	options := append(append([]string{}, quietHourPresets...), modeOption, TTEXT_QUIET_OFF, TTEXT_BACK)
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(options...),
+		replyText:     replyText,
+		userAction:    UserAction{CurrentMenu: MENU_SETTINGS_QUIET_HOURS},
+	}
+}
+
+func quietHoursText(user User) string {
+	if !user.QuietHours.isSet() {
+		return fmt.Sprintf("Quiet hours are off. Pick a window or type one like 22:30-07:00, times are in %v", user.location())
+	}
+	return fmt.Sprintf("Quiet hours: %v, times are in %v", user.QuietHours, user.location())
+}
+
+func processSettingsQuietHoursMenu(messageText string, chatId ChatId, user User, users *Users) (result MenuProcessorResult, err error) {
+	switch messageText {
+	case TTEXT_BACK:
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateSettingsKeyboard(),
+			replyText:     "Going back to the settings menu",
+			userAction:    UserAction{CurrentMenu: MENU_SETTINGS},
+		}, nil
+	case TTEXT_QUIET_OFF:
+		user.QuietHours = QuietHours{}
+	case TTEXT_QUIET_DEFER, TTEXT_QUIET_SILENT:
+		if !user.QuietHours.isSet() {
+			return generateQuietHoursResult(user, "Pick the quiet hours first"), nil
+		}
+		user.QuietHours.Mode = QUIET_MODE_SILENT
+		if messageText == TTEXT_QUIET_DEFER {
+			user.QuietHours.Mode = QUIET_MODE_DEFER
+		}
+	default:
+		start, end, parseErr := parseClockWindow(messageText)
+		if parseErr != nil {
+			return generateQuietHoursResult(user, "Sorry, I didn't get that. Type the quiet hours like 22:30-07:00"), nil
+		}
+		user.QuietHours.Start = start
+		user.QuietHours.End = end
+		if user.QuietHours.Mode == "" {
+			user.QuietHours.Mode = QUIET_MODE_SILENT
+		}
+	}
+
+	err = users.updateUser(chatId, user)
+	if err != nil {
+		return MenuProcessorResult{}, err
+	}
+	return generateQuietHoursResult(user, quietHoursText(user)), nil
+}
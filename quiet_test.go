@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeferredMessagesWaitForQuietHours(t *testing.T) {
+	const chatId ChatId = 1
+	messenger := &testMessenger{}
+	db := newMemoryStorage()
+	env := createEnvironment(messenger, db)
+	now := time.Now().UTC()
+	env.users.add(chatId, User{FirstName: "Ann", QuietHours: QuietHours{
+		Start: now.Add(-time.Hour).Format("15:04"),
+		End:   now.Add(time.Hour).Format("15:04"),
+		Mode:  QUIET_MODE_DEFER,
+	}})
+
+	env.notify(OutgoingMessage{ChatId: chatId, Text: "partner finished a focus"})
+	if depth := env.queue.depth(); depth[PRIORITY_BROADCAST] != 0 {
+		t.Fatalf("deferred message takes a place in the queue: %v", depth)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	env.shutdown(ctx)
+	if len(messenger.messages) != 0 {
+		t.Fatalf("deferred message was sent on shutdown: %+v", messenger.messages)
+	}
+
+	// the next run picks the message up once quiet hours are over
+	env = createEnvironment(messenger, db)
+	t.Cleanup(func() {
+		env.shutdown(context.Background())
+	})
+	env.sendDeferredMessages(now)
+	if depth := env.queue.depth(); depth[PRIORITY_BROADCAST] != 0 {
+		t.Fatalf("deferred message is queued during quiet hours: %v", depth)
+	}
+	env.sendDeferredMessages(now.Add(2 * time.Hour))
+	err := env.queue.flush(ctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(messenger.messages) != 1 || messenger.messages[0].Text != "partner finished a focus" || messenger.messages[0].Silent {
+		t.Fatalf("unexpected messages after quiet hours: %+v", messenger.messages)
+	}
+	messages, _ := db.getDeferredMessages(now.Add(24 * time.Hour))
+	if len(messages) != 0 {
+		t.Fatalf("sent message is still stored: %+v", messages)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxNoteLength    = 1000
+	journalEntries   = 10
+	maxSessionRating = 5
+)
+
+func GenerateRatingKeyboard() Keyboard {
+	row := make([]string, 0, maxSessionRating)
+	for i := 1; i <= maxSessionRating; i++ {
+		row = append(row, strconv.Itoa(i))
+	}
+	return Keyboard{row, GenerateKeyboardRow(TTEXT_SKIP)}
+}
+
+func generateRatingResult(sessionId int64, replyText string) MenuProcessorResult {
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateRatingKeyboard(),
+		replyText:     replyText,
+		userAction:    sessionAction(MENU_REFLECTION_RATING, sessionId),
+	}
+}
+
+func processReflectionNoteMenu(messageText string, user User, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	sessionId, err := contextSessionId(user)
+	if err != nil {
+		return MenuProcessorResult{}, fmt.Errorf("reflection without a session: %s", err)
+	}
+	if messageText != TTEXT_SKIP {
+		note := truncateText(strings.TrimSpace(messageText), maxNoteLength)
+		err = env.updateSession(chatId, sessionId, func(session *Session) {
+			session.Note = note
+		})
+		if err != nil {
+			return MenuProcessorResult{}, err
+		}
+	}
+	return generateRatingResult(sessionId, fmt.Sprintf("How focused were you, from 1 to %v?", maxSessionRating)), nil
+}
+
+func processReflectionRatingMenu(messageText string, user User, chatId ChatId, env *environment) (result MenuProcessorResult, err error) {
+	sessionId, err := contextSessionId(user)
+	if err != nil {
+		return MenuProcessorResult{}, fmt.Errorf("reflection without a session: %s", err)
+	}
+	result = MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateMainKeyboard(),
+		replyText:     "Enjoy your rest!",
+		userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+	}
+	if messageText == TTEXT_SKIP {
+		return result, nil
+	}
+
+	rating, convErr := strconv.Atoi(messageText)
+	if convErr != nil || rating < 1 || rating > maxSessionRating {
+		return generateRatingResult(sessionId, fmt.Sprintf("Please pick a number from 1 to %v", maxSessionRating)), nil
+	}
+	err = env.updateSession(chatId, sessionId, func(session *Session) {
+		session.Rating = rating
+	})
+	if err != nil {
+		return MenuProcessorResult{}, err
+	}
+	result.replyText = fmt.Sprintf("Thanks, noted in your %v. Enjoy your rest!", TTEXT_JOURNAL_COMMAND)
+	return result, nil
+}
+
+func formatRating(rating int) string {
+	return strings.Repeat("★", rating) + strings.Repeat("☆", maxSessionRating-rating)
+}
+
+// generateJournalText lists the latest focus sessions with a note or a
+// rating, newest first.
+func (env *environment) generateJournalText(chatId ChatId, tag string) (string, error) {
+	sessions, err := env.db.getSessions(chatId, time.Time{}, time.Time{})
+	if err != nil {
+		return "", fmt.Errorf("load sessions: %s", err)
+	}
+
+	var b strings.Builder
+	entries := 0
+	for i := len(sessions) - 1; i >= 0 && entries < journalEntries; i-- {
+		s := sessions[i]
+		if s.Kind != SESSION_KIND_FOCUS || (s.Note == "" && s.Rating == 0) {
+			continue
+		}
+		if tag != "" && s.Tag != tag {
+			continue
+		}
+		if entries > 0 {
+			b.WriteString("\n\n")
+		}
+		entries++
+		fmt.Fprintf(&b, "%v, %v", s.StartedAt.UTC().Format("Mon 2 Jan 15:04"), formatDuration(s.duration()))
+		if s.Tag != "" {
+			fmt.Fprintf(&b, ", %v", formatTag(s.Tag))
+		}
+		if s.Rating > 0 {
+			fmt.Fprintf(&b, " %v", formatRating(s.Rating))
+		}
+		if s.Note != "" {
+			fmt.Fprintf(&b, "\n%v", s.Note)
+		}
+	}
+	if entries == 0 && tag != "" {
+		return fmt.Sprintf("There are no journal entries for %v yet", formatTag(tag)), nil
+	}
+	if entries == 0 {
+		return "Your journal is empty. When a focus session ends I will ask what you got done", nil
+	}
+	return b.String(), nil
+}
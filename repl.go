@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	CONSOLE_METHOD_MESSAGE = "message"
+	CONSOLE_METHOD_EDIT    = "edit"
+	CONSOLE_METHOD_FILE    = "file"
+	CONSOLE_METHOD_ANSWER  = "answer"
+
+	REPL_GROUP   = ":group"
+	REPL_PRIVATE = ":private"
+	REPL_SAY     = ":say "
+	REPL_HELP    = ":help"
+	REPL_QUIT    = ":quit"
+)
+
+const replGroupChatId ChatId = -1
+
+const consoleReplyPollInterval = 20 * time.Millisecond
+
+var reHtmlTag = regexp.MustCompile(`</?[a-z]+>`)
+
+// consoleFile is the body of a file request, the content is written out
+// when the request is sent.
+type consoleFile struct {
+	ChatId   ChatId
+	Kind     string
+	FileName string
+	Content  []byte
+	Caption  string
+}
+
+// consoleChat is what the user can press in a chat: the reply keyboard
+// stays until another one replaces it, the buttons belong to the latest
+// message that has them.
+type consoleChat struct {
+	keyboard        Keyboard
+	buttons         []InlineButton
+	buttonMessageId string
+}
+
+// consoleOption is a numbered choice, either a keyboard text or a button.
+type consoleOption struct {
+	text   string
+	button *InlineButton
+}
+
+func (c *consoleChat) options() []consoleOption {
+	var options []consoleOption
+	for _, row := range c.keyboard {
+		for _, text := range row {
+			options = append(options, consoleOption{text: text})
+		}
+	}
+	for i := range c.buttons {
+		options = append(options, consoleOption{text: c.buttons[i].Text, button: &c.buttons[i]})
+	}
+	return options
+}
+
+// consoleMessenger plays a single user talking to the bot on stdin and
+// stdout, in a private chat and in a group of their own.
+type consoleMessenger struct {
+	in       io.Reader
+	out      io.Writer
+	sender   Sender
+	filesDir string
+	handler  updateHandler
+	done     chan struct{}
+	// pending tells how many replies to a chat are still on their way,
+	// without it input is read without waiting for them
+	pending func(chatId ChatId) int
+
+	mut           sync.Mutex
+	stopped       bool
+	group         bool
+	chats         map[ChatId]*consoleChat
+	lastMessageId int
+	lastUpdateId  int
+}
+
+func newConsoleMessenger(in io.Reader, out io.Writer, sender Sender, filesDir string) *consoleMessenger {
+	return &consoleMessenger{
+		in:       in,
+		out:      out,
+		sender:   sender,
+		filesDir: filesDir,
+		done:     make(chan struct{}),
+		chats:    make(map[ChatId]*consoleChat),
+	}
+}
+
+func (c *consoleMessenger) name() string {
+	return MESSENGER_CONSOLE
+}
+
+func (c *consoleMessenger) start(handler updateHandler) error {
+	c.handler = handler
+	fmt.Fprintf(c.out, "Type %v to begin, a number picks one of the options. %v switches to a group chat, "+
+		"%v back, %v leaves\n", TTEXT_START_COMMAND, REPL_GROUP, REPL_PRIVATE, REPL_QUIT)
+	c.prompt()
+	go c.readInput()
+	return nil
+}
+
+// stop keeps further input from reaching the bot, the reader itself stays
+// blocked on stdin until the process exits.
+func (c *consoleMessenger) stop(ctx context.Context) error {
+	c.mut.Lock()
+	c.stopped = true
+	c.mut.Unlock()
+	return nil
+}
+
+func (c *consoleMessenger) health() (string, healthComponent) {
+	return "console", newHealthComponent(nil, nil)
+}
+
+func (c *consoleMessenger) chatId() ChatId {
+	if c.group {
+		return replGroupChatId
+	}
+	return ChatId(c.sender.Id)
+}
+
+func (c *consoleMessenger) chat(chatId ChatId) *consoleChat {
+	chat, ok := c.chats[chatId]
+	if !ok {
+		chat = &consoleChat{}
+		c.chats[chatId] = chat
+	}
+	return chat
+}
+
+func (c *consoleMessenger) prompt() {
+	name := "you"
+	if c.group {
+		name = "group"
+	}
+	fmt.Fprintf(c.out, "%v> ", name)
+}
+
+func (c *consoleMessenger) readInput() {
+	defer close(c.done)
+	scanner := bufio.NewScanner(c.in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == REPL_QUIT {
+			return
+		}
+		c.mut.Lock()
+		if c.stopped {
+			c.mut.Unlock()
+			return
+		}
+		msg, press, ok := c.parseInput(line)
+		c.mut.Unlock()
+		switch {
+		case press != nil:
+			c.handler.processButtonPress(*press)
+			c.waitForReplies()
+		case ok:
+			c.handler.processMessage(msg)
+			c.waitForReplies()
+		default:
+			c.mut.Lock()
+			c.prompt()
+			c.mut.Unlock()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.error("failed to read input", "err", err)
+	}
+}
+
+// waitForReplies holds the next line back until the bot's replies are
+// printed, otherwise a number piped or typed ahead would be read before
+// the options it picks are shown and sent as text.
+func (c *consoleMessenger) waitForReplies() {
+	if c.pending == nil {
+		return
+	}
+	for c.pending(ChatId(c.sender.Id))+c.pending(replGroupChatId) > 0 {
+		time.Sleep(consoleReplyPollInterval)
+	}
+}
+
+// parseInput turns a line into what the bot receives, numbers pick the
+// options shown last in the current chat and other numbers are sent as
+// typed.
+func (c *consoleMessenger) parseInput(line string) (IncomingMessage, *ButtonPress, bool) {
+	switch line {
+	case "":
+		return IncomingMessage{}, nil, false
+	case REPL_GROUP, REPL_PRIVATE:
+		c.group = line == REPL_GROUP
+		return IncomingMessage{}, nil, false
+	case REPL_HELP:
+		fmt.Fprintf(c.out, "A number picks one of the options, anything else is sent as typed, %vtext sends a number "+
+			"as text. %v switches to a group chat, %v back, %v leaves\n", REPL_SAY, REPL_GROUP, REPL_PRIVATE, REPL_QUIT)
+		return IncomingMessage{}, nil, false
+	}
+
+	c.lastUpdateId++
+	updateId := strconv.Itoa(c.lastUpdateId)
+	chatId := c.chatId()
+	chat := c.chat(chatId)
+	text := line
+	options := chat.options()
+	if strings.HasPrefix(line, REPL_SAY) {
+		text = strings.TrimPrefix(line, REPL_SAY)
+	} else if n, err := strconv.Atoi(line); err == nil && n >= 1 && n <= len(options) {
+		option := options[n-1]
+		if option.button != nil {
+			return IncomingMessage{}, &ButtonPress{
+				Id:        updateId,
+				UpdateId:  updateId,
+				ChatId:    chatId,
+				MessageId: chat.buttonMessageId,
+				From:      c.sender,
+				Data:      option.button.Data,
+			}, true
+		}
+		text = option.text
+	}
+	return IncomingMessage{
+		UpdateId: updateId,
+		ChatId:   chatId,
+		Group:    c.group,
+		From:     c.sender,
+		Text:     text,
+	}, nil, true
+}
+
+func consoleText(text string, format string) string {
+	if format == FORMAT_HTML {
+		text = html.UnescapeString(reHtmlTag.ReplaceAllString(text, ""))
+	}
+	return text
+}
+
+func (c *consoleMessenger) messageRequest(msg OutgoingMessage) (*outgoingRequest, error) {
+	return jsonRequest(CONSOLE_METHOD_MESSAGE, msg)
+}
+
+func (c *consoleMessenger) editRequest(messageId string, msg OutgoingMessage) (*outgoingRequest, error) {
+	req, err := jsonRequest(CONSOLE_METHOD_EDIT, msg)
+	if err != nil {
+		return nil, err
+	}
+	req.target = messageId
+	return req, nil
+}
+
+func (c *consoleMessenger) fileRequest(chatId ChatId, kind string, fileName string, content []byte, caption string) (*outgoingRequest, error) {
+	return jsonRequest(CONSOLE_METHOD_FILE, consoleFile{
+		ChatId:   chatId,
+		Kind:     kind,
+		FileName: fileName,
+		Content:  content,
+		Caption:  caption,
+	})
+}
+
+func (c *consoleMessenger) answerRequest(press ButtonPress, text string) (*outgoingRequest, error) {
+	req, err := jsonRequest(CONSOLE_METHOD_ANSWER, OutgoingMessage{ChatId: press.ChatId, Text: text})
+	if err != nil {
+		return nil, err
+	}
+	req.target = press.Id
+	return req, nil
+}
+
+func (c *consoleMessenger) send(req *outgoingRequest) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if req.method == CONSOLE_METHOD_FILE {
+		file := consoleFile{}
+		err := json.Unmarshal(req.body, &file)
+		if err != nil {
+			return err
+		}
+		return c.printFile(file)
+	}
+
+	msg := OutgoingMessage{}
+	err := json.Unmarshal(req.body, &msg)
+	if err != nil {
+		return err
+	}
+	switch req.method {
+	case CONSOLE_METHOD_ANSWER:
+		if msg.Text == "" {
+			return nil
+		}
+		c.printLine(msg.ChatId, "(only you see) "+msg.Text)
+	case CONSOLE_METHOD_EDIT:
+		chat := c.chat(msg.ChatId)
+		if chat.buttonMessageId == req.target {
+			chat.buttons = msg.Buttons
+		}
+		c.printMessage(msg, "(edited) ")
+	default:
+		c.lastMessageId++
+		chat := c.chat(msg.ChatId)
+		switch {
+		case msg.Keyboard != nil:
+			chat.keyboard = msg.Keyboard
+		case msg.RemoveKeyboard:
+			chat.keyboard = nil
+		}
+		if len(msg.Buttons) > 0 {
+			chat.buttons = msg.Buttons
+			chat.buttonMessageId = strconv.Itoa(c.lastMessageId)
+		}
+		c.printMessage(msg, "")
+	}
+	return nil
+}
+
+// printMessage shows the text with the options of the chat numbered the
+// way the user picks them.
+func (c *consoleMessenger) printMessage(msg OutgoingMessage, prefix string) {
+	var b strings.Builder
+	b.WriteString(prefix + consoleText(msg.Text, msg.Format))
+	if msg.Keyboard != nil || len(msg.Buttons) > 0 {
+		for i, option := range c.chat(msg.ChatId).options() {
+			marker := ""
+			if option.button != nil {
+				marker = " [button]"
+			}
+			fmt.Fprintf(&b, "\n  %v. %v%v", i+1, option.text, marker)
+		}
+	}
+	c.printLine(msg.ChatId, b.String())
+}
+
+func (c *consoleMessenger) printFile(file consoleFile) error {
+	err := os.MkdirAll(c.filesDir, 0755)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.filesDir, file.FileName)
+	err = os.WriteFile(path, file.Content, 0644)
+	if err != nil {
+		return err
+	}
+	text := fmt.Sprintf("[%v saved to %v]", file.Kind, path)
+	if file.Caption != "" {
+		text += " " + file.Caption
+	}
+	c.printLine(file.ChatId, text)
+	return nil
+}
+
+// printLine writes the bot's output over the prompt and shows the prompt
+// again, messages to the chat the user is not in are labelled.
+func (c *consoleMessenger) printLine(chatId ChatId, text string) {
+	label := "bot"
+	if isGroupChatId(chatId) {
+		label = "bot in group"
+	}
+	fmt.Fprintf(c.out, "\r%v: %v\n", label, text)
+	c.prompt()
+}
+
+// replCommand runs the bot against stdin and stdout, with the storage of
+// the config or in memory so nothing is kept.
+func replCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	storage := flags.String("storage", STORAGE_MEMORY, "storage to use: memory, or bbolt and sqlite at the paths of the config")
+	userId := flags.Int64("user", 1, "user id of the chatting user")
+	firstName := flags.String("name", "Dev", "first name of the chatting user")
+	filesDir := flags.String("files", filepath.Join(os.TempDir(), "horae-repl"), "directory for the charts and exports the bot sends")
+	flags.Parse(args)
+	if *userId <= 0 {
+		return fmt.Errorf("-user must be positive")
+	}
+
+	cfg.Storage = *storage
+	console := newConsoleMessenger(os.Stdin, os.Stdout, Sender{Id: *userId, FirstName: *firstName}, *filesDir)
+	env := createEnvironment(console, openStorage(cfg))
+	if env == nil {
+		return fmt.Errorf("failed to create environment")
+	}
+	console.pending = env.queue.pendingFor
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := console.start(env)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-console.done:
+	}
+	fmt.Fprintln(console.out)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	err = console.stop(shutdownCtx)
+	if err != nil {
+		return err
+	}
+	env.shutdown(shutdownCtx)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplWaitsForOptionsBeforeNextLine(t *testing.T) {
+	const chatId ChatId = 1
+	out := &bytes.Buffer{}
+	console := newConsoleMessenger(strings.NewReader("/start\n1\n2\n"), out, Sender{Id: int64(chatId), FirstName: "Ann"}, t.TempDir())
+	env := createEnvironment(console, newMemoryStorage())
+	console.pending = env.queue.pendingFor
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		env.shutdown(ctx)
+	})
+
+	err := console.start(env)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	select {
+	case <-console.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("input was not read")
+	}
+	user := env.users.data[chatId]
+	if user.FocusDurationMins != 15 || user.BreakDurationMins != 10 {
+		t.Fatalf("piped numbers didn't pick the options, durations %v and %v\n%v",
+			user.FocusDurationMins, user.BreakDurationMins, out.String())
+	}
+}
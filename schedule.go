@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SCHEDULE_MODE_PROMPT = "prompt"
+	SCHEDULE_MODE_AUTO   = "auto"
+)
+
+const (
+	maxSchedules          = 10
+	maxScheduleCycles     = 8
+	scheduleCheckInterval = 30 * time.Second
+	// a schedule due while the bot was down still fires when it comes back
+	// within the grace period
+	scheduleGracePeriod = 10 * time.Minute
+	cyclesContext       = "cycles"
+	tagContext          = "tag"
+)
+
+var (
+	reScheduleTime   = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):([0-5][0-9])$`)
+	reScheduleCycles = regexp.MustCompile(`^([0-9]+)x$`)
+)
+
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule plans focus blocks, either once on a date or every week on the
+// given weekdays. Times are in the time zone of the user.
+type Schedule struct {
+	Id       int64          `json:"id"`
+	Date     string         `json:"date,omitempty"`
+	Weekdays []time.Weekday `json:"weekdays,omitempty"`
+	At       string         `json:"at"`
+	Cycles   int            `json:"cycles"`
+	Mode     string         `json:"mode"`
+	Tag      string         `json:"tag,omitempty"`
+	// LastRun keeps a schedule from firing twice for the same occurrence
+	LastRun time.Time `json:"last_run"`
+}
+
+func (s Schedule) isOneOff() bool {
+	return s.Date != ""
+}
+
+func (s Schedule) runsOn(day time.Time) bool {
+	if s.isOneOff() {
+		return day.Format(dayLayout) == s.Date
+	}
+	for _, weekday := range s.Weekdays {
+		if day.Weekday() == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// occurrence returns when the schedule runs on the day of t.
+func (s Schedule) occurrence(t time.Time) time.Time {
+	m := reScheduleTime.FindStringSubmatch(s.At)
+	if m == nil {
+		return time.Time{}
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	return time.Date(t.Year(), t.Month(), t.Day(), hour, minute, 0, 0, t.Location())
+}
+
+// oneOffAt returns when a one-off schedule runs.
+func (s Schedule) oneOffAt(loc *time.Location) time.Time {
+	date, err := time.ParseInLocation(dayLayout, s.Date, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return s.occurrence(date)
+}
+
+// dueAt returns the occurrence the schedule has to fire for at now, the
+// zero time when nothing is due.
+func (s Schedule) dueAt(now time.Time) time.Time {
+	for _, day := range []time.Time{now, now.AddDate(0, 0, -1)} {
+		if !s.runsOn(day) {
+			continue
+		}
+		at := s.occurrence(day)
+		if !at.After(now) && now.Sub(at) <= scheduleGracePeriod && s.LastRun.Before(at) {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+func formatWeekdays(weekdays []time.Weekday) string {
+	switch len(weekdays) {
+	case 7:
+		return "Every day"
+	case 5:
+		if !containsWeekday(weekdays, time.Saturday) && !containsWeekday(weekdays, time.Sunday) {
+			return "Weekdays"
+		}
+	case 2:
+		if containsWeekday(weekdays, time.Saturday) && containsWeekday(weekdays, time.Sunday) {
+			return "Weekends"
+		}
+	}
+	names := make([]string, 0, len(weekdays))
+	for _, weekday := range weekdays {
+		names = append(names, weekday.String()[:3])
+	}
+	return strings.Join(names, ", ")
+}
+
+func containsWeekday(weekdays []time.Weekday, weekday time.Weekday) bool {
+	for _, w := range weekdays {
+		if w == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Schedule) String() string {
+	var b strings.Builder
+	if s.isOneOff() {
+		date, err := time.Parse(dayLayout, s.Date)
+		if err == nil {
+			b.WriteString(date.Format("Mon 2 Jan"))
+		} else {
+			b.WriteString(s.Date)
+		}
+	} else {
+		b.WriteString(formatWeekdays(s.Weekdays))
+	}
+	fmt.Fprintf(&b, " at %v", s.At)
+	if s.Cycles > 1 {
+		fmt.Fprintf(&b, ", %v cycles", s.Cycles)
+	}
+	if s.Tag != "" {
+		fmt.Fprintf(&b, ", %v", formatTag(s.Tag))
+	}
+	if s.Mode == SCHEDULE_MODE_AUTO {
+		b.WriteString(", starts automatically")
+	}
+	return b.String()
+}
+
+// parseScheduleArgs parses a rule like "weekdays 09:00 3 cycles auto
+// #deep". Days are daily, weekdays, weekends, day names like mon,wed,
+// today, tomorrow or a date, now is used for the relative days.
+func parseScheduleArgs(args []string, now time.Time) (Schedule, error) {
+	schedule := Schedule{Cycles: 1, Mode: SCHEDULE_MODE_PROMPT}
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		if tag, ok := parseTag(args[i]); ok {
+			schedule.Tag = tag
+			continue
+		}
+		if m := reScheduleTime.FindStringSubmatch(arg); m != nil {
+			hour, _ := strconv.Atoi(m[1])
+			schedule.At = fmt.Sprintf("%02d:%v", hour, m[2])
+			continue
+		}
+		if m := reScheduleCycles.FindStringSubmatch(arg); m != nil {
+			schedule.Cycles, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if cycles, err := strconv.Atoi(arg); err == nil {
+			schedule.Cycles = cycles
+			if i+1 < len(args) && strings.HasPrefix(strings.ToLower(args[i+1]), "cycle") {
+				i++
+			}
+			continue
+		}
+
+		switch arg {
+		case "auto":
+			schedule.Mode = SCHEDULE_MODE_AUTO
+		case "daily":
+			schedule.Weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+		case "weekdays":
+			schedule.Weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+		case "weekends":
+			schedule.Weekdays = []time.Weekday{time.Saturday, time.Sunday}
+		case "today":
+			schedule.Date = now.Format(dayLayout)
+		case "tomorrow":
+			schedule.Date = now.AddDate(0, 0, 1).Format(dayLayout)
+		default:
+			if date, err := time.ParseInLocation(dayLayout, arg, now.Location()); err == nil {
+				schedule.Date = date.Format(dayLayout)
+				continue
+			}
+			for _, name := range strings.Split(arg, ",") {
+				weekday, ok := scheduleWeekdays[strings.TrimSpace(name)]
+				if !ok || len(name) == 0 {
+					return Schedule{}, fmt.Errorf("unexpected argument [%v]", args[i])
+				}
+				if !containsWeekday(schedule.Weekdays, weekday) {
+					schedule.Weekdays = append(schedule.Weekdays, weekday)
+				}
+			}
+		}
+	}
+
+	switch {
+	case schedule.At == "":
+		return Schedule{}, fmt.Errorf("time is missing")
+	case schedule.Date == "" && len(schedule.Weekdays) == 0:
+		return Schedule{}, fmt.Errorf("days are missing")
+	case schedule.Date != "" && len(schedule.Weekdays) > 0:
+		return Schedule{}, fmt.Errorf("both a date and weekdays are given")
+	case schedule.Cycles < 1 || schedule.Cycles > maxScheduleCycles:
+		return Schedule{}, fmt.Errorf("cycles [%v] are out of range", schedule.Cycles)
+	}
+	if schedule.isOneOff() {
+		if !schedule.oneOffAt(now.Location()).After(now) {
+			return Schedule{}, fmt.Errorf("[%v %v] is in the past", schedule.Date, schedule.At)
+		}
+	}
+	sort.Slice(schedule.Weekdays, func(i, j int) bool {
+		return (schedule.Weekdays[i]+6)%7 < (schedule.Weekdays[j]+6)%7
+	})
+	// a schedule added after today's time waits for the next occurrence
+	schedule.LastRun = now
+	schedule.Id = now.UnixNano()
+	return schedule, nil
+}
+
+func scheduleUsage() string {
+	return fmt.Sprintf("Add a schedule with %v DAYS TIME [CYCLES] [auto] [#tag], e.g.\n"+
+		"%v weekdays 09:00 3 cycles\n%v mon,wed 14:30 auto #writing\n%v tomorrow 08:00\n"+
+		"Days are daily, weekdays, weekends, day names, today, tomorrow or a date like 2026-10-20. "+
+		"With auto the focus starts by itself, otherwise I ask first",
+		TTEXT_SCHEDULE_COMMAND, TTEXT_SCHEDULE_COMMAND, TTEXT_SCHEDULE_COMMAND, TTEXT_SCHEDULE_COMMAND)
+}
+
+// generateSchedulesResult lists the schedules with a button to cancel each.
+func generateSchedulesResult(user User, replyText string) MenuProcessorResult {
+	var b strings.Builder
+	if replyText != "" {
+		b.WriteString(replyText + "\n\n")
+	}
+	if len(user.Schedules) == 0 {
+		b.WriteString("You have no schedules yet. " + scheduleUsage())
+	} else {
+		fmt.Fprintf(&b, "Your schedules, times in %v:\n", user.location())
+	}
+	options := make([]string, 0, len(user.Schedules)+1)
+	for i, schedule := range user.Schedules {
+		fmt.Fprintf(&b, "%v. %v\n", i+1, schedule)
+		options = append(options, fmt.Sprintf("%v%v", TTEXT_CANCEL_SCHEDULE, i+1))
+	}
+	if len(user.Schedules) > 0 {
+		b.WriteString("\n" + scheduleUsage())
+	}
+	options = append(options, TTEXT_MAIN_MENU)
+	return MenuProcessorResult{
+		responseType:  RESPONSE_TYPE_KEYBOARD,
+		replyKeyboard: GenerateCustomKeyboard(options...),
+		replyText:     strings.TrimRight(b.String(), "\n"),
+		userAction:    UserAction{CurrentMenu: MENU_SCHEDULES},
+	}
+}
+
+// processScheduleCommand adds a schedule from the arguments of /schedule,
+// without arguments it opens the list.
+func processScheduleCommand(args []string, chatId ChatId, user User, env *environment) (MenuProcessorResult, error) {
+	if len(args) == 0 {
+		return generateSchedulesResult(user, ""), nil
+	}
+	if len(user.Schedules) >= maxSchedules {
+		return generateSchedulesResult(user, fmt.Sprintf("You can have up to %v schedules, cancel one first", maxSchedules)), nil
+	}
+	schedule, err := parseScheduleArgs(args, time.Now().In(user.location()))
+	if err != nil {
+		return MenuProcessorResult{
+			responseType: RESPONSE_TYPE_TEXT,
+			replyText:    fmt.Sprintf("Sorry, I didn't get that: %s\n\n%v", err, scheduleUsage()),
+			userAction:   user.LastAction,
+		}, nil
+	}
+	user.Schedules = append(user.Schedules, schedule)
+	err = env.users.updateUser(chatId, user)
+	if err != nil {
+		return MenuProcessorResult{}, err
+	}
+	return generateSchedulesResult(user, fmt.Sprintf("Scheduled: %v", schedule)), nil
+}
+
+func processSchedulesMenu(messageText string, chatId ChatId, user User, env *environment) (result MenuProcessorResult, err error) {
+	if messageText == TTEXT_MAIN_MENU {
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateMainKeyboard(),
+			replyText:     "Back to main menu",
+			userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+		}, nil
+	}
+	if !strings.HasPrefix(messageText, TTEXT_CANCEL_SCHEDULE) {
+		return generateSchedulesResult(user, "Sorry, I didn't get that. Please select one of the options below"), nil
+	}
+	index, convErr := strconv.Atoi(strings.TrimPrefix(messageText, TTEXT_CANCEL_SCHEDULE))
+	if convErr != nil || index < 1 || index > len(user.Schedules) {
+		return generateSchedulesResult(user, "This schedule doesn't exist anymore"), nil
+	}
+
+	cancelled := user.Schedules[index-1]
+	user.Schedules = append(append([]Schedule{}, user.Schedules[:index-1]...), user.Schedules[index:]...)
+	err = env.users.updateUser(chatId, user)
+	if err != nil {
+		return MenuProcessorResult{}, err
+	}
+	return generateSchedulesResult(user, fmt.Sprintf("Cancelled: %v", cancelled)), nil
+}
+
+// processSchedulePromptMenu answers the question sent when a schedule
+// without auto start is due.
+func processSchedulePromptMenu(messageText string, chatId ChatId, user User, env *environment) (result MenuProcessorResult, err error) {
+	switch messageText {
+	case TTEXT_START_SCHEDULED:
+		cycles, _ := strconv.Atoi(user.LastAction.Context[cyclesContext])
+		if cycles < 1 {
+			cycles = 1
+		}
+		return startFocus(chatId, user.FocusDurationMins, user.LastAction.Context[tagContext], cycles, env), nil
+	case TTEXT_SKIP:
+		return MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateMainKeyboard(),
+			replyText:     "Skipped, see you next time",
+			userAction:    UserAction{CurrentMenu: MENU_MAIN_MENU},
+		}, nil
+	}
+	return processMainMenu(messageText, user, chatId, env)
+}
+
+type dueSchedule struct {
+	chatId   ChatId
+	schedule Schedule
+}
+
+// runScheduler checks the schedules and idle nudges of all users and sends
+// the deferred messages that are due every interval until ctx is done.
+func (env *environment) runScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		env.fireDueSchedules(time.Now())
+		env.sendDueNudges(time.Now())
+		env.sendDeferredMessages(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fireDueSchedules marks the due schedules as run, drops fired one-off
+// schedules and then starts or offers the focus blocks.
+func (env *environment) fireDueSchedules(now time.Time) {
+	due := make([]dueSchedule, 0)
+	env.users.mut.Lock()
+	for chatId, user := range env.users.data {
+		if len(user.Schedules) == 0 {
+			continue
+		}
+		local := now.In(user.location())
+		kept := make([]Schedule, 0, len(user.Schedules))
+		changed := false
+		for _, schedule := range user.Schedules {
+			// a one-off schedule runs once or is dropped when it was missed
+			expired := schedule.isOneOff() && local.Sub(schedule.oneOffAt(local.Location())) > scheduleGracePeriod
+			if at := schedule.dueAt(local); !at.IsZero() {
+				schedule.LastRun = now
+				due = append(due, dueSchedule{chatId: chatId, schedule: schedule})
+				changed = true
+				expired = schedule.isOneOff()
+			}
+			if expired {
+				changed = true
+				continue
+			}
+			kept = append(kept, schedule)
+		}
+		if changed {
+			user.Schedules = kept
+			env.users.data[chatId] = user
+		}
+	}
+	env.users.mut.Unlock()
+
+	for _, d := range due {
+		env.persistUser(d.chatId)
+		env.runSchedule(d.chatId, d.schedule)
+	}
+}
+
+func (env *environment) runSchedule(chatId ChatId, schedule Schedule) {
+	user, ok := env.users.get(chatId)
+	if !ok {
+		return
+	}
+	logger.info("schedule is due", "chat_id", chatId, "schedule_id", schedule.Id, "mode", schedule.Mode)
+	scheduleRuns.inc(schedule.Mode)
+
+	if _, running := env.timeKeepers.get(chatId); running {
+		env.notify(OutgoingMessage{
+			ChatId: chatId,
+			Text:   fmt.Sprintf("Your planned focus at %v is skipped, a timer is already running", schedule.At),
+		})
+		return
+	}
+
+	var result MenuProcessorResult
+	if schedule.Mode == SCHEDULE_MODE_AUTO {
+		result = startFocus(chatId, user.FocusDurationMins, schedule.Tag, schedule.Cycles, env)
+		result.replyText = "Planned focus. " + result.replyText
+	} else {
+		text := fmt.Sprintf("It's %v, time for your planned focus", schedule.At)
+		if schedule.Cycles > 1 {
+			text += fmt.Sprintf(" of %v cycles", schedule.Cycles)
+		}
+		if schedule.Tag != "" {
+			text += " on " + formatTag(schedule.Tag)
+		}
+		result = MenuProcessorResult{
+			responseType:  RESPONSE_TYPE_KEYBOARD,
+			replyKeyboard: GenerateCustomKeyboard(TTEXT_START_SCHEDULED, TTEXT_SKIP),
+			replyText:     text + ". Ready?",
+			userAction: UserAction{
+				CurrentMenu: MENU_SCHEDULE_PROMPT,
+				Context:     map[string]string{cyclesContext: strconv.Itoa(schedule.Cycles), tagContext: schedule.Tag},
+			},
+		}
+	}
+	env.users.saveLastUserAction(chatId, result.userAction)
+	env.persistUser(chatId)
+	env.notify(OutgoingMessage{
+		ChatId:   chatId,
+		Text:     result.replyText,
+		Format:   FORMAT_HTML,
+		Keyboard: result.replyKeyboard,
+	})
+}
+
+// continueCycle starts the next session of a planned block when a timer of
+// the block finished.
+func (env *environment) continueCycle(chatId ChatId, user User, tk *TimeKeeper, finishText string) {
+	var msg OutgoingMessage
+	if tk.kind == SESSION_KIND_FOCUS {
+		env.startSession(chatId, SESSION_KIND_BREAK, user.BreakDurationMins, "", "Break is over, the next focus starts now", tk.cycle)
+		env.users.saveLastUserAction(chatId, UserAction{CurrentMenu: MENU_INBREAK})
+		msg = OutgoingMessage{
+			ChatId: chatId,
+			Text: fmt.Sprintf("%v\nYour break of %v minutes started, focus cycles left: %v",
+				finishText, user.BreakDurationMins, tk.cycle.CyclesLeft),
+			Keyboard: GenerateCustomKeyboard(TTEXT_TIME_LEFT_BREAK, TTEXT_STOP_BREAK),
+		}
+	} else {
+		next := focusCycle{CyclesLeft: tk.cycle.CyclesLeft - 1, Tag: tk.cycle.Tag}
+		env.startSession(chatId, SESSION_KIND_FOCUS, user.FocusDurationMins, next.Tag, "The focus session ended, you can rest now!", next)
+		env.users.saveLastUserAction(chatId, UserAction{CurrentMenu: MENU_INFOCUS})
+		text := fmt.Sprintf("%v\nFocus for %v minutes", finishText, user.FocusDurationMins)
+		if next.Tag != "" {
+			text += " on " + formatTag(next.Tag)
+		}
+		if next.CyclesLeft == 0 {
+			text += ", this is the last cycle"
+		}
+		msg = OutgoingMessage{
+			ChatId:   chatId,
+			Text:     text,
+			Keyboard: GenerateFocusKeyboard(),
+		}
+	}
+	env.persistUser(chatId)
+	env.notify(msg)
+}
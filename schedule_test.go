@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleArgs(t *testing.T) {
+	// testDay is a Monday at 09:00 UTC
+	now := testDay
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	tests := []struct {
+		args     string
+		schedule Schedule
+		err      string
+	}{
+		{"weekdays 09:00 3 cycles", Schedule{Weekdays: weekdays, At: "09:00", Cycles: 3, Mode: SCHEDULE_MODE_PROMPT}, ""},
+		{"mon,wed 14:30 auto #Writing", Schedule{Weekdays: []time.Weekday{time.Monday, time.Wednesday}, At: "14:30", Cycles: 1,
+			Mode: SCHEDULE_MODE_AUTO, Tag: "writing"}, ""},
+		{"wed,mon 9:05 2x", Schedule{Weekdays: []time.Weekday{time.Monday, time.Wednesday}, At: "09:05", Cycles: 2,
+			Mode: SCHEDULE_MODE_PROMPT}, ""},
+		{"tomorrow 08:00", Schedule{Date: "2026-03-03", At: "08:00", Cycles: 1, Mode: SCHEDULE_MODE_PROMPT}, ""},
+		{"today 10:00", Schedule{Date: "2026-03-02", At: "10:00", Cycles: 1, Mode: SCHEDULE_MODE_PROMPT}, ""},
+		{"today 08:00", Schedule{}, "in the past"},
+		{"2026-03-01 10:00", Schedule{}, "in the past"},
+		{"weekdays", Schedule{}, "time is missing"},
+		{"10:00", Schedule{}, "days are missing"},
+		{"tomorrow mon 10:00", Schedule{}, "both a date and weekdays"},
+		{"daily 10:00 9 cycles", Schedule{}, "out of range"},
+		{"fortnightly 10:00", Schedule{}, "unexpected argument"},
+	}
+	for _, test := range tests {
+		schedule, err := parseScheduleArgs(strings.Fields(test.args), now)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: expected an error with %q, got %v", test.args, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.args, err)
+			continue
+		}
+		test.schedule.Id = now.UnixNano()
+		test.schedule.LastRun = now
+		if !reflect.DeepEqual(schedule, test.schedule) {
+			t.Errorf("%v: expected %+v, got %+v", test.args, test.schedule, schedule)
+		}
+	}
+}
+
+func TestScheduleDueAt(t *testing.T) {
+	monday := Schedule{Weekdays: []time.Weekday{time.Monday}, At: "09:00", LastRun: testDay.AddDate(0, 0, -7)}
+	oneOff := Schedule{Date: "2026-03-02", At: "09:00", LastRun: testDay.AddDate(0, 0, -1)}
+	ran := monday
+	ran.LastRun = testDay
+	lateNight := Schedule{Weekdays: []time.Weekday{time.Monday}, At: "23:55", LastRun: testDay}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		due      time.Time
+	}{
+		{"on time", monday, testDay, testDay},
+		{"inside the grace period", monday, testDay.Add(scheduleGracePeriod), testDay},
+		{"outside the grace period", monday, testDay.Add(scheduleGracePeriod + time.Minute), time.Time{}},
+		{"too early", monday, testDay.Add(-time.Minute), time.Time{}},
+		{"another weekday", monday, testDay.AddDate(0, 0, 1), time.Time{}},
+		{"next week", monday, testDay.AddDate(0, 0, 7), testDay.AddDate(0, 0, 7)},
+		{"already ran", ran, testDay.Add(time.Minute), time.Time{}},
+		{"one-off", oneOff, testDay.Add(time.Minute), testDay},
+		{"one-off on another day", oneOff, testDay.AddDate(0, 0, 7), time.Time{}},
+		{"due before midnight", lateNight, testDay.Add(15*time.Hour + 2*time.Minute), testDay.Add(14*time.Hour + 55*time.Minute)},
+	}
+	for _, test := range tests {
+		if due := test.schedule.dueAt(test.now); !due.Equal(test.due) {
+			t.Errorf("%v: expected due at %v, got %v", test.name, test.due, due)
+		}
+	}
+}
+
+func TestScheduleAddedAfterTodaysTimeWaitsForTomorrow(t *testing.T) {
+	added := testDay.Add(-55 * time.Minute)
+	schedule, err := parseScheduleArgs([]string{"daily", "08:00"}, added)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if due := schedule.dueAt(added.Add(time.Minute)); !due.IsZero() {
+		t.Fatalf("a schedule added at 08:05 fires for 08:00 of the same day")
+	}
+	tomorrow := testDay.AddDate(0, 0, 1).Add(-time.Hour)
+	if due := schedule.dueAt(tomorrow); !due.Equal(tomorrow) {
+		t.Fatalf("expected the schedule due at %v, got %v", tomorrow, due)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	SESSION_STATUS_RUNNING   = "running"
+	SESSION_STATUS_COMPLETED = "completed"
+	SESSION_STATUS_CANCELLED = "cancelled"
+)
+
+const sessionIdContext = "session_id"
+
+// Session is a single focus or break, it is stored when it starts and
+// updated when it ends.
+type Session struct {
+	Id          int64     `json:"id"`
+	ChatId      ChatId    `json:"chat_id"`
+	Kind        string    `json:"kind"`
+	Status      string    `json:"status"`
+	PlannedMins int       `json:"planned_minutes"`
+	StartedAt   time.Time `json:"started_at"`
+	EndedAt     time.Time `json:"ended_at"`
+	Tag         string    `json:"tag,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	Rating      int       `json:"rating,omitempty"`
+	// StopReason is asked for when a focus is stopped early
+	StopReason    string         `json:"stop_reason,omitempty"`
+	Interruptions []Interruption `json:"interruptions,omitempty"`
+	// GroupId is set on sessions shared in a group chat, the group keeps
+	// the list of participants and every participant a copy of their own
+	GroupId      ChatId        `json:"group_id,omitempty"`
+	Participants []Participant `json:"participants,omitempty"`
+}
+
+func (s *Session) duration() time.Duration {
+	if s.EndedAt.IsZero() {
+		return time.Since(s.StartedAt)
+	}
+	return s.EndedAt.Sub(s.StartedAt)
+}
+
+// startSession records a new session and starts its timekeeper.
+func (env *environment) startSession(chatId ChatId, kind string, durationMins int, tag string, finishMessage string, cycle focusCycle) *TimeKeeper {
+	now := time.Now()
+	session := Session{
+		Id:          now.UnixNano(),
+		ChatId:      chatId,
+		Kind:        kind,
+		Status:      SESSION_STATUS_RUNNING,
+		PlannedMins: durationMins,
+		StartedAt:   now,
+		Tag:         tag,
+	}
+	err := env.db.saveSession(session)
+	if err != nil {
+		logger.error("failed to save session", "chat_id", chatId, "kind", kind, "err", err)
+	}
+
+	tk := startTimeKeeper(chatId, session.Id, kind, durationMins, finishMessage, cycle, env.onTimekeepStopped)
+	env.timeKeepers.add(chatId, tk)
+	if kind == SESSION_KIND_FOCUS {
+		env.users.recordFocus(chatId, now.Add(time.Duration(durationMins)*time.Minute))
+		env.notifyPartners(chatId, fmt.Sprintf("%v %v started focusing for %v minutes", EMOJI_SEEDLING, env.userName(chatId), durationMins))
+	}
+	return tk
+}
+
+// finishSession forgets the timekeeper and stores how its session ended.
+func (env *environment) finishSession(chatId ChatId, tk *TimeKeeper, status string) {
+	env.timeKeepers.remove(chatId)
+
+	session, err := env.db.getSession(chatId, tk.sessionId)
+	if err != nil {
+		logger.error("failed to load session", "chat_id", chatId, "session_id", tk.sessionId, "err", err)
+		return
+	}
+	session.Status = status
+	session.EndedAt = time.Now()
+	// a timer resumed after downtime fires late, the session still lasted
+	// as long as it was planned
+	plannedEnd := session.StartedAt.Add(time.Duration(session.PlannedMins) * time.Minute)
+	if status == SESSION_STATUS_COMPLETED && session.EndedAt.After(plannedEnd) {
+		session.EndedAt = plannedEnd
+	}
+	err = env.db.saveSession(session)
+	if err != nil {
+		logger.error("failed to save session", "chat_id", chatId, "session_id", tk.sessionId, "err", err)
+	}
+	if session.Kind == SESSION_KIND_FOCUS {
+		env.users.recordFocus(chatId, session.EndedAt)
+	}
+}
+
+// updateSession applies fn to the stored session and saves it.
+func (env *environment) updateSession(chatId ChatId, sessionId int64, fn func(session *Session)) error {
+	session, err := env.db.getSession(chatId, sessionId)
+	if err != nil {
+		return err
+	}
+	fn(&session)
+	return env.db.saveSession(session)
+}
+
+// sessionAction keeps the id of the session in the action context while
+// the user answers questions about it.
+func sessionAction(menu int, sessionId int64) UserAction {
+	return UserAction{
+		CurrentMenu: menu,
+		Context:     map[string]string{sessionIdContext: strconv.FormatInt(sessionId, 10)},
+	}
+}
+
+func contextSessionId(user User) (int64, error) {
+	value, err := user.getActionContextField(sessionIdContext)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
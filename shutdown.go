@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const lastShutdownMetaKey = "last_shutdown_at"
+
+// resumeTimeKeepers restarts the timers that were running when the bot
+// was stopped.
+func (env *environment) resumeTimeKeepers() {
+	lastShutdown, err := env.db.getMeta(lastShutdownMetaKey)
+	if err == nil && lastShutdown != "" {
+		logger.info("previous run was shut down gracefully", "last_shutdown_at", lastShutdown)
+	}
+
+	timers, err := env.db.getAllTimers()
+	if err != nil {
+		logger.error("failed to load timers", "err", err)
+		return
+	}
+	for chatId, state := range timers {
+		logger.info("resuming timekeeper", "chat_id", chatId, "kind", state.Kind, "ends_at", state.EndsAt)
+		callback := env.onTimekeepStopped
+		if isGroupChatId(chatId) {
+			callback = env.onGroupTimekeepStopped
+		}
+		env.timeKeepers.add(chatId, resumeTimeKeeper(chatId, state, callback))
+	}
+
+	err = env.db.saveTimers(nil)
+	if err != nil {
+		logger.error("failed to clear timers", "err", err)
+	}
+}
+
+// shutdown stops the background loops, persists the running timers and
+// every user, delivers whatever is still queued and closes the database.
+// The messenger must already be stopped so no new work arrives.
+func (env *environment) shutdown(ctx context.Context) {
+	env.stopBackground()
+	stopped := make(chan struct{})
+	go func() {
+		env.background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		logger.info("background tasks stopped")
+	case <-ctx.Done():
+		logger.error("background tasks did not stop in time", "err", ctx.Err())
+	}
+
+	timers := env.timeKeepers.stopAll()
+	err := env.db.saveTimers(timers)
+	if err != nil {
+		logger.error("failed to persist timers", "err", err)
+	} else {
+		logger.info("timers persisted", "count", len(timers))
+	}
+
+	env.users.mut.Lock()
+	for chatId, user := range env.users.data {
+		err := env.db.saveUserData(chatId, user)
+		if err != nil {
+			logger.error("failed to persist user", "chat_id", chatId, "err", err)
+		}
+	}
+	env.users.mut.Unlock()
+
+	err = env.queue.flush(ctx)
+	if err != nil {
+		logger.error("failed to flush outgoing messages", "err", err)
+	} else {
+		logger.info("outgoing messages flushed")
+	}
+
+	err = env.db.setMeta(lastShutdownMetaKey, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		logger.error("failed to save shutdown time", "err", err)
+	}
+	env.db.closeDB()
+	logger.info("database closed")
+}
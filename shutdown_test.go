@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShutdownStopsBackgroundTasks(t *testing.T) {
+	env := createEnvironment(&testMessenger{}, newMemoryStorage())
+	stopped := false
+	env.goBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		stopped = true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	env.shutdown(ctx)
+	if !stopped {
+		t.Fatalf("shutdown returned before the background task stopped")
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("shutdown waited for the timeout: %v", ctx.Err())
+	}
+}
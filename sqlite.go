@@ -0,0 +1,690 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+	_ "modernc.org/sqlite"
+)
+
+const defaultSqliteFilePath = dataFolderPath + "/horae.sqlite"
+
+// Timestamps are stored in UTC with a fixed width so they sort as text and
+// are understood by the SQLite date and time functions.
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000000"
+
+// sqliteMigrations are applied in order, PRAGMA user_version holds the
+// number of applied ones. The full records are kept as JSON in the data
+// columns, the other columns are there to make the history easy to query.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		chat_id        INTEGER PRIMARY KEY,
+		first_name     TEXT NOT NULL,
+		focus_duration INTEGER NOT NULL,
+		break_duration INTEGER NOT NULL,
+		data           TEXT NOT NULL
+	);
+	CREATE TABLE timers (
+		chat_id INTEGER PRIMARY KEY,
+		data    TEXT NOT NULL
+	);
+	CREATE TABLE sessions (
+		chat_id         INTEGER NOT NULL,
+		id              INTEGER NOT NULL,
+		kind            TEXT NOT NULL,
+		status          TEXT NOT NULL,
+		planned_minutes INTEGER NOT NULL,
+		started_at      TEXT NOT NULL,
+		ended_at        TEXT,
+		duration_secs   INTEGER,
+		data            TEXT NOT NULL,
+		PRIMARY KEY (chat_id, id)
+	);
+	CREATE TABLE meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	`ALTER TABLE sessions ADD COLUMN tag TEXT;
+	CREATE INDEX sessions_chat_tag ON sessions (chat_id, tag);`,
+	`ALTER TABLE sessions ADD COLUMN note TEXT;
+	ALTER TABLE sessions ADD COLUMN rating INTEGER;`,
+	`ALTER TABLE sessions ADD COLUMN interruptions INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE sessions ADD COLUMN stop_reason TEXT;`,
+	`ALTER TABLE sessions ADD COLUMN group_id INTEGER;
+	CREATE INDEX sessions_group ON sessions (group_id);`,
+	`CREATE TABLE partners (
+		chat_a INTEGER NOT NULL,
+		chat_b INTEGER NOT NULL,
+		since  TEXT NOT NULL,
+		data   TEXT NOT NULL,
+		PRIMARY KEY (chat_a, chat_b)
+	);
+	CREATE INDEX partners_chat_b ON partners (chat_b);`,
+	`CREATE TABLE deferred (
+		chat_id INTEGER NOT NULL,
+		id      INTEGER NOT NULL,
+		send_at TEXT NOT NULL,
+		data    TEXT NOT NULL,
+		PRIMARY KEY (chat_id, id)
+	);
+	CREATE INDEX deferred_send_at ON deferred (send_at);`,
+	`CREATE TABLE leaderboard_opt_outs (
+		group_id INTEGER NOT NULL,
+		user_id  INTEGER NOT NULL,
+		PRIMARY KEY (group_id, user_id)
+	);
+	CREATE INDEX leaderboard_opt_outs_user ON leaderboard_opt_outs (user_id);
+	INSERT OR IGNORE INTO leaderboard_opt_outs (group_id, user_id)
+		SELECT CAST(substr(meta.key, 21) AS INTEGER), json_each.value FROM meta, json_each(meta.value)
+		WHERE meta.key LIKE 'leaderboard\_opt\_out\_%' ESCAPE '\';
+	DELETE FROM meta WHERE key LIKE 'leaderboard\_opt\_out\_%' ESCAPE '\';`,
+}
+
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+func openSqliteStorage(path string) (*sqliteStorage, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serialises writers the same way bbolt does
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStorage{db: db}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStorage) migrate() error {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("sqlite schema version %v is newer than the latest known version %v", version, len(sqliteMigrations))
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		err = s.transaction("migrate", func(tx *sql.Tx) error {
+			_, err := tx.Exec(sqliteMigrations[i])
+			if err != nil {
+				return err
+			}
+			// PRAGMA doesn't take parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("sqlite migration %v: %s", i+1, err)
+		}
+		logger.info("sqlite migration applied", "schema_version", i+1)
+	}
+	return nil
+}
+
+// transaction runs fn in a transaction and records its duration.
+func (s *sqliteStorage) transaction(operation string, fn func(tx *sql.Tx) error) error {
+	defer dbTransactionDuration.observeSince(time.Now(), operation)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func formatSqliteTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func nullableString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func nullableInt(value int) interface{} {
+	if value == 0 {
+		return nil
+	}
+	return value
+}
+
+func (s *sqliteStorage) saveUserData(chatId ChatId, user User) error {
+	return s.transaction("save_user", func(tx *sql.Tx) error {
+		return saveSqliteUser(tx, chatId, user)
+	})
+}
+
+func saveSqliteUser(tx *sql.Tx, chatId ChatId, user User) error {
+	jsonBuf, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("marshal user: %s", err)
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO users (chat_id, first_name, focus_duration, break_duration, data)
+		VALUES (?, ?, ?, ?, ?)`, int64(chatId), user.FirstName, user.FocusDurationMins, user.BreakDurationMins, string(jsonBuf))
+	if err != nil {
+		return fmt.Errorf("save user data: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) getAllUsersData() (map[ChatId]User, error) {
+	users := make(map[ChatId]User)
+	err := s.transaction("get_all_users", func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT chat_id, data FROM users")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var chatId int64
+			var data string
+			err = rows.Scan(&chatId, &data)
+			if err != nil {
+				return err
+			}
+			var user User
+			err = json.Unmarshal([]byte(data), &user)
+			if err != nil {
+				return fmt.Errorf("unmarshal user: %s", err)
+			}
+			users[ChatId(chatId)] = user
+		}
+		return rows.Err()
+	})
+	return users, err
+}
+
+func (s *sqliteStorage) deleteUserData(chatId ChatId) error {
+	return s.transaction("delete_user", func(tx *sql.Tx) error {
+		err := removeSqliteParticipant(tx, chatId)
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"users", "timers", "sessions", "deferred"} {
+			_, err := tx.Exec("DELETE FROM "+table+" WHERE chat_id = ?", int64(chatId))
+			if err != nil {
+				return fmt.Errorf("delete from %v: %s", table, err)
+			}
+		}
+		_, err = tx.Exec("DELETE FROM partners WHERE chat_a = ? OR chat_b = ?", int64(chatId), int64(chatId))
+		if err != nil {
+			return fmt.Errorf("delete from partners: %s", err)
+		}
+		_, err = tx.Exec("DELETE FROM leaderboard_opt_outs WHERE group_id = ? OR user_id = ?", int64(chatId), int64(chatId))
+		if err != nil {
+			return fmt.Errorf("delete from leaderboard_opt_outs: %s", err)
+		}
+		return nil
+	})
+}
+
+// removeSqliteParticipant drops the user from the participants of the
+// group sessions their own sessions point to.
+func removeSqliteParticipant(tx *sql.Tx, chatId ChatId) error {
+	rows, err := tx.Query(`SELECT data FROM sessions WHERE chat_id IN
+		(SELECT DISTINCT group_id FROM sessions WHERE chat_id = ? AND group_id IS NOT NULL)`, int64(chatId))
+	if err != nil {
+		return fmt.Errorf("get group sessions: %s", err)
+	}
+	changed := make([]Session, 0)
+	for rows.Next() {
+		var data string
+		err = rows.Scan(&data)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		var session Session
+		err = json.Unmarshal([]byte(data), &session)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("unmarshal group session: %s", err)
+		}
+		if session.removeParticipant(int64(chatId)) {
+			changed = append(changed, session)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, session := range changed {
+		err = saveSqliteSession(tx, session)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStorage) saveTimers(timers map[ChatId]TimeKeeperState) error {
+	return s.transaction("save_timers", func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM timers")
+		if err != nil {
+			return err
+		}
+		for chatId, state := range timers {
+			err = saveSqliteTimer(tx, chatId, state)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func saveSqliteTimer(tx *sql.Tx, chatId ChatId, state TimeKeeperState) error {
+	jsonBuf, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal timer: %s", err)
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO timers (chat_id, data) VALUES (?, ?)", int64(chatId), string(jsonBuf))
+	if err != nil {
+		return fmt.Errorf("save timer: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) getAllTimers() (map[ChatId]TimeKeeperState, error) {
+	timers := make(map[ChatId]TimeKeeperState)
+	err := s.transaction("get_all_timers", func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT chat_id, data FROM timers")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var chatId int64
+			var data string
+			err = rows.Scan(&chatId, &data)
+			if err != nil {
+				return err
+			}
+			var state TimeKeeperState
+			err = json.Unmarshal([]byte(data), &state)
+			if err != nil {
+				return fmt.Errorf("unmarshal timer: %s", err)
+			}
+			timers[ChatId(chatId)] = state
+		}
+		return rows.Err()
+	})
+	return timers, err
+}
+
+func (s *sqliteStorage) saveSession(session Session) error {
+	return s.transaction("save_session", func(tx *sql.Tx) error {
+		return saveSqliteSession(tx, session)
+	})
+}
+
+func saveSqliteSession(tx *sql.Tx, session Session) error {
+	jsonBuf, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("marshal session: %s", err)
+	}
+	var durationSecs interface{}
+	if !session.EndedAt.IsZero() {
+		durationSecs = int64(session.duration().Seconds())
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO sessions
+		(chat_id, id, kind, status, planned_minutes, started_at, ended_at, duration_secs, tag, note, rating, interruptions, stop_reason, group_id, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		int64(session.ChatId), session.Id, session.Kind, session.Status, session.PlannedMins,
+		formatSqliteTime(session.StartedAt), formatSqliteTime(session.EndedAt), durationSecs,
+		nullableString(session.Tag), nullableString(session.Note), nullableInt(session.Rating),
+		len(session.Interruptions), nullableString(session.StopReason), nullableInt(int(session.GroupId)), string(jsonBuf))
+	if err != nil {
+		return fmt.Errorf("save session: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) getSession(chatId ChatId, sessionId int64) (Session, error) {
+	var session Session
+	var data string
+	err := s.db.QueryRow("SELECT data FROM sessions WHERE chat_id = ? AND id = ?", int64(chatId), sessionId).Scan(&data)
+	if err == sql.ErrNoRows {
+		return session, fmt.Errorf("session [%v] of chat id [%v] not found", sessionId, chatId)
+	}
+	if err != nil {
+		return session, err
+	}
+	err = json.Unmarshal([]byte(data), &session)
+	return session, err
+}
+
+func (s *sqliteStorage) getSessions(chatId ChatId, from time.Time, to time.Time) ([]Session, error) {
+	sessions := make([]Session, 0)
+	query := "SELECT data FROM sessions WHERE chat_id = ?"
+	args := []interface{}{int64(chatId)}
+	if !from.IsZero() {
+		query += " AND id >= ?"
+		args = append(args, from.UnixNano())
+	}
+	if !to.IsZero() {
+		query += " AND id < ?"
+		args = append(args, to.UnixNano())
+	}
+	query += " ORDER BY id"
+
+	err := s.transaction("get_sessions", func(tx *sql.Tx) error {
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var data string
+			err = rows.Scan(&data)
+			if err != nil {
+				return err
+			}
+			var session Session
+			err = json.Unmarshal([]byte(data), &session)
+			if err != nil {
+				return fmt.Errorf("unmarshal session: %s", err)
+			}
+			sessions = append(sessions, session)
+		}
+		return rows.Err()
+	})
+	return sessions, err
+}
+
+func (s *sqliteStorage) savePartnership(partnership Partnership) error {
+	return s.transaction("save_partnership", func(tx *sql.Tx) error {
+		return saveSqlitePartnership(tx, partnership)
+	})
+}
+
+func saveSqlitePartnership(tx *sql.Tx, partnership Partnership) error {
+	jsonBuf, err := json.Marshal(partnership)
+	if err != nil {
+		return fmt.Errorf("marshal partnership: %s", err)
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO partners (chat_a, chat_b, since, data) VALUES (?, ?, ?, ?)",
+		int64(partnership.A), int64(partnership.B), formatSqliteTime(partnership.Since), string(jsonBuf))
+	if err != nil {
+		return fmt.Errorf("save partnership: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) deletePartnership(partnership Partnership) error {
+	return s.transaction("delete_partnership", func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM partners WHERE chat_a = ? AND chat_b = ?", int64(partnership.A), int64(partnership.B))
+		return err
+	})
+}
+
+func (s *sqliteStorage) getPartnerships(chatId ChatId) ([]Partnership, error) {
+	partnerships := make([]Partnership, 0)
+	err := s.transaction("get_partnerships", func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT data FROM partners WHERE chat_a = ? OR chat_b = ? ORDER BY since", int64(chatId), int64(chatId))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var data string
+			err = rows.Scan(&data)
+			if err != nil {
+				return err
+			}
+			var partnership Partnership
+			err = json.Unmarshal([]byte(data), &partnership)
+			if err != nil {
+				return fmt.Errorf("unmarshal partnership: %s", err)
+			}
+			partnerships = append(partnerships, partnership)
+		}
+		return rows.Err()
+	})
+	return partnerships, err
+}
+
+func (s *sqliteStorage) saveDeferredMessage(msg DeferredMessage) error {
+	return s.transaction("save_deferred_message", func(tx *sql.Tx) error {
+		return saveSqliteDeferredMessage(tx, msg)
+	})
+}
+
+func saveSqliteDeferredMessage(tx *sql.Tx, msg DeferredMessage) error {
+	jsonBuf, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal deferred message: %s", err)
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO deferred (chat_id, id, send_at, data) VALUES (?, ?, ?, ?)",
+		int64(msg.Message.ChatId), msg.Id, formatSqliteTime(msg.SendAt), string(jsonBuf))
+	if err != nil {
+		return fmt.Errorf("save deferred message: %s", err)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) deleteDeferredMessage(msg DeferredMessage) error {
+	return s.transaction("delete_deferred_message", func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM deferred WHERE chat_id = ? AND id = ?", int64(msg.Message.ChatId), msg.Id)
+		return err
+	})
+}
+
+func (s *sqliteStorage) getDeferredMessages(until time.Time) ([]DeferredMessage, error) {
+	messages := make([]DeferredMessage, 0)
+	err := s.transaction("get_deferred_messages", func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT data FROM deferred WHERE send_at <= ? ORDER BY send_at, chat_id, id", formatSqliteTime(until))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var data string
+			err = rows.Scan(&data)
+			if err != nil {
+				return err
+			}
+			var msg DeferredMessage
+			err = json.Unmarshal([]byte(data), &msg)
+			if err != nil {
+				return fmt.Errorf("unmarshal deferred message: %s", err)
+			}
+			messages = append(messages, msg)
+		}
+		return rows.Err()
+	})
+	return messages, err
+}
+
+func (s *sqliteStorage) setLeaderboardOptOut(groupId ChatId, userId int64, optOut bool) error {
+	return s.transaction("set_leaderboard_opt_out", func(tx *sql.Tx) error {
+		query := "DELETE FROM leaderboard_opt_outs WHERE group_id = ? AND user_id = ?"
+		if optOut {
+			query = "INSERT OR IGNORE INTO leaderboard_opt_outs (group_id, user_id) VALUES (?, ?)"
+		}
+		_, err := tx.Exec(query, int64(groupId), userId)
+		return err
+	})
+}
+
+func (s *sqliteStorage) getLeaderboardOptOuts(groupId ChatId) (map[int64]bool, error) {
+	optOuts := make(map[int64]bool)
+	err := s.transaction("get_leaderboard_opt_outs", func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT user_id FROM leaderboard_opt_outs WHERE group_id = ?", int64(groupId))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var userId int64
+			err = rows.Scan(&userId)
+			if err != nil {
+				return err
+			}
+			optOuts[userId] = true
+		}
+		return rows.Err()
+	})
+	return optOuts, err
+}
+
+func (s *sqliteStorage) getMeta(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow("SELECT value FROM meta WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (s *sqliteStorage) setMeta(key string, value string) error {
+	return s.transaction("set_meta", func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)", key, value)
+		return err
+	})
+}
+
+func (s *sqliteStorage) checkOpen() error {
+	return s.db.Ping()
+}
+
+func (s *sqliteStorage) checkReadable() error {
+	var count int
+	return s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+}
+
+func (s *sqliteStorage) closeDB() {
+	s.db.Close()
+}
+
+type bboltToSqliteStats struct {
+	users    int
+	timers   int
+	sessions int
+	partners int
+	deferred int
+	optOuts  int
+	meta     int
+}
+
+// copyBboltToSqlite copies every record of the bbolt database into SQLite
+// in a single transaction. Existing rows with the same keys are replaced,
+// so running it twice is harmless.
+func copyBboltToSqlite(from *hDataBase, to *sqliteStorage) (stats bboltToSqliteStats, err error) {
+	err = from.view("copy_to_sqlite", func(btx *bbolt.Tx) error {
+		return to.transaction("copy_from_bbolt", func(tx *sql.Tx) error {
+			err := btx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+				var user User
+				err := json.Unmarshal(v, &user)
+				if err != nil {
+					return fmt.Errorf("unmarshal user: %s", err)
+				}
+				stats.users++
+				return saveSqliteUser(tx, ChatId(btoi(k)), user)
+			})
+			if err != nil {
+				return err
+			}
+
+			err = btx.Bucket([]byte("timers")).ForEach(func(k, v []byte) error {
+				var state TimeKeeperState
+				err := json.Unmarshal(v, &state)
+				if err != nil {
+					return fmt.Errorf("unmarshal timer: %s", err)
+				}
+				stats.timers++
+				return saveSqliteTimer(tx, ChatId(btoi(k)), state)
+			})
+			if err != nil {
+				return err
+			}
+
+			sessions := btx.Bucket([]byte("sessions"))
+			err = sessions.ForEach(func(chatKey, _ []byte) error {
+				return sessions.Bucket(chatKey).ForEach(func(_, v []byte) error {
+					var session Session
+					err := json.Unmarshal(v, &session)
+					if err != nil {
+						return fmt.Errorf("unmarshal session: %s", err)
+					}
+					stats.sessions++
+					return saveSqliteSession(tx, session)
+				})
+			})
+			if err != nil {
+				return err
+			}
+
+			err = btx.Bucket([]byte("partners")).ForEach(func(_, v []byte) error {
+				var partnership Partnership
+				err := json.Unmarshal(v, &partnership)
+				if err != nil {
+					return fmt.Errorf("unmarshal partnership: %s", err)
+				}
+				stats.partners++
+				return saveSqlitePartnership(tx, partnership)
+			})
+			if err != nil {
+				return err
+			}
+
+			err = btx.Bucket([]byte("deferred")).ForEach(func(_, v []byte) error {
+				var msg DeferredMessage
+				err := json.Unmarshal(v, &msg)
+				if err != nil {
+					return fmt.Errorf("unmarshal deferred message: %s", err)
+				}
+				stats.deferred++
+				return saveSqliteDeferredMessage(tx, msg)
+			})
+			if err != nil {
+				return err
+			}
+
+			err = btx.Bucket([]byte(optOutsBucketName)).ForEach(func(k, _ []byte) error {
+				stats.optOuts++
+				_, err := tx.Exec("INSERT OR IGNORE INTO leaderboard_opt_outs (group_id, user_id) VALUES (?, ?)", btoi(k[:8]), btoi(k[8:]))
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			return btx.Bucket([]byte(metaBucketName)).ForEach(func(k, v []byte) error {
+				// the bbolt schema version means nothing to SQLite
+				if string(k) == schemaVersionKey {
+					return nil
+				}
+				stats.meta++
+				_, err := tx.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)", string(k), string(v))
+				return err
+			})
+		})
+	})
+	return stats, err
+}
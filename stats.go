@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const statsWeekDays = 7
+
+type tagTotal struct {
+	tag      string
+	duration time.Duration
+	sessions int
+}
+
+// focusStats sums up focus time, cancelled sessions count with the time
+// actually spent.
+type focusStats struct {
+	today      time.Duration
+	week       time.Duration
+	total      time.Duration
+	sessions   int
+	weekByTag  []tagTotal
+	totalByTag []tagTotal
+	// interruptions of the last days by kind
+	weekInterruptions map[string]int
+	stopReasons       []reasonCount
+}
+
+type reasonCount struct {
+	reason string
+	count  int
+}
+
+// topStopReasons counts the reasons, the same reason typed in a different
+// case counts as one.
+func topStopReasons(reasons map[string]*reasonCount, limit int) []reasonCount {
+	result := make([]reasonCount, 0, len(reasons))
+	for _, r := range reasons {
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].count != result[j].count {
+			return result[i].count > result[j].count
+		}
+		return result[i].reason < result[j].reason
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+func sumByTag(totals map[string]*tagTotal) []tagTotal {
+	result := make([]tagTotal, 0, len(totals))
+	for _, total := range totals {
+		result = append(result, *total)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].duration != result[j].duration {
+			return result[i].duration > result[j].duration
+		}
+		return result[i].tag < result[j].tag
+	})
+	return result
+}
+
+func addTagTotal(totals map[string]*tagTotal, tag string, duration time.Duration) {
+	total, ok := totals[tag]
+	if !ok {
+		total = &tagTotal{tag: tag}
+		totals[tag] = total
+	}
+	total.duration += duration
+	total.sessions++
+}
+
+func calculateFocusStats(sessions []Session, now time.Time) focusStats {
+	var stats focusStats
+	today := startOfDay(now)
+	weekStart := today.AddDate(0, 0, -(statsWeekDays - 1))
+	weekByTag := make(map[string]*tagTotal)
+	totalByTag := make(map[string]*tagTotal)
+	reasons := make(map[string]*reasonCount)
+	stats.weekInterruptions = make(map[string]int)
+	for _, s := range sessions {
+		if s.Kind != SESSION_KIND_FOCUS {
+			continue
+		}
+		duration := s.duration()
+		stats.total += duration
+		stats.sessions++
+		addTagTotal(totalByTag, s.Tag, duration)
+		if !s.StartedAt.Before(weekStart) {
+			stats.week += duration
+			addTagTotal(weekByTag, s.Tag, duration)
+			for _, interruption := range s.Interruptions {
+				stats.weekInterruptions[interruption.Kind]++
+			}
+		}
+		if s.StopReason != "" {
+			key := strings.ToLower(s.StopReason)
+			if _, ok := reasons[key]; !ok {
+				reasons[key] = &reasonCount{reason: s.StopReason}
+			}
+			reasons[key].count++
+		}
+		if !s.StartedAt.Before(today) {
+			stats.today += duration
+		}
+	}
+	stats.weekByTag = sumByTag(weekByTag)
+	stats.totalByTag = sumByTag(totalByTag)
+	stats.stopReasons = topStopReasons(reasons, commonStopReasons)
+	return stats
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	hours := int(d.Hours())
+	minutes := int(d.Minutes()) % 60
+	switch {
+	case hours == 0:
+		return fmt.Sprintf("%vm", minutes)
+	case minutes == 0:
+		return fmt.Sprintf("%vh", hours)
+	}
+	return fmt.Sprintf("%vh %vm", hours, minutes)
+}
+
+func formatTagTotals(b *strings.Builder, title string, totals []tagTotal) {
+	if len(totals) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\n%v\n", title)
+	for _, total := range totals {
+		fmt.Fprintf(b, "%v - %v (%v)\n", formatTag(total.tag), formatDuration(total.duration), total.sessions)
+	}
+}
+
+// generateStatsText counts days in the location of now.
+func (env *environment) generateStatsText(chatId ChatId, now time.Time) (string, error) {
+	sessions, err := env.db.getSessions(chatId, time.Time{}, time.Time{})
+	if err != nil {
+		return "", fmt.Errorf("load sessions: %s", err)
+	}
+	stats := calculateFocusStats(sessions, now)
+	if stats.sessions == 0 {
+		return "You haven't focused yet, let's start!", nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Focus time %v\n", EMOJI_STOPWATCH)
+	fmt.Fprintf(&b, "Today - %v\n", formatDuration(stats.today))
+	fmt.Fprintf(&b, "Last %v days - %v\n", statsWeekDays, formatDuration(stats.week))
+	fmt.Fprintf(&b, "All time - %v in %v sessions\n", formatDuration(stats.total), stats.sessions)
+	internal := stats.weekInterruptions[INTERRUPTION_INTERNAL]
+	external := stats.weekInterruptions[INTERRUPTION_EXTERNAL]
+	fmt.Fprintf(&b, "Interruptions, last %v days - %v (%v internal, %v external)\n", statsWeekDays, internal+external, internal, external)
+	if len(stats.stopReasons) > 0 {
+		b.WriteString("\nCommon reasons to stop early:\n")
+		for _, r := range stats.stopReasons {
+			fmt.Fprintf(&b, "%v (%v)\n", r.reason, r.count)
+		}
+	}
+	formatTagTotals(&b, fmt.Sprintf("By tag, last %v days:", statsWeekDays), stats.weekByTag)
+	formatTagTotals(&b, "By tag, all time:", stats.totalByTag)
+	return strings.TrimRight(b.String(), "\n"), nil
+}
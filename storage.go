@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	STORAGE_BBOLT  = "bbolt"
+	STORAGE_MEMORY = "memory"
+	STORAGE_SQLITE = "sqlite"
+)
+
+// Storage persists everything the bot has to remember between restarts.
+type Storage interface {
+	saveUserData(chatId ChatId, user User) error
+	getAllUsersData() (map[ChatId]User, error)
+	deleteUserData(chatId ChatId) error
+
+	saveTimers(timers map[ChatId]TimeKeeperState) error
+	getAllTimers() (map[ChatId]TimeKeeperState, error)
+
+	saveSession(session Session) error
+	getSession(chatId ChatId, sessionId int64) (Session, error)
+	// getSessions returns sessions started in [from, to), zero times leave
+	// the range open. Sessions are ordered by their start.
+	getSessions(chatId ChatId, from time.Time, to time.Time) ([]Session, error)
+
+	savePartnership(partnership Partnership) error
+	deletePartnership(partnership Partnership) error
+	// getPartnerships returns the partnerships the chat is part of.
+	getPartnerships(chatId ChatId) ([]Partnership, error)
+
+	saveDeferredMessage(msg DeferredMessage) error
+	deleteDeferredMessage(msg DeferredMessage) error
+	// getDeferredMessages returns the messages due at or before until,
+	// ordered by when they are due.
+	getDeferredMessages(until time.Time) ([]DeferredMessage, error)
+
+	// Members of a group who opted out aren't shown on its leaderboard,
+	// they don't have to be users of the bot.
+	setLeaderboardOptOut(groupId ChatId, userId int64, optOut bool) error
+	getLeaderboardOptOuts(groupId ChatId) (map[int64]bool, error)
+
+	getMeta(key string) (string, error)
+	setMeta(key string, value string) error
+
+	checkOpen() error
+	checkReadable() error
+	closeDB()
+}
+
+// openStorage creates the storage selected in the config, the process
+// exits when it can't be opened.
+func openStorage(cfg Config) Storage {
+	switch cfg.Storage {
+	case STORAGE_BBOLT:
+		db := &hDataBase{path: cfg.DatabasePath}
+		db.initDB()
+		return db
+	case STORAGE_SQLITE:
+		db, err := openSqliteStorage(cfg.SqlitePath)
+		if err != nil {
+			logger.fatal("failed to open sqlite database", "path", cfg.SqlitePath, "err", err)
+		}
+		return db
+	case STORAGE_MEMORY:
+		logger.warn("using in-memory storage, nothing will survive a restart")
+		return newMemoryStorage()
+	}
+	logger.fatal("unknown storage", "storage", cfg.Storage)
+	return nil
+}
+
+func sessionInRange(session Session, from time.Time, to time.Time) bool {
+	if !from.IsZero() && session.StartedAt.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !session.StartedAt.Before(to) {
+		return false
+	}
+	return true
+}
+
+// memoryStorage keeps records marshalled the same way bbolt does, so
+// callers never share memory with what is stored. It is meant for tests
+// and demo instances.
+type memoryStorage struct {
+	mut      sync.Mutex
+	users    map[ChatId][]byte
+	timers   map[ChatId][]byte
+	sessions map[ChatId]map[int64][]byte
+	partners map[string][]byte
+	deferred map[string][]byte
+	optOuts  map[ChatId]map[int64]bool
+	meta     map[string]string
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		users:    make(map[ChatId][]byte),
+		timers:   make(map[ChatId][]byte),
+		sessions: make(map[ChatId]map[int64][]byte),
+		partners: make(map[string][]byte),
+		deferred: make(map[string][]byte),
+		optOuts:  make(map[ChatId]map[int64]bool),
+		meta:     make(map[string]string),
+	}
+}
+
+func (m *memoryStorage) saveUserData(chatId ChatId, user User) error {
+	jsonBuf, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("marshal user: %s", err)
+	}
+	m.mut.Lock()
+	m.users[chatId] = jsonBuf
+	m.mut.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) getAllUsersData() (map[ChatId]User, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	users := make(map[ChatId]User, len(m.users))
+	for chatId, jsonBuf := range m.users {
+		var user User
+		err := json.Unmarshal(jsonBuf, &user)
+		if err != nil {
+			return users, fmt.Errorf("unmarshal user: %s", err)
+		}
+		users[chatId] = user
+	}
+	return users, nil
+}
+
+func (m *memoryStorage) deleteUserData(chatId ChatId) error {
+	m.mut.Lock()
+	err := m.removeParticipantLocked(chatId)
+	if err != nil {
+		m.mut.Unlock()
+		return err
+	}
+	delete(m.users, chatId)
+	delete(m.timers, chatId)
+	delete(m.sessions, chatId)
+	for key, jsonBuf := range m.partners {
+		var partnership Partnership
+		if json.Unmarshal(jsonBuf, &partnership) == nil && partnership.includes(chatId) {
+			delete(m.partners, key)
+		}
+	}
+	for key, jsonBuf := range m.deferred {
+		var msg DeferredMessage
+		if json.Unmarshal(jsonBuf, &msg) == nil && msg.Message.ChatId == chatId {
+			delete(m.deferred, key)
+		}
+	}
+	delete(m.optOuts, chatId)
+	for _, optOuts := range m.optOuts {
+		delete(optOuts, int64(chatId))
+	}
+	m.mut.Unlock()
+	return nil
+}
+
+// removeParticipantLocked drops the user from the participants of the
+// group sessions their own sessions point to.
+func (m *memoryStorage) removeParticipantLocked(chatId ChatId) error {
+	own := make([]Session, 0, len(m.sessions[chatId]))
+	for _, jsonBuf := range m.sessions[chatId] {
+		var session Session
+		err := json.Unmarshal(jsonBuf, &session)
+		if err != nil {
+			return fmt.Errorf("unmarshal session: %s", err)
+		}
+		own = append(own, session)
+	}
+	for _, groupId := range groupIdsOf(own) {
+		for id, jsonBuf := range m.sessions[groupId] {
+			var session Session
+			err := json.Unmarshal(jsonBuf, &session)
+			if err != nil {
+				return fmt.Errorf("unmarshal group session: %s", err)
+			}
+			if !session.removeParticipant(int64(chatId)) {
+				continue
+			}
+			jsonBuf, err = json.Marshal(session)
+			if err != nil {
+				return fmt.Errorf("marshal group session: %s", err)
+			}
+			m.sessions[groupId][id] = jsonBuf
+		}
+	}
+	return nil
+}
+
+func (m *memoryStorage) saveTimers(timers map[ChatId]TimeKeeperState) error {
+	encoded := make(map[ChatId][]byte, len(timers))
+	for chatId, state := range timers {
+		jsonBuf, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("marshal timer: %s", err)
+		}
+		encoded[chatId] = jsonBuf
+	}
+	m.mut.Lock()
+	m.timers = encoded
+	m.mut.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) getAllTimers() (map[ChatId]TimeKeeperState, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	timers := make(map[ChatId]TimeKeeperState, len(m.timers))
+	for chatId, jsonBuf := range m.timers {
+		var state TimeKeeperState
+		err := json.Unmarshal(jsonBuf, &state)
+		if err != nil {
+			return timers, fmt.Errorf("unmarshal timer: %s", err)
+		}
+		timers[chatId] = state
+	}
+	return timers, nil
+}
+
+func (m *memoryStorage) saveSession(session Session) error {
+	jsonBuf, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("marshal session: %s", err)
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	chatSessions, ok := m.sessions[session.ChatId]
+	if !ok {
+		chatSessions = make(map[int64][]byte)
+		m.sessions[session.ChatId] = chatSessions
+	}
+	chatSessions[session.Id] = jsonBuf
+	return nil
+}
+
+func (m *memoryStorage) getSession(chatId ChatId, sessionId int64) (Session, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	var session Session
+	jsonBuf, ok := m.sessions[chatId][sessionId]
+	if !ok {
+		return session, fmt.Errorf("session [%v] of chat id [%v] not found", sessionId, chatId)
+	}
+	err := json.Unmarshal(jsonBuf, &session)
+	return session, err
+}
+
+func (m *memoryStorage) getSessions(chatId ChatId, from time.Time, to time.Time) ([]Session, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	sessions := make([]Session, 0)
+	for _, jsonBuf := range m.sessions[chatId] {
+		var session Session
+		err := json.Unmarshal(jsonBuf, &session)
+		if err != nil {
+			return sessions, fmt.Errorf("unmarshal session: %s", err)
+		}
+		if sessionInRange(session, from, to) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Id < sessions[j].Id
+	})
+	return sessions, nil
+}
+
+func (m *memoryStorage) savePartnership(partnership Partnership) error {
+	jsonBuf, err := json.Marshal(partnership)
+	if err != nil {
+		return fmt.Errorf("marshal partnership: %s", err)
+	}
+	m.mut.Lock()
+	m.partners[string(partnership.key())] = jsonBuf
+	m.mut.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) deletePartnership(partnership Partnership) error {
+	m.mut.Lock()
+	delete(m.partners, string(partnership.key()))
+	m.mut.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) getPartnerships(chatId ChatId) ([]Partnership, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	partnerships := make([]Partnership, 0)
+	for _, jsonBuf := range m.partners {
+		var partnership Partnership
+		err := json.Unmarshal(jsonBuf, &partnership)
+		if err != nil {
+			return partnerships, fmt.Errorf("unmarshal partnership: %s", err)
+		}
+		if partnership.includes(chatId) {
+			partnerships = append(partnerships, partnership)
+		}
+	}
+	sort.Slice(partnerships, func(i, j int) bool {
+		return partnerships[i].Since.Before(partnerships[j].Since)
+	})
+	return partnerships, nil
+}
+
+func (m *memoryStorage) saveDeferredMessage(msg DeferredMessage) error {
+	jsonBuf, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal deferred message: %s", err)
+	}
+	m.mut.Lock()
+	m.deferred[string(msg.key())] = jsonBuf
+	m.mut.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) deleteDeferredMessage(msg DeferredMessage) error {
+	m.mut.Lock()
+	delete(m.deferred, string(msg.key()))
+	m.mut.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) getDeferredMessages(until time.Time) ([]DeferredMessage, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	messages := make([]DeferredMessage, 0)
+	for _, jsonBuf := range m.deferred {
+		var msg DeferredMessage
+		err := json.Unmarshal(jsonBuf, &msg)
+		if err != nil {
+			return messages, fmt.Errorf("unmarshal deferred message: %s", err)
+		}
+		if !msg.SendAt.After(until) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return string(messages[i].key()) < string(messages[j].key())
+	})
+	return messages, nil
+}
+
+func (m *memoryStorage) setLeaderboardOptOut(groupId ChatId, userId int64, optOut bool) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if !optOut {
+		delete(m.optOuts[groupId], userId)
+		return nil
+	}
+	if m.optOuts[groupId] == nil {
+		m.optOuts[groupId] = make(map[int64]bool)
+	}
+	m.optOuts[groupId][userId] = true
+	return nil
+}
+
+func (m *memoryStorage) getLeaderboardOptOuts(groupId ChatId) (map[int64]bool, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	optOuts := make(map[int64]bool, len(m.optOuts[groupId]))
+	for userId := range m.optOuts[groupId] {
+		optOuts[userId] = true
+	}
+	return optOuts, nil
+}
+
+func (m *memoryStorage) getMeta(key string) (string, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.meta[key], nil
+}
+
+func (m *memoryStorage) setMeta(key string, value string) error {
+	m.mut.Lock()
+	m.meta[key] = value
+	m.mut.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) checkOpen() error {
+	return nil
+}
+
+func (m *memoryStorage) checkReadable() error {
+	return nil
+}
+
+func (m *memoryStorage) closeDB() {
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storageBackends opens an empty storage of every kind, the same contract
+// tests run against each of them.
+func storageBackends(t *testing.T) map[string]func() Storage {
+	return map[string]func() Storage{
+		STORAGE_MEMORY: func() Storage {
+			return newMemoryStorage()
+		},
+		STORAGE_BBOLT: func() Storage {
+			db := &hDataBase{path: filepath.Join(t.TempDir(), "horae.db")}
+			db.initDB()
+			return db
+		},
+		STORAGE_SQLITE: func() Storage {
+			db, err := openSqliteStorage(filepath.Join(t.TempDir(), "horae.sqlite"))
+			if err != nil {
+				t.Fatalf("open sqlite storage: %v", err)
+			}
+			return db
+		},
+	}
+}
+
+func runStorageTest(t *testing.T, test func(t *testing.T, db Storage)) {
+	for name, open := range storageBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			db := open()
+			defer db.closeDB()
+			test(t, db)
+		})
+	}
+}
+
+var testDay = time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+
+func testSession(chatId ChatId, startedAt time.Time) Session {
+	return Session{
+		Id:          startedAt.UnixNano(),
+		ChatId:      chatId,
+		Kind:        SESSION_KIND_FOCUS,
+		Status:      SESSION_STATUS_COMPLETED,
+		PlannedMins: 25,
+		StartedAt:   startedAt,
+		EndedAt:     startedAt.Add(25 * time.Minute),
+		Tag:         "docs",
+	}
+}
+
+func TestStorageUsers(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		users, err := db.getAllUsersData()
+		if err != nil || len(users) != 0 {
+			t.Fatalf("new storage has users %v, err %v", users, err)
+		}
+		for _, chatId := range []ChatId{1, 2} {
+			err = db.saveUserData(chatId, User{FirstName: "Ann", FocusDurationMins: 25})
+			if err != nil {
+				t.Fatalf("save user: %v", err)
+			}
+		}
+		err = db.saveUserData(2, User{FirstName: "Bob", FocusDurationMins: 45})
+		if err != nil {
+			t.Fatalf("save user: %v", err)
+		}
+		users, err = db.getAllUsersData()
+		if err != nil {
+			t.Fatalf("get users: %v", err)
+		}
+		if len(users) != 2 || users[1].FirstName != "Ann" || users[2].FirstName != "Bob" || users[2].FocusDurationMins != 45 {
+			t.Fatalf("unexpected users %+v", users)
+		}
+	})
+}
+
+func TestStorageTimers(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		endsAt := testDay.Add(time.Hour)
+		err := db.saveTimers(map[ChatId]TimeKeeperState{
+			1: {SessionId: 10, Kind: SESSION_KIND_FOCUS, EndsAt: endsAt},
+			2: {SessionId: 20, Kind: SESSION_KIND_BREAK, EndsAt: endsAt},
+		})
+		if err != nil {
+			t.Fatalf("save timers: %v", err)
+		}
+		// saving replaces every timer saved before
+		err = db.saveTimers(map[ChatId]TimeKeeperState{
+			3: {SessionId: 30, Kind: SESSION_KIND_FOCUS, EndsAt: endsAt, SecondsLeft: 60},
+		})
+		if err != nil {
+			t.Fatalf("save timers: %v", err)
+		}
+		timers, err := db.getAllTimers()
+		if err != nil {
+			t.Fatalf("get timers: %v", err)
+		}
+		if len(timers) != 1 || timers[3].SessionId != 30 || timers[3].SecondsLeft != 60 || !timers[3].EndsAt.Equal(endsAt) {
+			t.Fatalf("unexpected timers %+v", timers)
+		}
+	})
+}
+
+func TestStorageSessions(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		for _, hours := range []int{48, 0, 24} {
+			err := db.saveSession(testSession(1, testDay.Add(time.Duration(hours)*time.Hour)))
+			if err != nil {
+				t.Fatalf("save session: %v", err)
+			}
+		}
+		err := db.saveSession(testSession(2, testDay))
+		if err != nil {
+			t.Fatalf("save session: %v", err)
+		}
+
+		updated := testSession(1, testDay)
+		updated.Note = "wrote the tests"
+		updated.Rating = 4
+		err = db.saveSession(updated)
+		if err != nil {
+			t.Fatalf("update session: %v", err)
+		}
+		session, err := db.getSession(1, updated.Id)
+		if err != nil {
+			t.Fatalf("get session: %v", err)
+		}
+		if session.Note != updated.Note || session.Rating != 4 || !session.StartedAt.Equal(testDay) {
+			t.Fatalf("unexpected session %+v", session)
+		}
+		_, err = db.getSession(1, 12345)
+		if err == nil {
+			t.Fatalf("expected an error for a missing session")
+		}
+
+		sessions, err := db.getSessions(1, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("get sessions: %v", err)
+		}
+		if len(sessions) != 3 {
+			t.Fatalf("expected 3 sessions, got %v", len(sessions))
+		}
+		for i, hours := range []int{0, 24, 48} {
+			if !sessions[i].StartedAt.Equal(testDay.Add(time.Duration(hours) * time.Hour)) {
+				t.Fatalf("sessions are not ordered by start: %+v", sessions)
+			}
+		}
+
+		// the range includes from and excludes to
+		sessions, err = db.getSessions(1, testDay.Add(24*time.Hour), testDay.Add(48*time.Hour))
+		if err != nil {
+			t.Fatalf("get sessions: %v", err)
+		}
+		if len(sessions) != 1 || !sessions[0].StartedAt.Equal(testDay.Add(24*time.Hour)) {
+			t.Fatalf("unexpected sessions in range %+v", sessions)
+		}
+		sessions, err = db.getSessions(3, time.Time{}, time.Time{})
+		if err != nil || len(sessions) != 0 {
+			t.Fatalf("unknown chat has sessions %v, err %v", sessions, err)
+		}
+	})
+}
+
+func TestStoragePartnerships(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		ab := newPartnership(2, 1, testDay)
+		ac := newPartnership(1, 3, testDay.Add(time.Hour))
+		for _, p := range []Partnership{ac, ab} {
+			err := db.savePartnership(p)
+			if err != nil {
+				t.Fatalf("save partnership: %v", err)
+			}
+		}
+		partnerships, err := db.getPartnerships(1)
+		if err != nil {
+			t.Fatalf("get partnerships: %v", err)
+		}
+		if len(partnerships) != 2 || partnerships[0].partnerOf(1) != 2 || partnerships[1].partnerOf(1) != 3 {
+			t.Fatalf("unexpected partnerships %+v", partnerships)
+		}
+
+		err = db.deletePartnership(newPartnership(1, 2, testDay))
+		if err != nil {
+			t.Fatalf("delete partnership: %v", err)
+		}
+		partnerships, err = db.getPartnerships(2)
+		if err != nil || len(partnerships) != 0 {
+			t.Fatalf("deleted partnership is still there: %v, err %v", partnerships, err)
+		}
+		partnerships, err = db.getPartnerships(3)
+		if err != nil || len(partnerships) != 1 {
+			t.Fatalf("unexpected partnerships %v, err %v", partnerships, err)
+		}
+	})
+}
+
+func TestStorageMeta(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		value, err := db.getMeta("missing")
+		if err != nil || value != "" {
+			t.Fatalf("missing key has value %q, err %v", value, err)
+		}
+		for _, v := range []string{"first", "second"} {
+			err = db.setMeta("key", v)
+			if err != nil {
+				t.Fatalf("set meta: %v", err)
+			}
+		}
+		value, err = db.getMeta("key")
+		if err != nil || value != "second" {
+			t.Fatalf("unexpected value %q, err %v", value, err)
+		}
+	})
+}
+
+func TestStorageDeleteUserData(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		for _, chatId := range []ChatId{1, 2} {
+			err := db.saveUserData(chatId, User{FirstName: "Ann"})
+			if err != nil {
+				t.Fatalf("save user: %v", err)
+			}
+			err = db.saveSession(testSession(chatId, testDay))
+			if err != nil {
+				t.Fatalf("save session: %v", err)
+			}
+		}
+		err := db.saveTimers(map[ChatId]TimeKeeperState{1: {SessionId: 1}, 2: {SessionId: 2}})
+		if err != nil {
+			t.Fatalf("save timers: %v", err)
+		}
+		err = db.savePartnership(newPartnership(1, 2, testDay))
+		if err != nil {
+			t.Fatalf("save partnership: %v", err)
+		}
+
+		err = db.deleteUserData(1)
+		if err != nil {
+			t.Fatalf("delete user data: %v", err)
+		}
+		users, _ := db.getAllUsersData()
+		timers, _ := db.getAllTimers()
+		if _, ok := users[1]; ok || len(users) != 1 {
+			t.Fatalf("user is not deleted: %+v", users)
+		}
+		if _, ok := timers[1]; ok || len(timers) != 1 {
+			t.Fatalf("timer is not deleted: %+v", timers)
+		}
+		sessions, _ := db.getSessions(1, time.Time{}, time.Time{})
+		if len(sessions) != 0 {
+			t.Fatalf("sessions are not deleted: %+v", sessions)
+		}
+		sessions, _ = db.getSessions(2, time.Time{}, time.Time{})
+		if len(sessions) != 1 {
+			t.Fatalf("sessions of another user are deleted")
+		}
+		partnerships, _ := db.getPartnerships(2)
+		if len(partnerships) != 0 {
+			t.Fatalf("partnership is not deleted: %+v", partnerships)
+		}
+	})
+}
+
+func TestStorageDeferredMessages(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		late := DeferredMessage{Id: 1, SendAt: testDay.Add(2 * time.Hour), Message: OutgoingMessage{ChatId: 1, Text: "late"}}
+		early := DeferredMessage{Id: 2, SendAt: testDay.Add(time.Hour), Message: OutgoingMessage{ChatId: 2, Text: "early"}}
+		other := DeferredMessage{Id: 3, SendAt: testDay.Add(time.Hour), Message: OutgoingMessage{ChatId: 1, Text: "other"}}
+		for _, msg := range []DeferredMessage{late, early, other} {
+			err := db.saveDeferredMessage(msg)
+			if err != nil {
+				t.Fatalf("save deferred message: %v", err)
+			}
+		}
+		messages, err := db.getDeferredMessages(testDay)
+		if err != nil || len(messages) != 0 {
+			t.Fatalf("messages are due too early: %+v, err %v", messages, err)
+		}
+		// messages due exactly at until are included
+		messages, err = db.getDeferredMessages(testDay.Add(2 * time.Hour))
+		if err != nil {
+			t.Fatalf("get deferred messages: %v", err)
+		}
+		if len(messages) != 3 || messages[2].Message.Text != "late" || !messages[2].SendAt.Equal(late.SendAt) {
+			t.Fatalf("unexpected deferred messages %+v", messages)
+		}
+
+		err = db.deleteDeferredMessage(other)
+		if err != nil {
+			t.Fatalf("delete deferred message: %v", err)
+		}
+		err = db.deleteUserData(1)
+		if err != nil {
+			t.Fatalf("delete user data: %v", err)
+		}
+		messages, err = db.getDeferredMessages(testDay.Add(24 * time.Hour))
+		if err != nil {
+			t.Fatalf("get deferred messages: %v", err)
+		}
+		if len(messages) != 1 || messages[0].Message.Text != "early" {
+			t.Fatalf("unexpected deferred messages after deleting %+v", messages)
+		}
+	})
+}
+
+func TestStorageDeleteUserDataFromGroupSessions(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		const groupId ChatId = -100
+		group := testSession(groupId, testDay)
+		group.GroupId = groupId
+		for _, userId := range []int64{1, 2} {
+			own := testSession(ChatId(userId), testDay)
+			own.GroupId = groupId
+			err := db.saveSession(own)
+			if err != nil {
+				t.Fatalf("save session: %v", err)
+			}
+			group.Participants = append(group.Participants, Participant{UserId: userId, FirstName: "Ann", SessionId: own.Id})
+		}
+		err := db.saveSession(group)
+		if err != nil {
+			t.Fatalf("save group session: %v", err)
+		}
+
+		err = db.deleteUserData(1)
+		if err != nil {
+			t.Fatalf("delete user data: %v", err)
+		}
+		group, err = db.getSession(groupId, group.Id)
+		if err != nil {
+			t.Fatalf("get group session: %v", err)
+		}
+		if len(group.Participants) != 1 || group.Participants[0].UserId != 2 {
+			t.Fatalf("deleted user is still a participant: %+v", group.Participants)
+		}
+	})
+}
+
+func TestStorageLeaderboardOptOuts(t *testing.T) {
+	runStorageTest(t, func(t *testing.T, db Storage) {
+		const groupId, otherGroupId ChatId = -100, -200
+		for _, optOut := range []struct {
+			groupId ChatId
+			userId  int64
+			optOut  bool
+		}{
+			{groupId, 1, true},
+			{groupId, 2, true},
+			{groupId, 2, true},
+			{groupId, 3, true},
+			{groupId, 3, false},
+			{otherGroupId, 1, true},
+		} {
+			err := db.setLeaderboardOptOut(optOut.groupId, optOut.userId, optOut.optOut)
+			if err != nil {
+				t.Fatalf("set leaderboard opt-out: %v", err)
+			}
+		}
+		optOuts, err := db.getLeaderboardOptOuts(groupId)
+		if err != nil {
+			t.Fatalf("get leaderboard opt-outs: %v", err)
+		}
+		if len(optOuts) != 2 || !optOuts[1] || !optOuts[2] {
+			t.Fatalf("unexpected opt-outs %v", optOuts)
+		}
+
+		err = db.deleteUserData(1)
+		if err != nil {
+			t.Fatalf("delete user data: %v", err)
+		}
+		for id, expected := range map[ChatId]int{groupId: 1, otherGroupId: 0} {
+			optOuts, err = db.getLeaderboardOptOuts(id)
+			if err != nil || len(optOuts) != expected || optOuts[1] {
+				t.Fatalf("unexpected opt-outs of %v after deleting the user: %v, err %v", id, optOuts, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxRecentTags   = 6
+	maxFocusMinutes = 240
+)
+
+// Tags are single words of letters, digits, '_' and '-', written with a
+// leading '#' and stored without it in lower case.
+var reTag = regexp.MustCompile(`^#([\p{L}\p{N}_-]{1,32})$`)
+
+func parseTag(text string) (string, bool) {
+	m := reTag.FindStringSubmatch(strings.TrimSpace(text))
+	if m == nil {
+		return "", false
+	}
+	return strings.ToLower(m[1]), true
+}
+
+func formatTag(tag string) string {
+	if tag == "" {
+		return "untagged"
+	}
+	return "#" + tag
+}
+
+// parseFocusArgs parses the arguments of /focus, an optional duration in
+// minutes and an optional tag in any order.
+func parseFocusArgs(args []string, defaultMins int) (mins int, tag string, err error) {
+	mins = defaultMins
+	durationSet := false
+	for _, arg := range args {
+		if t, ok := parseTag(arg); ok && tag == "" {
+			tag = t
+			continue
+		}
+		value, convErr := strconv.Atoi(arg)
+		if convErr == nil && !durationSet && value > 0 && value <= maxFocusMinutes {
+			mins = value
+			durationSet = true
+			continue
+		}
+		return 0, "", fmt.Errorf("unexpected argument [%v]", arg)
+	}
+	return mins, tag, nil
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var validPath = regexp.MustCompile("^/(update)/+")
+var reIpAddress = regexp.MustCompile(`^((25[0-5]|(2[0-4]|1\d|[1-9]|)\d)\.?\b){4}$`)
+
+const (
+	webhookInfoRefreshInterval = time.Minute
+	// Telegram keeps the last delivery error around forever, only errors
+	// newer than this window make the bot unready.
+	webhookErrorWindow = 5 * time.Minute
+)
+
+// telegramMessenger receives updates through a webhook and talks to the
+// Telegram Bot API.
+type telegramMessenger struct {
+	client          http.Client
+	botKey          string
+	ipAddress       string
+	url             string
+	certificateFile string
+	keyFile         string
+	webhookAction   string
+	webhook         webhookStatus
+	server          *http.Server
+	handler         updateHandler
+}
+
+type TChat struct {
+	Id   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+type TKeyBoardButton struct {
+	Text string `json:"text"`
+}
+
+type TReplyKeyboard struct {
+	Keyboard        [][]TKeyBoardButton `json:"keyboard"`
+	ResizeKeyboard  bool                `json:"resize_keyboard"`
+	OneTimeKeyboard bool                `json:"one_time_keyboard"`
+}
+
+type TMessage struct {
+	MessageId int    `json:"message_id"`
+	Text      string `json:"text"`
+	Chat      TChat  `json:"chat"`
+	From      TUser  `json:"from"`
+}
+
+type TMessageSend struct {
+	ChatId              ChatId `json:"chat_id"`
+	Text                string `json:"text"`
+	ParseMode           string `json:"parse_mode,omitempty"`
+	DisableNotification bool   `json:"disable_notification,omitempty"`
+}
+
+type TKeyboardMessageSend struct {
+	ChatId         ChatId         `json:"chat_id"`
+	Text           string         `json:"text"`
+	KeyboardMarkup TReplyKeyboard `json:"reply_markup"`
+	ParseMode      string         `json:"parse_mode,omitempty"`
+	// DisableNotification delivers the message without a sound
+	DisableNotification bool `json:"disable_notification,omitempty"`
+}
+
+type TInlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+type TInlineKeyboard struct {
+	InlineKeyboard [][]TInlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type TInlineKeyboardMessageSend struct {
+	ChatId              ChatId          `json:"chat_id"`
+	Text                string          `json:"text"`
+	ReplyMarkup         TInlineKeyboard `json:"reply_markup"`
+	ParseMode           string          `json:"parse_mode,omitempty"`
+	DisableNotification bool            `json:"disable_notification,omitempty"`
+}
+
+// TEditMessageText replaces the text of a message, without ReplyMarkup
+// the inline keyboard is removed.
+type TEditMessageText struct {
+	ChatId      ChatId           `json:"chat_id"`
+	MessageId   int              `json:"message_id"`
+	Text        string           `json:"text"`
+	ParseMode   string           `json:"parse_mode,omitempty"`
+	ReplyMarkup *TInlineKeyboard `json:"reply_markup,omitempty"`
+}
+
+// TCallbackQuery is sent when a button of an inline keyboard is pressed,
+// Message is the message the keyboard is attached to.
+type TCallbackQuery struct {
+	Id      string   `json:"id"`
+	From    TUser    `json:"from"`
+	Message TMessage `json:"message"`
+	Data    string   `json:"data"`
+}
+
+type TAnswerCallbackQuery struct {
+	CallbackQueryId string `json:"callback_query_id"`
+	Text            string `json:"text,omitempty"`
+}
+
+type TReplyKeyboardRemove struct {
+	RemoveKeyboard bool `json:"remove_keyboard"`
+}
+
+type TRemoveKeyboardMessageSend struct {
+	ChatId              ChatId               `json:"chat_id"`
+	Text                string               `json:"text"`
+	ReplyMarkup         TReplyKeyboardRemove `json:"reply_markup"`
+	ParseMode           string               `json:"parse_mode,omitempty"`
+	DisableNotification bool                 `json:"disable_notification,omitempty"`
+}
+
+type TUser struct {
+	Id        int64  `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+type TResponseParameters struct {
+	RetryAfter int `json:"retry_after"`
+}
+
+type TApiResponse struct {
+	Ok          bool                `json:"ok"`
+	ErrorCode   int                 `json:"error_code"`
+	Description string              `json:"description"`
+	Parameters  TResponseParameters `json:"parameters"`
+}
+
+type TWebhookInfo struct {
+	Url                  string `json:"url"`
+	HasCustomCertificate bool   `json:"has_custom_certificate"`
+	PendingUpdateCount   int    `json:"pending_update_count"`
+	IpAddress            string `json:"ip_address,omitempty"`
+	LastErrorDate        int64  `json:"last_error_date,omitempty"`
+	LastErrorMessage     string `json:"last_error_message,omitempty"`
+	MaxConnections       int    `json:"max_connections,omitempty"`
+}
+
+type TWebhookInfoResponse struct {
+	Ok          bool         `json:"ok"`
+	Description string       `json:"description"`
+	Result      TWebhookInfo `json:"result"`
+}
+
+type TUpdate struct {
+	UpdateId      int            `json:"update_id"`
+	Message       TMessage       `json:"message"`
+	CallbackQuery TCallbackQuery `json:"callback_query"`
+}
+
+// getType classifies the update for metrics.
+func (u *TUpdate) getType() string {
+	switch {
+	case u.CallbackQuery.Id != "":
+		return "callback_query"
+	case u.Message.MessageId == 0:
+		return "unsupported"
+	default:
+		return messageType(u.Message.Text)
+	}
+}
+
+func getPathValue(r *http.Request, pathCheck *regexp.Regexp) (string, error) {
+	m := pathCheck.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return "", fmt.Errorf("url path is not valid")
+	}
+
+	logger.debug("path value parsed", "path", r.URL.Path, "value", m[1])
+	return m[1], nil
+}
+
+func (t *telegramMessenger) pageHandler(w http.ResponseWriter, r *http.Request) {
+	pageTitle, err := getPathValue(r, validPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger.debug("update page requested", "page_title", pageTitle)
+}
+
+type webhookStatus struct {
+	mut       sync.Mutex
+	info      TWebhookInfo
+	checkedAt time.Time
+	err       error
+}
+
+func (s *webhookStatus) update(info TWebhookInfo) {
+	s.mut.Lock()
+	s.info = info
+	s.checkedAt = time.Now()
+	s.err = nil
+	s.mut.Unlock()
+}
+
+func (s *webhookStatus) fail(err error) {
+	s.mut.Lock()
+	s.checkedAt = time.Now()
+	s.err = err
+	s.mut.Unlock()
+}
+
+func newTelegramMessenger(cfg Config, webhookAction string) *telegramMessenger {
+	//Valid input parameters
+	if cfg.TelegramBotToken == "" {
+		logger.fatal("telegram bot token is not set")
+	}
+	if cfg.Url == "" {
+		logger.fatal("url is not set")
+	}
+	if cfg.IpAddress == "" {
+		logger.fatal("ip address is not set")
+	} else if !reIpAddress.MatchString(cfg.IpAddress) {
+		logger.fatal("ip address is not valid", "ip_address", cfg.IpAddress)
+	}
+
+	return &telegramMessenger{
+		client:          http.Client{},
+		botKey:          cfg.TelegramBotToken,
+		ipAddress:       cfg.IpAddress,
+		url:             cfg.Url,
+		certificateFile: cfg.CertificateFile,
+		keyFile:         cfg.KeyFile,
+		webhookAction:   webhookAction,
+	}
+}
+
+func (t *telegramMessenger) name() string {
+	return MESSENGER_TELEGRAM
+}
+
+// start performs the webhook action given on the command line and serves
+// the webhook.
+func (t *telegramMessenger) start(handler updateHandler) error {
+	t.handler = handler
+	//process webhook action provided by the user
+	if t.webhookAction == "install" {
+		err := t.setupWebhook(t.certificateFile, t.url)
+		if err != nil {
+			logger.error("failed to install webhook", "err", err)
+		}
+	} else if t.webhookAction == "delete" {
+		err := t.deleteWebhook()
+		if err != nil {
+			logger.error("failed to delete webhook", "err", err)
+		}
+	}
+	go t.monitorWebhook(webhookInfoRefreshInterval)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/update/", t.pageHandler)
+	mux.HandleFunc("/", t.updateHandler)
+	t.server = &http.Server{Addr: ":443", Handler: mux}
+	go func() {
+		logger.info("starting webhook server", "address", t.server.Addr)
+		err := t.server.ListenAndServeTLS(t.certificateFile, t.keyFile)
+		if err != nil && err != http.ErrServerClosed {
+			logger.fatal("webhook server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// stop waits for the updates being handled, Telegram delivers the rest
+// again once the webhook answers.
+func (t *telegramMessenger) stop(ctx context.Context) error {
+	return t.server.Shutdown(ctx)
+}
+
+func (t *telegramMessenger) updateHandler(w http.ResponseWriter, r *http.Request) {
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.error("failed to read update body", "err", err)
+		return
+	}
+
+	update := &TUpdate{}
+	err = json.Unmarshal(buf, update)
+	if err != nil {
+		updatesReceived.inc("invalid")
+		logger.warn("failed to parse update", "err", err)
+		return
+	}
+	updatesReceived.inc(update.getType())
+	updateId := strconv.Itoa(update.UpdateId)
+	if query := update.CallbackQuery; query.Id != "" {
+		t.handler.processButtonPress(ButtonPress{
+			Id:        query.Id,
+			UpdateId:  updateId,
+			ChatId:    ChatId(query.Message.Chat.Id),
+			MessageId: strconv.Itoa(query.Message.MessageId),
+			From:      telegramSender(query.From),
+			Data:      query.Data,
+		})
+		return
+	}
+	t.handler.processMessage(IncomingMessage{
+		UpdateId: updateId,
+		ChatId:   ChatId(update.Message.Chat.Id),
+		Group:    isGroupChat(update.Message.Chat),
+		From:     telegramSender(update.Message.From),
+		Text:     update.Message.Text,
+	})
+}
+
+func telegramSender(user TUser) Sender {
+	return Sender{Id: user.Id, FirstName: user.FirstName}
+}
+
+func isGroupChat(chat TChat) bool {
+	return chat.Type == CHAT_TYPE_GROUP || chat.Type == CHAT_TYPE_SUPERGROUP
+}
+
+func telegramParseMode(format string) string {
+	if format == FORMAT_HTML {
+		return "HTML"
+	}
+	return ""
+}
+
+func telegramKeyboard(keyboard Keyboard) TReplyKeyboard {
+	rows := make([][]TKeyBoardButton, len(keyboard))
+	for i, row := range keyboard {
+		rows[i] = make([]TKeyBoardButton, len(row))
+		for j, text := range row {
+			rows[i][j] = TKeyBoardButton{Text: text}
+		}
+	}
+	return TReplyKeyboard{
+		Keyboard:       rows,
+		ResizeKeyboard: true,
+	}
+}
+
+func telegramInlineKeyboard(buttons []InlineButton) TInlineKeyboard {
+	row := make([]TInlineKeyboardButton, len(buttons))
+	for i, button := range buttons {
+		row[i] = TInlineKeyboardButton{Text: button.Text, CallbackData: button.Data}
+	}
+	return TInlineKeyboard{InlineKeyboard: [][]TInlineKeyboardButton{row}}
+}
+
+// health reports the webhook, the bot is unready until Telegram knows where
+// to deliver updates.
+func (t *telegramMessenger) health() (string, healthComponent) {
+	t.webhook.mut.Lock()
+	info := t.webhook.info
+	checkedAt := t.webhook.checkedAt
+	err := t.webhook.err
+	t.webhook.mut.Unlock()
+
+	details := map[string]interface{}{
+		"url":                  info.Url,
+		"pending_update_count": info.PendingUpdateCount,
+		"last_error_message":   info.LastErrorMessage,
+	}
+	if !checkedAt.IsZero() {
+		details["checked_at"] = checkedAt.UTC().Format(time.RFC3339)
+	}
+
+	switch {
+	case err != nil:
+	case checkedAt.IsZero():
+		err = fmt.Errorf("webhook info was not received yet")
+	case info.Url == "":
+		err = fmt.Errorf("webhook is not registered")
+	case info.LastErrorMessage != "" && time.Since(time.Unix(info.LastErrorDate, 0)) < webhookErrorWindow:
+		err = fmt.Errorf("webhook delivery failed recently: %v", info.LastErrorMessage)
+	}
+	return "webhook", newHealthComponent(err, details)
+}
+
+func (t *telegramMessenger) messageRequest(msg OutgoingMessage) (*outgoingRequest, error) {
+	parseMode := telegramParseMode(msg.Format)
+	var payload interface{}
+	switch {
+	case len(msg.Buttons) > 0:
+		payload = TInlineKeyboardMessageSend{
+			ChatId:              msg.ChatId,
+			Text:                msg.Text,
+			ReplyMarkup:         telegramInlineKeyboard(msg.Buttons),
+			ParseMode:           parseMode,
+			DisableNotification: msg.Silent,
+		}
+	case msg.RemoveKeyboard:
+		payload = TRemoveKeyboardMessageSend{
+			ChatId:              msg.ChatId,
+			Text:                msg.Text,
+			ReplyMarkup:         TReplyKeyboardRemove{RemoveKeyboard: true},
+			ParseMode:           parseMode,
+			DisableNotification: msg.Silent,
+		}
+	case msg.Keyboard != nil:
+		payload = TKeyboardMessageSend{
+			ChatId:              msg.ChatId,
+			Text:                msg.Text,
+			KeyboardMarkup:      telegramKeyboard(msg.Keyboard),
+			ParseMode:           parseMode,
+			DisableNotification: msg.Silent,
+		}
+	default:
+		payload = TMessageSend{
+			ChatId:              msg.ChatId,
+			Text:                msg.Text,
+			ParseMode:           parseMode,
+			DisableNotification: msg.Silent,
+		}
+	}
+	return jsonRequest("sendMessage", payload)
+}
+
+func (t *telegramMessenger) editRequest(messageId string, msg OutgoingMessage) (*outgoingRequest, error) {
+	id, err := strconv.Atoi(messageId)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected message id [%v]", messageId)
+	}
+	edit := TEditMessageText{
+		ChatId:    msg.ChatId,
+		MessageId: id,
+		Text:      msg.Text,
+		ParseMode: telegramParseMode(msg.Format),
+	}
+	if len(msg.Buttons) > 0 {
+		keyboard := telegramInlineKeyboard(msg.Buttons)
+		edit.ReplyMarkup = &keyboard
+	}
+	return jsonRequest("editMessageText", edit)
+}
+
+// fileRequest builds the multipart body of an upload.
+func (t *telegramMessenger) fileRequest(chatId ChatId, kind string, fileName string, content []byte, caption string) (*outgoingRequest, error) {
+	method := "sendDocument"
+	if kind == FILE_KIND_PHOTO {
+		method = "sendPhoto"
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	err := writer.WriteField("chat_id", fmt.Sprint(chatId))
+	if err != nil {
+		return nil, err
+	}
+	if caption != "" {
+		err = writer.WriteField("caption", caption)
+		if err != nil {
+			return nil, err
+		}
+	}
+	part, err := writer.CreateFormFile(kind, fileName)
+	if err != nil {
+		return nil, err
+	}
+	_, err = part.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &outgoingRequest{
+		method:      method,
+		contentType: writer.FormDataContentType(),
+		body:        body.Bytes(),
+	}, nil
+}
+
+func (t *telegramMessenger) answerRequest(press ButtonPress, text string) (*outgoingRequest, error) {
+	return jsonRequest("answerCallbackQuery", TAnswerCallbackQuery{CallbackQueryId: press.Id, Text: text})
+}
+
+func (t *telegramMessenger) send(req *outgoingRequest) error {
+	return t.callTelegram(req.method, req.contentType, req.body)
+}
+
+func (t *telegramMessenger) setupWebhook(certificateFilePath string, url string) error {
+	keyFile, err := os.Open(certificateFilePath)
+	if err != nil {
+		return err
+	}
+	defer keyFile.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("certificate", keyFile.Name())
+	io.Copy(part, keyFile)
+	err = writer.WriteField("url", "https://"+url+"/")
+	if err != nil {
+		return err
+	}
+	err = writer.WriteField("ip_address", t.ipAddress)
+	writer.Close()
+
+	request, err := http.NewRequest("POST", "https://api.telegram.org/bot"+t.botKey+"/setWebhook", body)
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	start := time.Now()
+	response, err := t.client.Do(request)
+	observeTelegramCall("setWebhook", start, response, err)
+	if err != nil {
+		return err
+	}
+
+	buf, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	logger.info("webhook installed", "response", string(buf))
+	return nil
+}
+
+func (t *telegramMessenger) deleteWebhook() error {
+	start := time.Now()
+	resp, err := http.Get("https://api.telegram.org/bot" + t.botKey + "/deleteWebhook?url=https://" + t.ipAddress + "/")
+	observeTelegramCall("deleteWebhook", start, resp, err)
+	if err != nil {
+		return err
+	}
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	logger.info("webhook deleted", "response", string(buf))
+	return nil
+}
+
+func (t *telegramMessenger) getWebhookInfo() error {
+	info, err := fetchWebhookInfo(t.botKey, t.ipAddress)
+	if err != nil {
+		return err
+	}
+	t.webhook.update(info)
+	return nil
+}
+
+func fetchWebhookInfo(botKey string, ipAddress string) (TWebhookInfo, error) {
+	start := time.Now()
+	resp, err := http.Get("https://api.telegram.org/bot" + botKey + "/getWebhookInfo?url=https://" + ipAddress + "/update")
+	observeTelegramCall("getWebhookInfo", start, resp, err)
+	if err != nil {
+		return TWebhookInfo{}, err
+	}
+
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return TWebhookInfo{}, err
+	}
+	logger.debug("webhook info received", "response", string(buf))
+
+	infoResponse := TWebhookInfoResponse{}
+	err = json.Unmarshal(buf, &infoResponse)
+	if err != nil {
+		return TWebhookInfo{}, err
+	}
+	if !infoResponse.Ok {
+		return TWebhookInfo{}, fmt.Errorf("getWebhookInfo failed, status code - [%v], description - [%v]", resp.StatusCode, infoResponse.Description)
+	}
+	return infoResponse.Result, nil
+}
+
+// monitorWebhook refreshes the webhook info periodically for the readiness probe.
+func (t *telegramMessenger) monitorWebhook(interval time.Duration) {
+	for {
+		err := t.getWebhookInfo()
+		if err != nil {
+			t.webhook.fail(err)
+			logger.warn("failed to refresh webhook info", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// callTelegram performs a single Bot API request. Failed requests are
+// reported as *apiError so the message queue can decide whether to retry
+// them.
+func (t *telegramMessenger) callTelegram(method string, contentType string, body []byte) error {
+	request, err := http.NewRequest("POST", t.generateTelegramUrl(method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	start := time.Now()
+	resp, err := t.client.Do(request)
+	observeTelegramCall(method, start, resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	desc, _ := io.ReadAll(resp.Body)
+	apiErr := &apiError{
+		messenger:   MESSENGER_TELEGRAM,
+		method:      method,
+		statusCode:  resp.StatusCode,
+		description: string(desc),
+	}
+	apiResponse := TApiResponse{}
+	if json.Unmarshal(desc, &apiResponse) == nil {
+		apiErr.description = apiResponse.Description
+		apiErr.retryAfter = time.Duration(apiResponse.Parameters.RetryAfter) * time.Second
+	}
+	return apiErr
+}
+
+func (t *telegramMessenger) generateTelegramUrl(action string) string {
+	return "https://api.telegram.org/bot" + t.botKey + "/" + action
+}
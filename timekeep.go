@@ -1,25 +1,79 @@
 package main
 
 import (
-	"fmt"
 	"sync"
 	"time"
 )
 
+const (
+	SESSION_KIND_FOCUS = "focus"
+	SESSION_KIND_BREAK = "break"
+)
+
+// TimeKeeper counts a session down on its own goroutine, stopMut guards
+// isStopped and secondsLeft.
 type TimeKeeper struct {
-	secondsLeft int
-	isStopped   bool
-	stopMut     sync.Mutex
+	sessionId     int64
+	kind          string
+	finishMessage string
+	endsAt        time.Time
+	secondsLeft   int
+	isStopped     bool
+	stopMut       sync.Mutex
+	cycle         focusCycle
 }
 
-func startTimeKeeper(chatId ChatId, focusDuration int, finishMessage string, callback timeekeepStoppedCallback) *TimeKeeper {
+// focusCycle continues a planned block of focus and break sessions, they
+// alternate until no focus cycles are left.
+type focusCycle struct {
+	CyclesLeft int    `json:"cycles_left,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+// TimeKeeperState is what survives a restart of the bot.
+type TimeKeeperState struct {
+	SessionId     int64      `json:"session_id"`
+	Kind          string     `json:"kind"`
+	FinishMessage string     `json:"finish_message"`
+	EndsAt        time.Time  `json:"ends_at"`
+	SecondsLeft   int        `json:"seconds_left"`
+	Cycle         focusCycle `json:"cycle,omitempty"`
+}
+
+type TimeKeepers struct {
+	data map[ChatId]*TimeKeeper
+	mut  sync.Mutex
+}
+
+func startTimeKeeper(chatId ChatId, sessionId int64, kind string, focusDuration int, finishMessage string, cycle focusCycle, callback timeekeepStoppedCallback) *TimeKeeper {
+	sessionEvents.inc(kind, "started")
+	return runTimeKeeper(chatId, sessionId, kind, focusDuration*60, finishMessage, cycle, callback)
+}
+
+// resumeTimeKeeper restarts a timer saved during shutdown, the time the bot
+// was down counts towards the session so overdue timers fire right away.
+func resumeTimeKeeper(chatId ChatId, state TimeKeeperState, callback timeekeepStoppedCallback) *TimeKeeper {
+	secondsLeft := int(time.Until(state.EndsAt).Seconds())
+	if secondsLeft < 1 {
+		secondsLeft = 1
+	}
+	return runTimeKeeper(chatId, state.SessionId, state.Kind, secondsLeft, state.FinishMessage, state.Cycle, callback)
+}
+
+func runTimeKeeper(chatId ChatId, sessionId int64, kind string, seconds int, finishMessage string, cycle focusCycle, callback timeekeepStoppedCallback) *TimeKeeper {
 	ticker := time.NewTicker(time.Second * 1)
 	tk := TimeKeeper{
-		secondsLeft: 0,
-		isStopped:   false,
+		sessionId:     sessionId,
+		kind:          kind,
+		finishMessage: finishMessage,
+		endsAt:        time.Now().Add(time.Duration(seconds) * time.Second),
+		secondsLeft:   seconds,
+		isStopped:     false,
+		cycle:         cycle,
 	}
+	activeTimers.add(1, kind)
 
-	go tk.watchTime(chatId, focusDuration, finishMessage, ticker, callback)
+	go tk.watchTime(chatId, ticker, callback)
 	return &tk
 }
 
@@ -28,26 +82,88 @@ func (tk *TimeKeeper) stopTimeKeep() bool {
 	defer tk.stopMut.Unlock()
 	if !tk.isStopped {
 		tk.isStopped = true
+		activeTimers.add(-1, tk.kind)
 		return true
 	}
 	return false
 }
 
-func (tk *TimeKeeper) watchTime(chatId ChatId, focusDuration int, finishMessage string, ticker *time.Ticker, callback timeekeepStoppedCallback) {
-	tk.secondsLeft = focusDuration * 60
+func (tk *TimeKeeper) stopped() bool {
+	tk.stopMut.Lock()
+	defer tk.stopMut.Unlock()
+	return tk.isStopped
+}
+
+func (tk *TimeKeeper) remainingSeconds() int {
+	tk.stopMut.Lock()
+	defer tk.stopMut.Unlock()
+	return tk.secondsLeft
+}
+
+func (tk *TimeKeeper) state() TimeKeeperState {
+	return TimeKeeperState{
+		SessionId:     tk.sessionId,
+		Kind:          tk.kind,
+		FinishMessage: tk.finishMessage,
+		EndsAt:        tk.endsAt,
+		SecondsLeft:   tk.remainingSeconds(),
+		Cycle:         tk.cycle,
+	}
+}
+
+func (tk *TimeKeeper) watchTime(chatId ChatId, ticker *time.Ticker, callback timeekeepStoppedCallback) {
+	defer ticker.Stop()
 	for {
-		if tk.isStopped {
-			fmt.Println("TimeKeeper stopped")
+		if tk.stopped() {
+			logger.debug("timekeeper stopped", "chat_id", chatId, "kind", tk.kind)
 			return
 		}
 
 		_ = <-ticker.C
+		tk.stopMut.Lock()
 		tk.secondsLeft = tk.secondsLeft - 1
-		if tk.secondsLeft == 0 {
+		secondsLeft := tk.secondsLeft
+		tk.stopMut.Unlock()
+		if secondsLeft == 0 {
 			ok := tk.stopTimeKeep()
 			if ok {
-				callback(chatId, finishMessage)
+				sessionEvents.inc(tk.kind, "completed")
+				callback(chatId, tk)
 			}
 		}
 	}
 }
+
+func (t *TimeKeepers) get(chatId ChatId) (*TimeKeeper, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	tk, ok := t.data[chatId]
+	return tk, ok
+}
+
+func (t *TimeKeepers) add(chatId ChatId, tk *TimeKeeper) {
+	t.mut.Lock()
+	t.data[chatId] = tk
+	t.mut.Unlock()
+}
+
+func (t *TimeKeepers) remove(chatId ChatId) {
+	t.mut.Lock()
+	delete(t.data, chatId)
+	t.mut.Unlock()
+}
+
+// stopAll stops every running timer and returns their states so they can
+// be persisted.
+func (t *TimeKeepers) stopAll() map[ChatId]TimeKeeperState {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	states := make(map[ChatId]TimeKeeperState, len(t.data))
+	for chatId, tk := range t.data {
+		if tk.stopTimeKeep() {
+			states[chatId] = tk.state()
+		}
+		delete(t.data, chatId)
+	}
+	return states
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"sync"
+	"time"
 )
 
 type ChatId int64
@@ -19,6 +19,21 @@ type User struct {
 	FocusDurationMins int        `json:"focus_duration"`
 	BreakDurationMins int        `json:"break_duration"`
 	LastAction        UserAction `json:"last_action,omitempty"`
+	// Tags are the recently used session tags, the latest first
+	Tags []string `json:"tags,omitempty"`
+	// SkipReflection turns off the questions asked after a focus session
+	SkipReflection bool      `json:"skip_reflection,omitempty"`
+	Goal           DailyGoal `json:"goal,omitempty"`
+	// Timezone is an IANA name, days of goals and stats follow it
+	Timezone   string     `json:"timezone,omitempty"`
+	Schedules  []Schedule `json:"schedules,omitempty"`
+	QuietHours QuietHours `json:"quiet_hours,omitempty"`
+	Nudges     Nudges     `json:"nudges,omitempty"`
+	// LastFocusAt is when the latest focus session ended, or when the
+	// running one is planned to end
+	LastFocusAt time.Time `json:"last_focus_at,omitempty"`
+	// PartnerInvite is the pending invite for an accountability partner
+	PartnerInvite PartnerInvite `json:"partner_invite,omitempty"`
 }
 
 type Users struct {
@@ -71,17 +86,30 @@ func (u *User) getActionContextField(field string) (string, error) {
 func (u *Users) add(chatId ChatId, user User) (result bool) {
 	u.mut.Lock()
 	if _, ok := u.data[chatId]; ok {
-		log.Printf("User with chat id [%v] already exists", chatId)
 		result = false
 	} else {
 		u.data[chatId] = user
-		log.Printf("user with chat id [%v] added to the list", chatId)
 		result = true
 	}
 	u.mut.Unlock()
 	return
 }
 
+// get returns a copy of the user, safe to use while other goroutines
+// update the users.
+func (u *Users) get(chatId ChatId) (User, bool) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	user, ok := u.data[chatId]
+	return user, ok
+}
+
+func (u *Users) remove(chatId ChatId) {
+	u.mut.Lock()
+	delete(u.data, chatId)
+	u.mut.Unlock()
+}
+
 func (u *Users) updateUser(chatId ChatId, user User) error {
 	u.mut.Lock()
 	if _, ok := u.data[chatId]; ok {
@@ -93,15 +121,31 @@ func (u *Users) updateUser(chatId ChatId, user User) error {
 	return nil
 }
 
+// rememberTag moves the tag to the front of the recent tags of the user.
+func (u *Users) rememberTag(chatId ChatId, tag string) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	user, ok := u.data[chatId]
+	if !ok {
+		return
+	}
+	tags := []string{tag}
+	for _, t := range user.Tags {
+		if t != tag && len(tags) < maxRecentTags {
+			tags = append(tags, t)
+		}
+	}
+	user.Tags = tags
+	u.data[chatId] = user
+}
+
 func (u *Users) saveLastUserAction(chatId ChatId, action UserAction) {
 	u.mut.Lock()
 	if user, ok := u.data[chatId]; ok {
 		user.LastAction = action
 		u.data[chatId] = user
-
-		log.Printf("user with chat id [%v] updated with last action [%v]", chatId, action)
 	} else {
-		log.Printf("user with chat id [%v] not found", chatId)
+		logger.warn("user is not found", "chat_id", chatId)
 	}
 	u.mut.Unlock()
 }
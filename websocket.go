@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A websocket client after RFC 6455 that knows just enough for the Discord
+// gateway: text messages, answering pings and closing.
+
+const (
+	WS_OP_TEXT  = 0x1
+	WS_OP_CLOSE = 0x8
+	WS_OP_PING  = 0x9
+	WS_OP_PONG  = 0xA
+)
+
+const (
+	wsAcceptGuid       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize   = 4 << 20
+	wsCloseNormal      = 1000
+	wsHandshakeTimeout = 10 * time.Second
+)
+
+type wsConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	writeMut sync.Mutex
+}
+
+func wsAcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + wsAcceptGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// dialWebsocket connects to a ws:// or wss:// url and performs the opening
+// handshake.
+func dialWebsocket(rawUrl string) (*wsConn, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: wsHandshakeTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", hostWithPort(u, "80"))
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostWithPort(u, "443"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme [%v]", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes := make([]byte, 16)
+	_, err = rand.Read(keyBytes)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	_, err = fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %v\r\nSec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "GET", URL: u})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed, status code - [%v]", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed, unexpected accept key")
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, reader: reader}, nil
+}
+
+func hostWithPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// readMessage returns the next text or binary message, control frames in
+// between are handled on the way. A close frame ends with io.EOF.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case WS_OP_PING:
+			err = c.writeFrame(WS_OP_PONG, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case WS_OP_PONG:
+			continue
+		case WS_OP_CLOSE:
+			if len(payload) >= 2 {
+				return nil, fmt.Errorf("websocket closed, code - [%v], reason - [%s]: %w",
+					binary.BigEndian.Uint16(payload), payload[2:], io.EOF)
+			}
+			return nil, io.EOF
+		}
+		if len(message)+len(payload) > wsMaxMessageSize {
+			return nil, fmt.Errorf("websocket message is larger than %v bytes", wsMaxMessageSize)
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	_, err = io.ReadFull(c.reader, header)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, ext)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, ext)
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, fmt.Errorf("websocket frame is larger than %v bytes", wsMaxMessageSize)
+	}
+	mask := make([]byte, 4)
+	if masked {
+		_, err = io.ReadFull(c.reader, mask)
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame sends a single unfragmented frame, clients have to mask
+// everything they send.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	mask := make([]byte, 4)
+	_, err := rand.Read(mask)
+	if err != nil {
+		return err
+	}
+	frame := []byte{0x80 | op}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 0x80|126, byte(length>>8), byte(length))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(length))
+		frame = append(append(frame, 0x80|127), ext...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) writeText(data []byte) error {
+	return c.writeFrame(WS_OP_TEXT, data)
+}
+
+// close says goodbye to the server and closes the connection, it is safe
+// to call more than once.
+func (c *wsConn) close() error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, wsCloseNormal)
+	c.writeFrame(WS_OP_CLOSE, payload)
+	return c.conn.Close()
+}
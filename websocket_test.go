@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// acceptTestWebsocket is the server side of the handshake, reading from
+// the returned connection unmasks what the client sends.
+func acceptTestWebsocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %v\r\n\r\n", wsAcceptKey(r.Header.Get("Sec-WebSocket-Key")))
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// writeServerFrame sends a frame the way servers do, without a mask.
+func writeServerFrame(c *wsConn, fin bool, op byte, payload []byte) error {
+	first := op
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(len(payload)))
+		frame = append(append(frame, 127), ext...)
+	}
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+func TestWebsocketMessages(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	serverErr := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := acceptTestWebsocket(w, r)
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.conn.Close()
+		serverErr <- func() error {
+			// a ping between the fragments of a message is answered
+			for _, frame := range []struct {
+				fin     bool
+				op      byte
+				payload string
+			}{
+				{false, WS_OP_TEXT, "hel"},
+				{true, WS_OP_PING, "ping"},
+				{true, 0, "lo"},
+			} {
+				err := writeServerFrame(conn, frame.fin, frame.op, []byte(frame.payload))
+				if err != nil {
+					return err
+				}
+			}
+			_, op, payload, err := conn.readFrame()
+			if err != nil || op != WS_OP_PONG || string(payload) != "ping" {
+				return fmt.Errorf("expected a pong, got opcode %v %q, err %v", op, payload, err)
+			}
+			message, err := conn.readMessage()
+			if err != nil || string(message) != "hi" {
+				return fmt.Errorf("expected hi from the client, got %q, err %v", message, err)
+			}
+			err = writeServerFrame(conn, true, WS_OP_TEXT, []byte(long))
+			if err != nil {
+				return err
+			}
+			closing := make([]byte, 2)
+			binary.BigEndian.PutUint16(closing, wsCloseNormal)
+			return writeServerFrame(conn, true, WS_OP_CLOSE, append(closing, "bye"...))
+		}()
+	}))
+	defer server.Close()
+
+	conn, err := dialWebsocket("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.close()
+	message, err := conn.readMessage()
+	if err != nil || string(message) != "hello" {
+		t.Fatalf("expected the fragments joined, got %q, err %v", message, err)
+	}
+	err = conn.writeText([]byte("hi"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	message, err = conn.readMessage()
+	if err != nil || !bytes.Equal(message, []byte(long)) {
+		t.Fatalf("unexpected long message of %v bytes, err %v", len(message), err)
+	}
+	_, err = conn.readMessage()
+	if !errors.Is(err, io.EOF) || !strings.Contains(err.Error(), "bye") {
+		t.Fatalf("expected the close frame to end with io.EOF, got %v", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+}
+
+func TestWebsocketHandshakeFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, err := dialWebsocket("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("expected the handshake to fail with the status code, got %v", err)
+	}
+	_, err = dialWebsocket("http" + strings.TrimPrefix(server.URL, "http"))
+	if err == nil {
+		t.Fatalf("expected an error for a url that is not a websocket")
+	}
+}